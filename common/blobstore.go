@@ -35,14 +35,429 @@
 
 package common
 
-import "io"
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultListPageSize is the number of blobs returned by BlobStore.List when no page size is given
+const DefaultListPageSize = 1000
 
 // BlobStore describes an form of storage targeted at storing files, regardless of the data they
 // embed. A file is stored under a given key that can be used for further retrieval. It aims at
-// abstracting disk storage as well as Amazon S3 (and alike) distributed storage platforms
+// abstracting disk storage as well as Amazon S3 (and alike) distributed storage platforms.
+// Implementations map their errors onto ErrNotFound, ErrAlreadyExists, ErrPermission and
+// ErrInvalidKey where relevant, to be checked with errors.Is().
 type BlobStore interface {
 	Put(key string, data io.Reader, size int64) error
 	Get(key string) (data io.ReadCloser, err error)
 	Delete(key string) error
 	Rename(key string, newKey string) error
+
+	// Stat returns information on the blob living under the given key
+	Stat(key string) (info *BlobInfo, err error)
+
+	// Exists returns true if there is a blob under the given key. A missing key isn't an error.
+	Exists(key string) (bool, error)
+
+	// List returns a page of at most pageSize blobs whose keys start with prefix, in lexicographical
+	// order. pageToken must be empty for the first page, and set to the previous page's NextPageToken
+	// to get the following ones.
+	List(prefix string, pageToken string, pageSize int) (page *BlobPage, err error)
+}
+
+// BlobInfo describes a blob stored in a BlobStore
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+
+	// ContentHash is a digest of the blob prefixed by the name of the hash function (for instance
+	// "md5:9e10...") or an empty string if the backend doesn't provide one
+	ContentHash string
+
+	// Metadata holds user defined metadata, with lower case keys. It is only filled by Stat.
+	Metadata map[string]string
+
+	// Version identifies the current content of a blob (its generation on Google Cloud Storage, its
+	// ETag on S3 and Azure) on the stores implementing ConditionalDeleteBlobStore. It is empty on the
+	// other ones.
+	Version string
+}
+
+// BlobPage is a page of results returned by BlobStore.List
+type BlobPage struct {
+	Blobs []BlobInfo
+
+	// NextPageToken is empty when there are no more results
+	NextPageToken string
+}
+
+// ContextBlobStore is a BlobStore whose operations can be bound to a context, so that long-running
+// transfers can be cancelled or given a deadline. The context-less methods of its implementations
+// behave as if they were called with context.Background().
+type ContextBlobStore interface {
+	BlobStore
+
+	PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error
+	GetWithContext(ctx context.Context, key string) (data io.ReadCloser, err error)
+	DeleteWithContext(ctx context.Context, key string) error
+	RenameWithContext(ctx context.Context, key string, newKey string) error
+	StatWithContext(ctx context.Context, key string) (info *BlobInfo, err error)
+	ExistsWithContext(ctx context.Context, key string) (bool, error)
+	ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (page *BlobPage, err error)
+}
+
+// MetadataBlobStore is implemented by blob stores that can attach user defined metadata to the blobs
+// they store. The metadata is returned by Stat.
+type MetadataBlobStore interface {
+	ContextBlobStore
+
+	PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error
+
+	// SetMetadata replaces the metadata of an existing blob
+	SetMetadata(ctx context.Context, key string, metadata map[string]string) error
+}
+
+// RangeBlobStore is implemented by blob stores that can read a part of a blob without streaming it
+// entirely
+type RangeBlobStore interface {
+	ContextBlobStore
+
+	// GetRange returns a reader on length bytes of a blob, starting at offset. A negative length
+	// stands for "up to the end of the blob". Fewer than length bytes are returned if the blob ends
+	// before offset + length. Negative offsets are rejected with ErrInvalidRange.
+	GetRange(key string, offset int64, length int64) (data io.ReadCloser, err error)
+	GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (data io.ReadCloser, err error)
+}
+
+// ConditionalBlobStore is implemented by blob stores that can copy blobs server-side and write
+// blobs without ever overwriting an existing one. The IfAbsent operations fail with
+// ErrAlreadyExists if there already is a blob under the destination key, even if it is being
+// written concurrently.
+type ConditionalBlobStore interface {
+	ContextBlobStore
+
+	// Copy copies a blob (and its metadata) to dst, overwriting any existing blob
+	Copy(src string, dst string) error
+	CopyWithContext(ctx context.Context, src string, dst string) error
+
+	PutIfAbsent(key string, data io.Reader, size int64) error
+	PutIfAbsentWithContext(ctx context.Context, key string, data io.Reader, size int64) error
+
+	RenameIfAbsent(key string, newKey string) error
+	RenameIfAbsentWithContext(ctx context.Context, key string, newKey string) error
+}
+
+// ConditionalDeleteBlobStore is implemented by blob stores that can atomically delete a blob only if
+// it hasn't been modified since it was listed or stat'ed
+type ConditionalDeleteBlobStore interface {
+	ContextBlobStore
+
+	// DeleteIfUnchanged deletes a blob if its version (see BlobInfo.Version) still is version, and
+	// fails with ErrModified otherwise
+	DeleteIfUnchanged(ctx context.Context, key string, version string) error
+}
+
+// SignedURLBlobStore is implemented by blob stores that can hand out temporary URLs to a blob, so
+// that clients transfer its content directly from (or to) the underlying storage. Decorators that
+// transform the content of blobs (encryption, compression...) don't implement it.
+type SignedURLBlobStore interface {
+	BlobStore
+
+	// SignedURL returns a URL granting method (GET, HEAD or PUT) on a blob for ttl, without further
+	// authentication
+	SignedURL(key string, method string, ttl time.Duration) (string, error)
+}
+
+// signedURLMethod normalizes and checks the HTTP method of a signed URL
+func signedURLMethod(method string) (string, error) {
+	method = strings.ToUpper(method)
+	switch method {
+	case "GET", "HEAD", "PUT":
+		return method, nil
+	}
+	return "", fmt.Errorf("[blobstore] Unsupported method %q for a signed URL", method)
+}
+
+// checkSignedURLRequest checks the key and lifetime of a signed URL, and returns its normalized
+// method
+func checkSignedURLRequest(key string, method string, ttl time.Duration) (string, error) {
+	method, err := signedURLMethod(method)
+	if err != nil {
+		return "", err
+	}
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+	if ttl <= 0 {
+		return "", fmt.Errorf("[blobstore] Invalid signed URL lifetime %s", ttl)
+	}
+	return method, nil
+}
+
+// CopyBlob copies a blob within store. Stores that can't copy blobs server-side are handled by
+// downloading the blob and uploading it again (along with its metadata, if store supports it).
+func CopyBlob(ctx context.Context, store BlobStore, src string, dst string) error {
+	if cstore, ok := store.(ConditionalBlobStore); ok {
+		return cstore.CopyWithContext(ctx, src, dst)
+	}
+
+	cstore := AsContextBlobStore(store)
+	info, err := cstore.StatWithContext(ctx, src)
+	if err != nil {
+		return err
+	}
+	rc, err := cstore.GetWithContext(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if mstore, ok := store.(MetadataBlobStore); ok {
+		return mstore.PutWithMetadata(ctx, dst, rc, info.Size, info.Metadata)
+	}
+	return cstore.PutWithContext(ctx, dst, rc, info.Size)
+}
+
+// GetBlobRange performs a ranged read on store, as described by RangeBlobStore.GetRange. Stores that
+// don't support ranged reads are handled by discarding the first offset bytes of the blob.
+func GetBlobRange(ctx context.Context, store BlobStore, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	if rstore, ok := store.(RangeBlobStore); ok {
+		return rstore.GetRangeWithContext(ctx, key, offset, length)
+	}
+
+	rc, err := AsContextBlobStore(store).GetWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return limitReadCloser(rc, length), nil
+}
+
+// checkBlobRange rejects the ranged reads starting at a negative offset
+func checkBlobRange(key string, offset int64) error {
+	if offset < 0 {
+		return newBlobError(ErrInvalidRange, key, fmt.Errorf("[blobstore] Negative offset %d in ranged read of blob %s", offset, key))
+	}
+	return nil
+}
+
+// NewBlobReaderAt returns an io.ReaderAt on a blob, every call to ReadAt resulting in a ranged read
+func NewBlobReaderAt(ctx context.Context, store BlobStore, key string) io.ReaderAt {
+	return &blobReaderAt{ctx: ctx, store: store, key: key}
+}
+
+type blobReaderAt struct {
+	ctx   context.Context
+	store BlobStore
+	key   string
+}
+
+func (r *blobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	rc, err := GetBlobRange(r.ctx, r.store, r.key, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// limitReadCloser returns an io.ReadCloser reading at most n bytes of rc, or all of them if n is
+// negative
+func limitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+	return &readCloser{Reader: io.LimitReader(rc, n), Closer: rc}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// WalkBlobs calls fn for every blob of store whose key starts with prefix, going through all the
+// pages returned by List. It stops at the first error returned by fn.
+func WalkBlobs(ctx context.Context, store BlobStore, prefix string, fn func(info BlobInfo) error) error {
+	cstore := AsContextBlobStore(store)
+	pageToken := ""
+	for {
+		page, err := cstore.ListWithContext(ctx, prefix, pageToken, DefaultListPageSize)
+		if err != nil {
+			return err
+		}
+		for _, info := range page.Blobs {
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// AsContextBlobStore returns store as a ContextBlobStore. Stores that don't support contexts
+// natively are wrapped: the context is then checked before each operation and while data is being
+// streamed.
+func AsContextBlobStore(store BlobStore) ContextBlobStore {
+	if s, ok := store.(ContextBlobStore); ok {
+		return s
+	}
+	return &contextBlobStoreAdapter{BlobStore: store}
+}
+
+type contextBlobStoreAdapter struct {
+	BlobStore
+}
+
+func (s *contextBlobStoreAdapter) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Put(key, newContextReader(ctx, data), size)
+}
+
+func (s *contextBlobStoreAdapter) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r, err := s.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return newContextReadCloser(ctx, r), nil
+}
+
+func (s *contextBlobStoreAdapter) DeleteWithContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Delete(key)
+}
+
+func (s *contextBlobStoreAdapter) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Rename(key, newKey)
+}
+
+func (s *contextBlobStoreAdapter) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.Stat(key)
+}
+
+func (s *contextBlobStoreAdapter) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return s.Exists(key)
+}
+
+func (s *contextBlobStoreAdapter) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return s.List(prefix, pageToken, pageSize)
+}
+
+// InvalidKeyError is returned by blob stores for keys they refuse to handle. Keys are slash
+// separated paths, and must not be empty nor absolute nor contain empty, "." or ".." elements.
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (err *InvalidKeyError) Error() string {
+	return fmt.Sprintf("Invalid blob key %q: %s", err.Key, err.Reason)
+}
+
+// Is makes errors.Is(err, ErrInvalidKey) true
+func (err *InvalidKeyError) Is(target error) bool {
+	return target == ErrInvalidKey
+}
+
+// validateBlobKey checks that a key is a relative, normalized, slash separated path
+func validateBlobKey(key string) error {
+	switch {
+	case key == "":
+		return &InvalidKeyError{Key: key, Reason: "empty key"}
+	case strings.HasPrefix(key, "/") || filepath.IsAbs(key):
+		return &InvalidKeyError{Key: key, Reason: "absolute path"}
+	case strings.ContainsRune(key, 0) || strings.ContainsRune(key, '\\'):
+		return &InvalidKeyError{Key: key, Reason: "forbidden character"}
+	}
+
+	for _, elem := range strings.Split(key, "/") {
+		switch elem {
+		case "", ".":
+			return &InvalidKeyError{Key: key, Reason: "empty path element"}
+		case "..":
+			return &InvalidKeyError{Key: key, Reason: "path traversal"}
+		}
+	}
+	return nil
+}
+
+// lowerKeys returns a copy of metadata with lower case keys
+func lowerKeys(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		ret[strings.ToLower(k)] = v
+	}
+	return ret
+}
+
+// contextReader is an io.Reader that stops reading (and returns the context's error) as soon as its
+// context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+type contextReadCloser struct {
+	contextReader
+	io.Closer
+}
+
+func newContextReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return &contextReadCloser{
+		contextReader: contextReader{ctx: ctx, r: rc},
+		Closer:        rc,
+	}
 }
@@ -0,0 +1,657 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	azureAPIVersion = "2019-12-12"
+
+	// Blobs bigger than azureBlockSize (or of unknown size) are uploaded block by block
+	azureBlockSize = 16 * 1024 * 1024
+
+	azureCopyPollInterval = 500 * time.Millisecond
+)
+
+// AzureConfig describes how to reach an Azure Blob Storage container
+type AzureConfig struct {
+	Account   string
+	Container string
+
+	// AccountKey is the base64 encoded storage account key, used for Shared Key authentication.
+	// If it is empty, SASToken is appended to requests instead (and if both are empty, requests
+	// are anonymous).
+	AccountKey string
+	SASToken   string
+
+	// Endpoint is the blob service endpoint, defaulting to https://<account>.blob.core.windows.net.
+	// Emulators such as Azurite use path-style endpoints, like http://127.0.0.1:10000/<account>.
+	Endpoint string
+
+	// Client is the HTTP client to use (http.DefaultClient if nil)
+	Client *http.Client
+}
+
+// AzureBlobStore is a BlobStore implementation storing blobs in an Azure Blob Storage container
+type AzureBlobStore struct {
+	conf       AzureConfig
+	endpoint   *url.URL
+	accountKey []byte
+	sasQuery   url.Values
+}
+
+// NewAzureBlobStore creates a new AzureBlobStore
+func NewAzureBlobStore(conf AzureConfig) (*AzureBlobStore, error) {
+	if conf.Account == "" || conf.Container == "" {
+		return nil, fmt.Errorf("[azure-storage] Account and container are required")
+	}
+	if conf.Endpoint == "" {
+		conf.Endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", conf.Account)
+	}
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+
+	s := &AzureBlobStore{conf: conf}
+	var err error
+	if s.endpoint, err = url.Parse(strings.TrimSuffix(conf.Endpoint, "/")); err != nil {
+		return nil, fmt.Errorf("[azure-storage] Invalid endpoint %s: %s", conf.Endpoint, err)
+	}
+	if conf.AccountKey != "" {
+		if s.accountKey, err = base64.StdEncoding.DecodeString(conf.AccountKey); err != nil {
+			return nil, fmt.Errorf("[azure-storage] Invalid account key (it should be base64 encoded): %s", err)
+		}
+	}
+	if conf.SASToken != "" {
+		if s.sasQuery, err = url.ParseQuery(strings.TrimPrefix(conf.SASToken, "?")); err != nil {
+			return nil, fmt.Errorf("[azure-storage] Invalid SAS token: %s", err)
+		}
+	}
+	return s, nil
+}
+
+// Put uploads a blob to the container
+func (s *AzureBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext uploads a blob to the container
+func (s *AzureBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, data, size, nil)
+}
+
+// PutWithMetadata uploads a blob to the container, with user-defined metadata. Small blobs are
+// uploaded in a single Put Blob request, bigger ones (or ones of unknown size) block by block.
+func (s *AzureBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	return s.put(ctx, key, data, size, metadata, false)
+}
+
+// PutIfAbsent uploads a blob to the container, unless there already is a blob under the same key
+func (s *AzureBlobStore) PutIfAbsent(key string, data io.Reader, size int64) error {
+	return s.PutIfAbsentWithContext(context.Background(), key, data, size)
+}
+
+// PutIfAbsentWithContext uploads a blob to the container, unless there already is a blob under the
+// same key (using an If-None-Match: * condition)
+func (s *AzureBlobStore) PutIfAbsentWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.put(ctx, key, data, size, nil, true)
+}
+
+func (s *AzureBlobStore) put(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string, ifAbsent bool) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	if size < 0 || size > azureBlockSize {
+		return s.putBlocks(ctx, key, data, metadata, ifAbsent)
+	}
+
+	header := azureMetadataHeader(metadata)
+	header.Set("x-ms-blob-type", "BlockBlob")
+	if ifAbsent {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, header, data, size)
+	if err != nil {
+		return err
+	}
+	return s.expect(resp, http.StatusCreated)
+}
+
+// putBlocks uploads a blob with a sequence of Put Block requests, committed by a Put Block List
+// request
+func (s *AzureBlobStore) putBlocks(ctx context.Context, key string, data io.Reader, metadata map[string]string, ifAbsent bool) error {
+	var blockIDs []string
+	buf := make([]byte, azureBlockSize)
+	for {
+		n, err := io.ReadFull(data, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("[azure-storage] Error reading data for blob %s: %s", key, err)
+		}
+		// An empty blob is committed with an empty block list, rather than with an empty block
+		if n == 0 {
+			break
+		}
+
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], uint64(len(blockIDs)))
+		blockID := base64.StdEncoding.EncodeToString(id[:])
+		query := url.Values{"comp": {"block"}, "blockid": {blockID}}
+		resp, reqErr := s.do(ctx, http.MethodPut, key, query, nil, bytes.NewReader(buf[:n]), int64(n))
+		if reqErr != nil {
+			return reqErr
+		}
+		if reqErr = s.expect(resp, http.StatusCreated); reqErr != nil {
+			return reqErr
+		}
+		blockIDs = append(blockIDs, blockID)
+
+		if err != nil {
+			break
+		}
+	}
+
+	var blockList bytes.Buffer
+	blockList.WriteString(`<?xml version="1.0" encoding="utf-8"?><BlockList>`)
+	for _, id := range blockIDs {
+		blockList.WriteString("<Latest>" + id + "</Latest>")
+	}
+	blockList.WriteString("</BlockList>")
+
+	header := azureMetadataHeader(metadata)
+	header.Set("Content-Type", "application/xml")
+	if ifAbsent {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, url.Values{"comp": {"blocklist"}}, header, &blockList, int64(blockList.Len()))
+	if err != nil {
+		return err
+	}
+	return s.expect(resp, http.StatusCreated)
+}
+
+// SetMetadata replaces the user-defined metadata of a blob
+func (s *AzureBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, url.Values{"comp": {"metadata"}}, azureMetadataHeader(metadata), nil, 0)
+	if err != nil {
+		return err
+	}
+	return s.expect(resp, http.StatusOK)
+}
+
+// Get downloads a blob from the container
+func (s *AzureBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext downloads a blob from the container
+func (s *AzureBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(ctx, key, 0, -1)
+}
+
+// GetRange downloads a part of a blob from the container
+func (s *AzureBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext downloads a part of a blob from the container
+func (s *AzureBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	if err := validateBlobKey(key); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	header := http.Header{}
+	if offset > 0 || length > 0 {
+		header.Set("x-ms-range", httpRange(offset, length))
+	}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	default:
+		return nil, newHTTPStatusError("[azure-storage]", resp)
+	}
+}
+
+// Delete deletes a blob from the container
+func (s *AzureBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a blob from the container
+func (s *AzureBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	return s.expect(resp, http.StatusAccepted)
+}
+
+// DeleteIfUnchanged deletes a blob, with an If-Match condition on its ETag
+func (s *AzureBlobStore) DeleteIfUnchanged(ctx context.Context, key string, version string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("If-Match", version)
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return conditionalBlobError(resp.StatusCode, key, newHTTPStatusError("[azure-storage]", resp))
+	}
+	return s.expect(resp, http.StatusAccepted)
+}
+
+// Rename copies a blob to its new key (with a Copy Blob request), then deletes the original one
+func (s *AzureBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext copies a blob to its new key (with a Copy Blob request), then deletes the
+// original one
+func (s *AzureBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if err := s.copy(ctx, key, newKey, false); err != nil {
+		return err
+	}
+	return s.DeleteWithContext(ctx, key)
+}
+
+// RenameIfAbsent renames a blob, unless there already is a blob under the new key
+func (s *AzureBlobStore) RenameIfAbsent(key string, newKey string) error {
+	return s.RenameIfAbsentWithContext(context.Background(), key, newKey)
+}
+
+// RenameIfAbsentWithContext renames a blob, unless there already is a blob under the new key (the
+// copy being made with an If-None-Match: * condition)
+func (s *AzureBlobStore) RenameIfAbsentWithContext(ctx context.Context, key string, newKey string) error {
+	if err := s.copy(ctx, key, newKey, true); err != nil {
+		return err
+	}
+	return s.DeleteWithContext(ctx, key)
+}
+
+// Copy copies a blob (and its metadata) with a Copy Blob request
+func (s *AzureBlobStore) Copy(src string, dst string) error {
+	return s.CopyWithContext(context.Background(), src, dst)
+}
+
+// CopyWithContext copies a blob (and its metadata) with a Copy Blob request
+func (s *AzureBlobStore) CopyWithContext(ctx context.Context, src string, dst string) error {
+	return s.copy(ctx, src, dst, false)
+}
+
+// copy copies a blob with a Copy Blob request, and waits for the copy to complete
+func (s *AzureBlobStore) copy(ctx context.Context, key string, newKey string, ifAbsent bool) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	if err := validateBlobKey(newKey); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("x-ms-copy-source", s.blobURL(key, nil).String())
+	if ifAbsent {
+		header.Set("If-None-Match", "*")
+	}
+	resp, err := s.do(ctx, http.MethodPut, newKey, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	status := resp.Header.Get("x-ms-copy-status")
+	if err := s.expect(resp, http.StatusAccepted); err != nil {
+		return err
+	}
+
+	// Copies within a storage account are usually synchronous, but may not be
+	for status == "pending" {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("[azure-storage] Error waiting for the copy of blob %s to %s: %s", key, newKey, ctx.Err())
+		case <-time.After(azureCopyPollInterval):
+		}
+		resp, err := s.do(ctx, http.MethodHead, newKey, nil, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		status = resp.Header.Get("x-ms-copy-status")
+		if err := s.expect(resp, http.StatusOK); err != nil {
+			return err
+		}
+	}
+	if status != "success" {
+		return fmt.Errorf("[azure-storage] Error copying blob %s to %s: copy status is %q", key, newKey, status)
+	}
+	return nil
+}
+
+// Stat returns information on a blob
+func (s *AzureBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on a blob
+func (s *AzureBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if err := validateBlobKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.expect(resp, http.StatusOK); err != nil {
+		return nil, err
+	}
+
+	info := &BlobInfo{
+		Key:         key,
+		Size:        resp.ContentLength,
+		ContentHash: azureContentHash(resp.Header.Get("Content-MD5"), resp.Header.Get("ETag")),
+		Metadata:    map[string]string{},
+		Version:     azureVersion(resp.Header.Get("ETag")),
+	}
+	info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	for name, values := range resp.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-ms-meta-") && len(values) > 0 {
+			info.Metadata[strings.TrimPrefix(name, "x-ms-meta-")] = values[0]
+		}
+	}
+	return info, nil
+}
+
+// Exists checks whether a blob exists
+func (s *AzureBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether a blob exists
+func (s *AzureBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	_, err := s.StatWithContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List lists the blobs of the container whose key starts with prefix
+func (s *AzureBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+type azureEnumerationResults struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  string `xml:"Last-Modified"`
+			ContentLength int64  `xml:"Content-Length"`
+			ContentMD5    string `xml:"Content-MD5"`
+			Etag          string `xml:"Etag"`
+		} `xml:"Properties"`
+		Metadata struct {
+			Items []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"Metadata"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// ListWithContext lists the blobs of the container whose key starts with prefix
+func (s *AzureBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	query := url.Values{
+		"restype":    {"container"},
+		"comp":       {"list"},
+		"include":    {"metadata"},
+		"maxresults": {strconv.Itoa(pageSize)},
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if pageToken != "" {
+		query.Set("marker", pageToken)
+	}
+
+	resp, err := s.do(ctx, http.MethodGet, "", query, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPStatusError("[azure-storage]", resp)
+	}
+	defer resp.Body.Close()
+
+	var results azureEnumerationResults
+	if err := xml.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, fmt.Errorf("[azure-storage] Error parsing blob list of container %s: %s", s.conf.Container, err)
+	}
+
+	page := &BlobPage{NextPageToken: results.NextMarker}
+	for _, blob := range results.Blobs {
+		info := BlobInfo{
+			Key:         blob.Name,
+			Size:        blob.Properties.ContentLength,
+			ContentHash: azureContentHash(blob.Properties.ContentMD5, blob.Properties.Etag),
+			Metadata:    map[string]string{},
+			Version:     azureVersion(blob.Properties.Etag),
+		}
+		info.ModTime, _ = http.ParseTime(blob.Properties.LastModified)
+		for _, item := range blob.Metadata.Items {
+			info.Metadata[strings.ToLower(item.XMLName.Local)] = item.Value
+		}
+		page.Blobs = append(page.Blobs, info)
+	}
+	return page, nil
+}
+
+// azureContentHash turns the base64 encoded Content-MD5 of a blob into a BlobInfo.ContentHash,
+// falling back on its ETag (blobs uploaded block by block have no Content-MD5)
+func azureContentHash(contentMD5 string, etag string) string {
+	if sum, err := base64.StdEncoding.DecodeString(contentMD5); err == nil && len(sum) > 0 {
+		return "md5:" + hex.EncodeToString(sum)
+	}
+	if etag = strings.Trim(etag, `"`); etag != "" {
+		return "etag:" + etag
+	}
+	return ""
+}
+
+// azureVersion turns the ETag of a blob into a BlobInfo.Version, quoting it as in If-Match headers
+// (the ETags of blob listings aren't quoted)
+func azureVersion(etag string) string {
+	if etag = strings.Trim(etag, `"`); etag != "" {
+		return `"` + etag + `"`
+	}
+	return ""
+}
+
+func azureMetadataHeader(metadata map[string]string) http.Header {
+	header := http.Header{}
+	for name, value := range metadata {
+		header.Set("x-ms-meta-"+strings.ToLower(name), value)
+	}
+	return header
+}
+
+// blobURL returns the URL of a blob ("" being the container itself)
+func (s *AzureBlobStore) blobURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	u.Path = u.Path + "/" + s.conf.Container
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = ""
+
+	q := url.Values{}
+	for name, values := range query {
+		q[name] = values
+	}
+	if s.accountKey == nil {
+		for name, values := range s.sasQuery {
+			q[name] = values
+		}
+	}
+	u.RawQuery = q.Encode()
+	return &u
+}
+
+func (s *AzureBlobStore) do(ctx context.Context, method string, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u := s.blobURL(key, query)
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("[azure-storage] Error building %s request against %s: %s", method, u.Path, err)
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[http.CanonicalHeaderKey(name)] = values
+	}
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	if s.accountKey != nil {
+		req.Header.Set("Authorization", "SharedKey "+s.conf.Account+":"+s.sign(req))
+	}
+
+	resp, err := s.conf.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("[azure-storage] Error performing %s request against %s: %s", method, u.Path, err)
+	}
+	return resp, nil
+}
+
+// sign computes the Shared Key signature of a request, as described in
+// https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (s *AzureBlobStore) sign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	var msHeaders []string
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-ms-") {
+			msHeaders = append(msHeaders, name+":"+strings.TrimSpace(strings.Join(values, ",")))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + s.conf.Account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for name, values := range query {
+		sort.Strings(values)
+		params = append(params, strings.ToLower(name)+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		resource += "\n" + param
+	}
+
+	stringToSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date (x-ms-date is used instead)
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(msHeaders, "\n") + "\n" + resource
+
+	mac := hmac.New(sha256.New, s.accountKey)
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// expect checks the status code of a response, and closes its body
+func (s *AzureBlobStore) expect(resp *http.Response, statusCode int) error {
+	if resp.StatusCode != statusCode {
+		return newHTTPStatusError("[azure-storage]", resp)
+	}
+	resp.Body.Close()
+	return nil
+}
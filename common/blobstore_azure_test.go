@@ -0,0 +1,573 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// azuriteAccountKey is the well-known account key of the Azure storage emulators
+const azuriteAccountKey = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+
+// fakeAzure is a minimal, in-memory, Azure Blob Storage server (in the fashion of Azurite) serving
+// a single container with path-style addressing. It only accepts requests bearing a valid Shared
+// Key signature.
+type fakeAzure struct {
+	account    string
+	container  string
+	accountKey []byte
+
+	mutex    sync.Mutex
+	blobs    map[string]*fakeAzureBlob
+	blocks   map[string]map[string][]byte
+	requests []string
+}
+
+type fakeAzureBlob struct {
+	data       []byte
+	metadata   map[string]string
+	contentMD5 string
+	etag       string
+	modTime    time.Time
+}
+
+func newFakeAzure(t *testing.T) (*fakeAzure, *AzureBlobStore) {
+	accountKey, err := base64.StdEncoding.DecodeString(azuriteAccountKey)
+	require.NoError(t, err)
+	f := &fakeAzure{
+		account:    "devstoreaccount1",
+		container:  "morpheo",
+		accountKey: accountKey,
+		blobs:      map[string]*fakeAzureBlob{},
+		blocks:     map[string]map[string][]byte{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	store, err := NewAzureBlobStore(AzureConfig{
+		Account:    f.account,
+		Container:  f.container,
+		AccountKey: azuriteAccountKey,
+		Endpoint:   server.URL + "/" + f.account,
+	})
+	require.NoError(t, err)
+	return f, store
+}
+
+func (f *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.Header.Get("Authorization") != "SharedKey "+f.account+":"+f.signature(r) {
+		f.error(w, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"+f.account+"/"), "/", 2)
+	if path[0] != f.container {
+		f.error(w, http.StatusNotFound, "ContainerNotFound")
+		return
+	}
+	key := ""
+	if len(path) == 2 {
+		key = path[1]
+	}
+	query := r.URL.Query()
+
+	op := r.Method
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("comp") == "list":
+		op = "ListBlobs"
+		f.list(w, r)
+	case r.Method == http.MethodPut && query.Get("comp") == "block":
+		op = "PutBlock"
+		f.putBlock(w, r, key)
+	case r.Method == http.MethodPut && query.Get("comp") == "blocklist":
+		op = "PutBlockList"
+		f.putBlockList(w, r, key)
+	case r.Method == http.MethodPut && query.Get("comp") == "metadata":
+		op = "SetBlobMetadata"
+		f.setMetadata(w, r, key)
+	case r.Method == http.MethodPut && r.Header.Get("x-ms-copy-source") != "":
+		op = "CopyBlob"
+		f.copy(w, r, key)
+	case r.Method == http.MethodPut:
+		op = "PutBlob"
+		f.putBlob(w, r, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		op = "GetBlob"
+		f.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		op = "DeleteBlob"
+		blob, ok := f.blobs[key]
+		if !ok {
+			f.error(w, http.StatusNotFound, "BlobNotFound")
+			break
+		}
+		if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != blob.etag {
+			f.error(w, http.StatusPreconditionFailed, "ConditionNotMet")
+			break
+		}
+		delete(f.blobs, key)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		f.error(w, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+	f.requests = append(f.requests, op)
+}
+
+// signature computes the Shared Key signature a request should bear. Requests against the
+// emulator's path-style endpoint have the account name twice in their canonicalized resource.
+func (f *fakeAzure) signature(r *http.Request) string {
+	var stringToSign bytes.Buffer
+	stringToSign.WriteString(r.Method + "\n")
+	for _, name := range []string{"Content-Encoding", "Content-Language", "Content-Length", "Content-MD5", "Content-Type", "Date", "If-Modified-Since", "If-Match", "If-None-Match", "If-Unmodified-Since", "Range"} {
+		value := r.Header.Get(name)
+		if name == "Content-Length" {
+			value = ""
+			if r.ContentLength > 0 {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		}
+		stringToSign.WriteString(value + "\n")
+	}
+
+	var names []string
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return strings.ToLower(names[i]) < strings.ToLower(names[j]) })
+	for _, name := range names {
+		stringToSign.WriteString(strings.ToLower(name) + ":" + strings.TrimSpace(r.Header.Get(name)) + "\n")
+	}
+
+	stringToSign.WriteString("/" + f.account + r.URL.EscapedPath())
+	query := r.URL.Query()
+	var params []string
+	for name := range query {
+		params = append(params, name)
+	}
+	sort.Strings(params)
+	for _, name := range params {
+		values := query[name]
+		sort.Strings(values)
+		stringToSign.WriteString("\n" + strings.ToLower(name) + ":" + strings.Join(values, ","))
+	}
+
+	mac := hmac.New(sha256.New, f.accountKey)
+	mac.Write(stringToSign.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (f *fakeAzure) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeAzure) count(op string) (n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, request := range f.requests {
+		if request == op {
+			n++
+		}
+	}
+	return n
+}
+
+func fakeAzureMetadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-meta-") {
+			metadata[strings.ToLower(name[len("x-ms-meta-"):])] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+// commit stores a blob, unless the request is conditioned on its absence and it already exists
+func (f *fakeAzure) commit(w http.ResponseWriter, r *http.Request, key string, blob *fakeAzureBlob) bool {
+	if _, ok := f.blobs[key]; ok && r.Header.Get("If-None-Match") == "*" {
+		f.error(w, http.StatusConflict, "BlobAlreadyExists")
+		return false
+	}
+	sum := md5.Sum(blob.data)
+	blob.etag = fmt.Sprintf(`"0x%X"`, sum[:8])
+	blob.modTime = time.Now().UTC()
+	f.blobs[key] = blob
+	w.Header().Set("ETag", blob.etag)
+	return true
+}
+
+func (f *fakeAzure) putBlob(w http.ResponseWriter, r *http.Request, key string) {
+	if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "InvalidInput")
+		return
+	}
+	sum := md5.Sum(data)
+	blob := &fakeAzureBlob{data: data, metadata: fakeAzureMetadata(r.Header), contentMD5: base64.StdEncoding.EncodeToString(sum[:])}
+	if f.commit(w, r, key, blob) {
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (f *fakeAzure) putBlock(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(data) == 0 {
+		// Azure rejects empty blocks
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	if f.blocks[key] == nil {
+		f.blocks[key] = map[string][]byte{}
+	}
+	f.blocks[key][r.URL.Query().Get("blockid")] = data
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeAzure) putBlockList(w http.ResponseWriter, r *http.Request, key string) {
+	var blockList struct {
+		Latest []string `xml:"Latest"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&blockList); err != nil {
+		f.error(w, http.StatusBadRequest, "InvalidXmlDocument")
+		return
+	}
+	var data []byte
+	for _, id := range blockList.Latest {
+		block, ok := f.blocks[key][id]
+		if !ok {
+			f.error(w, http.StatusBadRequest, "InvalidBlockList")
+			return
+		}
+		data = append(data, block...)
+	}
+	if f.commit(w, r, key, &fakeAzureBlob{data: data, metadata: fakeAzureMetadata(r.Header)}) {
+		delete(f.blocks, key)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func (f *fakeAzure) setMetadata(w http.ResponseWriter, r *http.Request, key string) {
+	blob, ok := f.blobs[key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	blob.metadata = fakeAzureMetadata(r.Header)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeAzure) copy(w http.ResponseWriter, r *http.Request, key string) {
+	source, err := url.PathUnescape(r.Header.Get("x-ms-copy-source"))
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	prefix := "/" + f.account + "/" + f.container + "/"
+	i := strings.Index(source, prefix)
+	if i < 0 {
+		f.error(w, http.StatusBadRequest, "InvalidHeaderValue")
+		return
+	}
+	src, ok := f.blobs[source[i+len(prefix):]]
+	if !ok {
+		f.error(w, http.StatusNotFound, "CannotVerifyCopySource")
+		return
+	}
+	blob := *src
+	if f.commit(w, r, key, &blob) {
+		w.Header().Set("x-ms-copy-status", "success")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (f *fakeAzure) get(w http.ResponseWriter, r *http.Request, key string) {
+	blob, ok := f.blobs[key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "BlobNotFound")
+		return
+	}
+	for k, v := range blob.metadata {
+		w.Header().Set("x-ms-meta-"+k, v)
+	}
+	if blob.contentMD5 != "" {
+		w.Header().Set("Content-MD5", blob.contentMD5)
+	}
+	w.Header().Set("ETag", blob.etag)
+	w.Header().Set("Last-Modified", blob.modTime.Format(http.TimeFormat))
+
+	data := blob.data
+	status := http.StatusOK
+	if byteRange := r.Header.Get("x-ms-range"); byteRange != "" {
+		start, end, ok := parseFakeRange(byteRange, int64(len(data)))
+		if !ok {
+			f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// list answers List Blobs requests. Its markers are simply the key of the first blob of the next
+// page.
+func (f *fakeAzure) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	maxResults, _ := strconv.Atoi(query.Get("maxresults"))
+	if maxResults <= 0 {
+		maxResults = 5000
+	}
+	var keys []string
+	for key := range f.blobs {
+		if strings.HasPrefix(key, prefix) && key >= query.Get("marker") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><EnumerationResults><Blobs>`)
+	for i, key := range keys {
+		if i == maxResults {
+			break
+		}
+		blob := f.blobs[key]
+		body.WriteString("<Blob><Name>")
+		xml.EscapeText(&body, []byte(key))
+		fmt.Fprintf(&body, "</Name><Properties><Last-Modified>%s</Last-Modified><Content-Length>%d</Content-Length><Content-MD5>%s</Content-MD5><Etag>%s</Etag></Properties><Metadata>",
+			blob.modTime.Format(http.TimeFormat), len(blob.data), blob.contentMD5, blob.etag)
+		for k, v := range blob.metadata {
+			body.WriteString("<" + k + ">")
+			xml.EscapeText(&body, []byte(v))
+			body.WriteString("</" + k + ">")
+		}
+		body.WriteString("</Metadata></Blob>")
+	}
+	body.WriteString("</Blobs><NextMarker>")
+	if len(keys) > maxResults {
+		xml.EscapeText(&body, []byte(keys[maxResults]))
+	}
+	body.WriteString("</NextMarker></EnumerationResults>")
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(body.Bytes())
+}
+
+func TestAzureBlobStoreSharedKeySignature(t *testing.T) {
+	store, err := NewAzureBlobStore(AzureConfig{
+		Account:    "devstoreaccount1",
+		Container:  "morpheo",
+		AccountKey: azuriteAccountKey,
+		Endpoint:   "http://127.0.0.1:10000/devstoreaccount1",
+	})
+	require.NoError(t, err)
+
+	u := store.blobURL("algo/model.tar", map[string][]string{"comp": {"block"}, "blockid": {"AAAAAAAAAAA="}})
+	req, err := http.NewRequest(http.MethodPut, u.String(), strings.NewReader("model"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("If-None-Match", "*")
+	req.Header.Set("x-ms-version", "2019-12-12")
+	req.Header.Set("x-ms-date", "Sat, 17 Oct 2026 10:00:00 GMT")
+	req.Header.Set("x-ms-meta-owner", " morpheo ")
+
+	stringToSign := "PUT\n\n\n5\n\napplication/octet-stream\n\n\n\n*\n\n\n" +
+		"x-ms-date:Sat, 17 Oct 2026 10:00:00 GMT\nx-ms-meta-owner:morpheo\nx-ms-version:2019-12-12\n" +
+		"/devstoreaccount1/devstoreaccount1/morpheo/algo/model.tar\nblockid:AAAAAAAAAAA=\ncomp:block"
+	mac := hmac.New(sha256.New, store.accountKey)
+	mac.Write([]byte(stringToSign))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(mac.Sum(nil)), store.sign(req))
+}
+
+func TestAzureBlobStoreEmulator(t *testing.T) {
+	ctx := context.Background()
+	f, store := newFakeAzure(t)
+
+	require.NoError(t, store.PutWithMetadata(ctx, "algo/model.tar", strings.NewReader("model"), 5, map[string]string{"Owner": "morpheo"}))
+	assert.Equal(t, 1, f.count("PutBlob"))
+
+	data, err := readBlob(t, store, "algo/model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "model", string(data))
+
+	info, err := store.Stat("algo/model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "morpheo", info.Metadata["owner"])
+	sum := md5.Sum([]byte("model"))
+	assert.Equal(t, "md5:"+hex.EncodeToString(sum[:]), info.ContentHash)
+	assert.False(t, info.ModTime.IsZero())
+
+	rc, err := store.GetRange("algo/model.tar", 1, 3)
+	require.NoError(t, err)
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "ode", string(data))
+
+	err = store.PutIfAbsent("algo/model.tar", strings.NewReader("other"), 5)
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "PutIfAbsent on an existing key: %v", err)
+
+	require.NoError(t, store.SetMetadata(ctx, "algo/model.tar", map[string]string{"owner": "someone else"}))
+	info, err = store.Stat("algo/model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "someone else"}, info.Metadata)
+
+	require.NoError(t, store.Copy("algo/model.tar", "algo/copy.tar"))
+	require.NoError(t, store.Rename("algo/copy.tar", "algo/renamed name.tar"))
+	exists, err := store.Exists("algo/copy.tar")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	info, err = store.Stat("algo/renamed name.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "someone else", info.Metadata["owner"], "copies keep their metadata")
+
+	require.NoError(t, store.Put("data/a", strings.NewReader("a"), 1))
+	var keys []string
+	pageToken := ""
+	for {
+		page, err := store.List("algo/", pageToken, 1)
+		require.NoError(t, err)
+		for _, blob := range page.Blobs {
+			keys = append(keys, blob.Key)
+			assert.Equal(t, "someone else", blob.Metadata["owner"])
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"algo/model.tar", "algo/renamed name.tar"}, keys)
+
+	require.NoError(t, store.Delete("algo/model.tar"))
+	_, err = store.Get("algo/model.tar")
+	assert.True(t, errors.Is(err, ErrNotFound), "Get on a deleted key: %v", err)
+	_, err = store.Stat("algo/model.tar")
+	assert.True(t, errors.Is(err, ErrNotFound), "Stat on a deleted key: %v", err)
+}
+
+func TestAzureBlobStoreDeleteIfUnchanged(t *testing.T) {
+	ctx := context.Background()
+	_, store := newFakeAzure(t)
+
+	require.NoError(t, store.Put("key", strings.NewReader("v1"), 2))
+	info, err := store.Stat("key")
+	require.NoError(t, err)
+	require.NoError(t, store.Put("key", strings.NewReader("v2"), 2))
+	err = store.DeleteIfUnchanged(ctx, "key", info.Version)
+	assert.True(t, errors.Is(err, ErrModified), "DeleteIfUnchanged on a modified blob: %v", err)
+
+	page, err := store.List("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, page.Blobs, 1)
+	require.NoError(t, store.DeleteIfUnchanged(ctx, "key", page.Blobs[0].Version))
+	exists, err := store.Exists("key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestAzureBlobStoreRejectedAccountKey(t *testing.T) {
+	f, store := newFakeAzure(t)
+	f.accountKey = []byte("another account key")
+
+	err := store.Put("key", strings.NewReader("data"), 4)
+	assert.True(t, errors.Is(err, ErrPermission), "Put with a wrong account key: %v", err)
+	_, err = store.Stat("key")
+	assert.True(t, errors.Is(err, ErrPermission), "Stat with a wrong account key: %v", err)
+}
+
+func TestAzureBlobStoreBlockUpload(t *testing.T) {
+	ctx := context.Background()
+	f, store := newFakeAzure(t)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (azureBlockSize+1024)/16)
+	require.NoError(t, store.PutWithMetadata(ctx, "data/large", bytes.NewReader(data), -1, map[string]string{"kind": "dataset"}))
+	assert.Equal(t, 2, f.count("PutBlock"))
+	assert.Equal(t, 1, f.count("PutBlockList"))
+	got, err := readBlob(t, store, "data/large")
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "block upload content mismatch")
+
+	info, err := store.Stat("data/large")
+	require.NoError(t, err)
+	assert.Equal(t, "dataset", info.Metadata["kind"])
+	assert.True(t, strings.HasPrefix(info.ContentHash, "etag:"), "block uploads have no MD5 digest: %s", info.ContentHash)
+
+	// Empty blobs of unknown size are committed with an empty block list
+	require.NoError(t, store.PutWithContext(ctx, "data/empty", bytes.NewReader(nil), -1))
+	assert.Equal(t, 2, f.count("PutBlock"))
+	assert.Equal(t, 2, f.count("PutBlockList"))
+	info, err = store.Stat("data/empty")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size)
+}
@@ -0,0 +1,393 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// cacheSubdir is the directory, inside of the cache directory given to NewCachingBlobStore, where
+// CachingBlobStore keeps its files. Only this directory is emptied when the cache is created, so
+// that pointing the cache to a directory holding other data doesn't wipe it.
+const cacheSubdir = ".blobcache"
+
+// CachingBlobStore fronts a (remote) BlobStore with a bounded on-disk cache, evicting the least
+// recently used blobs first. Concurrent reads of a blob that isn't cached yet result in a single
+// download. Writes, deletions and renames go straight to the underlying store and invalidate the
+// cached blobs they affect, but changes made to the underlying store by other processes aren't
+// detected: it is meant for immutable blobs (that are never overwritten under the same key).
+type CachingBlobStore struct {
+	ContextBlobStore
+
+	cacheDir string
+	maxSize  int64
+
+	mutex   sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	fills   map[string]*cacheFill
+	writes  map[string]int
+	size    int64
+	stats   CacheStats
+}
+
+// CacheStats holds statistics on the use of a CachingBlobStore
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Entries   int
+	Size      int64
+}
+
+type cacheEntry struct {
+	key  string
+	path string
+	size int64
+}
+
+// cacheFill is a download of a blob into the cache, that concurrent readers of the blob wait for
+type cacheFill struct {
+	done chan struct{}
+	err  error
+
+	// stale is set if the blob is written to during the download, which may then have fetched its
+	// previous version
+	stale bool
+}
+
+// NewCachingBlobStore creates a CachingBlobStore caching up to maxSize bytes of the blobs of store
+// in a subdirectory of cacheDir (see cacheSubdir). The cache's content isn't reused between runs:
+// that subdirectory is emptied, and the rest of cacheDir is left untouched.
+func NewCachingBlobStore(store BlobStore, cacheDir string, maxSize int64) (*CachingBlobStore, error) {
+	cacheDir = filepath.Join(cacheDir, cacheSubdir)
+	if err := os.RemoveAll(cacheDir); err != nil {
+		return nil, fmt.Errorf("[cache] Error cleaning cache directory %s: %s", cacheDir, err)
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("[cache] Error creating cache directory %s: %s", cacheDir, err)
+	}
+	return &CachingBlobStore{
+		ContextBlobStore: AsContextBlobStore(store),
+		cacheDir:         cacheDir,
+		maxSize:          maxSize,
+		lru:              list.New(),
+		entries:          map[string]*list.Element{},
+		fills:            map[string]*cacheFill{},
+		writes:           map[string]int{},
+	}, nil
+}
+
+// Stats returns the cache's hit/miss statistics and its current usage
+func (s *CachingBlobStore) Stats() CacheStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := s.stats
+	stats.Entries = s.lru.Len()
+	stats.Size = s.size
+	return stats
+}
+
+// Get returns a blob from the cache, downloading it first if needed
+func (s *CachingBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext returns a blob from the cache, downloading it first if needed
+func (s *CachingBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return newContextReadCloser(ctx, file), nil
+}
+
+// GetRange returns a part of a blob from the cache, downloading the whole blob first if needed
+func (s *CachingBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext returns a part of a blob from the cache, downloading the whole blob first if
+// needed
+func (s *CachingBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	file, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return limitReadCloser(newContextReadCloser(ctx, file), length), nil
+}
+
+// Put invalidates the cached version of a blob and writes it to the underlying store
+func (s *CachingBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext invalidates the cached version of a blob and writes it to the underlying store
+func (s *CachingBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.write(func() error {
+		return s.ContextBlobStore.PutWithContext(ctx, key, data, size)
+	}, key)
+}
+
+// PutWithMetadata invalidates the cached version of a blob and writes it to the underlying store
+// along with its metadata. It fails if the underlying store doesn't support metadata.
+func (s *CachingBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	mstore, err := s.metadataStore()
+	if err != nil {
+		return err
+	}
+	return s.write(func() error {
+		return mstore.PutWithMetadata(ctx, key, data, size, metadata)
+	}, key)
+}
+
+// SetMetadata replaces the metadata of a blob of the underlying store (cached blobs only hold
+// their content, so they remain valid)
+func (s *CachingBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	mstore, err := s.metadataStore()
+	if err != nil {
+		return err
+	}
+	return mstore.SetMetadata(ctx, key, metadata)
+}
+
+func (s *CachingBlobStore) metadataStore() (MetadataBlobStore, error) {
+	mstore, ok := s.ContextBlobStore.(MetadataBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("[cache] Underlying blob store (%T) doesn't support metadata", s.ContextBlobStore)
+	}
+	return mstore, nil
+}
+
+// Delete invalidates the cached version of a blob and deletes it from the underlying store
+func (s *CachingBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext invalidates the cached version of a blob and deletes it from the underlying
+// store
+func (s *CachingBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	return s.write(func() error {
+		return s.ContextBlobStore.DeleteWithContext(ctx, key)
+	}, key)
+}
+
+// Rename invalidates the cached versions of both keys and renames the blob in the underlying store
+func (s *CachingBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext invalidates the cached versions of both keys and renames the blob in the
+// underlying store
+func (s *CachingBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	return s.write(func() error {
+		return s.ContextBlobStore.RenameWithContext(ctx, key, newKey)
+	}, key, newKey)
+}
+
+// open returns the cached file holding a blob, downloading it first if needed
+func (s *CachingBlobStore) open(ctx context.Context, key string) (*os.File, error) {
+	for {
+		s.mutex.Lock()
+		if elem, ok := s.entries[key]; ok {
+			s.lru.MoveToFront(elem)
+			s.stats.Hits++
+			// Once open, the file remains readable even if it gets evicted
+			file, err := os.Open(elem.Value.(*cacheEntry).path)
+			s.mutex.Unlock()
+			return file, err
+		}
+
+		fill, ok := s.fills[key]
+		if !ok {
+			fill = &cacheFill{done: make(chan struct{}), stale: s.writes[key] > 0}
+			s.fills[key] = fill
+			s.stats.Misses++
+			s.mutex.Unlock()
+			return s.fill(ctx, key, fill)
+		}
+		s.mutex.Unlock()
+
+		// Someone else is downloading the blob, let's wait for them
+		select {
+		case <-fill.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		// Only give up if the download didn't fail because of the downloader's context
+		if fill.err != nil && !errors.Is(fill.err, context.Canceled) && !errors.Is(fill.err, context.DeadlineExceeded) {
+			return nil, fill.err
+		}
+	}
+}
+
+// fill downloads a blob into the cache and returns the cached file. Blobs larger than the cache
+// itself are returned without being cached.
+func (s *CachingBlobStore) fill(ctx context.Context, key string, fill *cacheFill) (file *os.File, err error) {
+	var entry *cacheEntry
+	defer func() {
+		s.mutex.Lock()
+		if entry != nil && fill.stale {
+			os.Remove(entry.path)
+		} else if entry != nil {
+			s.add(entry)
+		}
+		delete(s.fills, key)
+		s.mutex.Unlock()
+
+		fill.err = err
+		close(fill.done)
+	}()
+
+	rc, err := s.ContextBlobStore.GetWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	tmp, err := ioutil.TempFile(s.cacheDir, "fill-")
+	if err != nil {
+		return nil, fmt.Errorf("[cache] Error creating cache file: %s", err)
+	}
+	size, err := io.Copy(tmp, rc)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	if size > s.maxSize {
+		// The open file remains readable once removed
+		os.Remove(tmp.Name())
+		return tmp, nil
+	}
+
+	path := filepath.Join(s.cacheDir, cacheFileName(key))
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("[cache] Error moving cache file: %s", err)
+	}
+	entry = &cacheEntry{key: key, path: path, size: size}
+	return tmp, nil
+}
+
+// add adds an entry to the cache, evicting the least recently used ones if needed. The caller must
+// hold the mutex.
+func (s *CachingBlobStore) add(entry *cacheEntry) {
+	s.entries[entry.key] = s.lru.PushFront(entry)
+	s.size += entry.size
+
+	for s.size > s.maxSize {
+		oldest := s.lru.Back()
+		s.remove(oldest)
+		s.stats.Evictions++
+	}
+}
+
+// remove removes an entry from the cache. The caller must hold the mutex.
+func (s *CachingBlobStore) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.key)
+	s.size -= entry.size
+	os.Remove(entry.path)
+}
+
+// write calls a function writing to the given keys of the underlying store, invalidating their
+// cached versions before and after it. The blobs downloaded while it runs aren't cached, since they
+// may be their previous versions.
+func (s *CachingBlobStore) write(write func() error, keys ...string) error {
+	s.mutex.Lock()
+	for _, key := range keys {
+		s.writes[key]++
+		s.invalidate(key)
+	}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for _, key := range keys {
+			if s.writes[key]--; s.writes[key] == 0 {
+				delete(s.writes, key)
+			}
+			s.invalidate(key)
+		}
+	}()
+	return write()
+}
+
+// invalidate removes the cached version of a blob, and marks its download as stale if it is being
+// downloaded. The caller must hold the mutex.
+func (s *CachingBlobStore) invalidate(key string) {
+	if elem, ok := s.entries[key]; ok {
+		s.remove(elem)
+	}
+	if fill, ok := s.fills[key]; ok {
+		fill.stale = true
+	}
+}
+
+// cacheFileName returns the name of the cache file of a blob, keys being hashed to avoid any issue
+// with special characters or path separators
+func cacheFileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestCachingBlobStoreKeepsForeignFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	foreign := filepath.Join(dir, "precious.csv")
+	require.NoError(t, ioutil.WriteFile(foreign, []byte("data"), 0644))
+
+	mem := NewMemoryBlobStore()
+	require.NoError(t, mem.Put("blob", strings.NewReader("content"), 7))
+	store, err := NewCachingBlobStore(mem, dir, 1<<20)
+	require.NoError(t, err)
+	data, err := readBlob(t, store, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	// A new cache on the same directory only empties its own subdirectory
+	_, err = NewCachingBlobStore(mem, dir, 1<<20)
+	require.NoError(t, err)
+	_, err = os.Stat(foreign)
+	assert.NoError(t, err)
+	entries, err := ioutil.ReadDir(filepath.Join(dir, cacheSubdir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestCachingBlobStoreForwardsMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	mem := NewMemoryBlobStore()
+	store, err := NewCachingBlobStore(mem, dir, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, store.PutWithMetadata(ctx, "blob", strings.NewReader("v1"), 2, map[string]string{"version": "1"}))
+	data, err := readBlob(t, store, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+
+	// Writing a blob with metadata invalidates its cached version
+	require.NoError(t, store.PutWithMetadata(ctx, "blob", strings.NewReader("v2"), 2, map[string]string{"version": "2"}))
+	data, err = readBlob(t, store, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+
+	require.NoError(t, store.SetMetadata(ctx, "blob", map[string]string{"version": "3"}))
+	info, err := store.StatWithContext(ctx, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "3", info.Metadata["version"])
+
+	_, err = NewCompressingBlobStore(store, "gzip")
+	assert.NoError(t, err, "compression can be layered over the cache")
+}
+
+// blockingPutBlobStore blocks writes until release is closed, once it has closed started
+type blockingPutBlobStore struct {
+	*MemoryBlobStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingPutBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	close(s.started)
+	<-s.release
+	return s.MemoryBlobStore.PutWithContext(ctx, key, data, size)
+}
+
+func TestCachingBlobStoreGetDuringPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mem := &blockingPutBlobStore{
+		MemoryBlobStore: NewMemoryBlobStore(),
+		started:         make(chan struct{}),
+		release:         make(chan struct{}),
+	}
+	require.NoError(t, mem.MemoryBlobStore.Put("blob", strings.NewReader("v1"), 2))
+	store, err := NewCachingBlobStore(mem, dir, 1<<20)
+	require.NoError(t, err)
+
+	written := make(chan error)
+	go func() {
+		written <- store.Put("blob", strings.NewReader("v2"), 2)
+	}()
+	<-mem.started
+
+	// The blob read while it's being written may be the previous version, which mustn't be cached
+	data, err := readBlob(t, store, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", string(data))
+	close(mem.release)
+	require.NoError(t, <-written)
+
+	data, err = readBlob(t, store, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(data))
+	assert.Equal(t, int64(2), store.Stats().Misses, "the second read is a miss")
+}
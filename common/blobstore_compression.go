@@ -0,0 +1,379 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/net/context"
+)
+
+// Metadata keys under which CompressingBlobStore records the codec a blob was compressed with and
+// its uncompressed size
+const (
+	CompressionMetadataKey      = "compression"
+	UncompressedSizeMetadataKey = "uncompressed_size"
+)
+
+// CompressionCodec is a streaming compression format usable by CompressingBlobStore
+type CompressionCodec interface {
+	// Name identifies the codec in the metadata of the blobs it compressed
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressionCodecs = struct {
+	sync.RWMutex
+	codecs map[string]CompressionCodec
+}{codecs: map[string]CompressionCodec{}}
+
+// RegisterCompressionCodec makes a codec available to CompressingBlobStore, for reading blobs as
+// well as for writing them. gzip and zstd are built in: other formats can be registered by the
+// programs that depend on an implementation of them.
+func RegisterCompressionCodec(codec CompressionCodec) {
+	compressionCodecs.Lock()
+	defer compressionCodecs.Unlock()
+	compressionCodecs.codecs[codec.Name()] = codec
+}
+
+// GetCompressionCodec returns the registered codec with the given name
+func GetCompressionCodec(name string) (CompressionCodec, error) {
+	compressionCodecs.RLock()
+	defer compressionCodecs.RUnlock()
+	codec, ok := compressionCodecs.codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("[compression] Unknown compression codec %q", name)
+	}
+	return codec, nil
+}
+
+// GzipCodec is the gzip CompressionCodec
+type GzipCodec struct {
+	Level int
+}
+
+// Name returns "gzip"
+func (c *GzipCodec) Name() string {
+	return "gzip"
+}
+
+// NewWriter returns a gzip writer
+func (c *GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.Level)
+}
+
+// NewReader returns a gzip reader
+func (c *GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// ZstdCodec is the zstd CompressionCodec
+type ZstdCodec struct {
+	Level zstd.EncoderLevel
+}
+
+// Name returns "zstd"
+func (c *ZstdCodec) Name() string {
+	return "zstd"
+}
+
+// NewWriter returns a zstd encoder
+func (c *ZstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderLevel(c.Level))
+}
+
+// NewReader returns a zstd decoder
+func (c *ZstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return zstdReadCloser{d}, nil
+}
+
+// zstdReadCloser adapts the Close method of zstd decoders, which returns no error
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+func init() {
+	RegisterCompressionCodec(&GzipCodec{Level: gzip.DefaultCompression})
+	RegisterCompressionCodec(&ZstdCodec{Level: zstd.SpeedDefault})
+}
+
+// DefaultUncompressibleExtensions are the key extensions of the blobs CompressingBlobStore stores
+// as is, their content being already compressed
+var DefaultUncompressibleExtensions = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".zst", ".zip", ".7z", ".jpg", ".jpeg", ".png", ".mp4",
+}
+
+// compressedMagics are the first bytes of already compressed formats (gzip, zstd, bzip2, xz, zip
+// and 7z), for the blobs whose key has no telling extension
+var compressedMagics = [][]byte{
+	{0x1f, 0x8b},
+	{0x28, 0xb5, 0x2f, 0xfd},
+	[]byte("BZh"),
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},
+	[]byte("PK\x03\x04"),
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},
+}
+
+// CompressingBlobStore wraps a MetadataBlobStore to compress blobs while they are streamed to it
+// and decompress them when they are read. The codec of every compressed blob is recorded in its
+// metadata, so that blobs written with another codec (or not compressed at all) remain readable.
+// Blobs that are already compressed, judging from their key's extension or their first bytes, are
+// stored as is.
+//
+// Stat returns the uncompressed size of blobs (and no content hash, since the underlying store's
+// one is the compressed content's) but List returns the sizes of the stored blobs.
+type CompressingBlobStore struct {
+	MetadataBlobStore
+
+	Codec                    CompressionCodec
+	UncompressibleExtensions []string
+}
+
+// NewCompressingBlobStore wraps store (which must support metadata) in a CompressingBlobStore
+// compressing blobs with the registered codec named codecName
+func NewCompressingBlobStore(store BlobStore, codecName string) (*CompressingBlobStore, error) {
+	mstore, ok := store.(MetadataBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("[compression] Underlying blob store (%T) doesn't support metadata", store)
+	}
+	codec, err := GetCompressionCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+	return &CompressingBlobStore{
+		MetadataBlobStore:        mstore,
+		Codec:                    codec,
+		UncompressibleExtensions: DefaultUncompressibleExtensions,
+	}, nil
+}
+
+// Put compresses a blob and streams it to the underlying store
+func (s *CompressingBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(context.Background(), key, data, size, nil)
+}
+
+// PutWithContext compresses a blob and streams it to the underlying store
+func (s *CompressingBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, data, size, nil)
+}
+
+// PutWithMetadata compresses a blob and streams it to the underlying store, adding its codec and
+// uncompressed size to the given metadata. When size isn't known beforehand, the compressed blob is
+// spooled (in memory or in a temporary file) until its uncompressed size is known, so that it can
+// be committed along with it.
+func (s *CompressingBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	metadata = withoutCompressionMetadata(metadata)
+	br := bufio.NewReader(data)
+	if s.isCompressed(key, br) {
+		return s.MetadataBlobStore.PutWithMetadata(ctx, key, br, size, metadata)
+	}
+	metadata[CompressionMetadataKey] = s.Codec.Name()
+
+	pr, pw := io.Pipe()
+	counter := &countingReader{r: br}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w, err := s.Codec.NewWriter(pw)
+		if err == nil {
+			_, err = io.Copy(w, counter)
+			if closeErr := w.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		if err == nil && size >= 0 && counter.n != size {
+			err = fmt.Errorf("[compression] Blob %s is %d bytes long instead of %d", key, counter.n, size)
+		}
+		pw.CloseWithError(err)
+	}()
+	// Unblock the compressing goroutine if the compressed blob isn't read until EOF
+	wait := func() {
+		pr.CloseWithError(io.ErrClosedPipe)
+		<-done
+	}
+
+	if size >= 0 {
+		metadata[UncompressedSizeMetadataKey] = strconv.FormatInt(size, 10)
+		err := s.MetadataBlobStore.PutWithMetadata(ctx, key, pr, -1, metadata)
+		wait()
+		return err
+	}
+
+	spool, err := spoolBlob(ctx, pr)
+	wait()
+	if err != nil {
+		return fmt.Errorf("[compression] Error compressing blob %s: %w", key, err)
+	}
+	defer spool.Close()
+	metadata[UncompressedSizeMetadataKey] = strconv.FormatInt(counter.n, 10)
+	compressed, err := spool.Reader()
+	if err != nil {
+		return err
+	}
+	return s.MetadataBlobStore.PutWithMetadata(ctx, key, compressed, spool.Size, metadata)
+}
+
+// SetMetadata replaces the metadata of a blob, keeping its compression metadata
+func (s *CompressingBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	info, err := s.MetadataBlobStore.StatWithContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	metadata = withoutCompressionMetadata(metadata)
+	for _, k := range []string{CompressionMetadataKey, UncompressedSizeMetadataKey} {
+		if v, ok := info.Metadata[k]; ok {
+			metadata[k] = v
+		}
+	}
+	return s.MetadataBlobStore.SetMetadata(ctx, key, metadata)
+}
+
+// Get returns a reader decompressing a blob of the underlying store
+func (s *CompressingBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext returns a reader decompressing a blob of the underlying store, with the codec
+// recorded in its metadata
+func (s *CompressingBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	info, err := s.MetadataBlobStore.StatWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	codecName := info.Metadata[CompressionMetadataKey]
+	var codec CompressionCodec
+	if codecName != "" {
+		if codec, err = GetCompressionCodec(codecName); err != nil {
+			return nil, err
+		}
+	}
+
+	rc, err := s.MetadataBlobStore.GetWithContext(ctx, key)
+	if err != nil || codec == nil {
+		return rc, err
+	}
+	dr, err := codec.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("[compression] Error decompressing blob %s: %s", key, err)
+	}
+	return &readCloser{Reader: dr, Closer: multiCloser{dr, rc}}, nil
+}
+
+// Stat returns information on a blob, with its uncompressed size
+func (s *CompressingBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on a blob, with its uncompressed size
+func (s *CompressingBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	info, err := s.MetadataBlobStore.StatWithContext(ctx, key)
+	if err != nil || info.Metadata[CompressionMetadataKey] == "" {
+		return info, err
+	}
+
+	if size, err := strconv.ParseInt(info.Metadata[UncompressedSizeMetadataKey], 10, 64); err == nil {
+		info.Size = size
+	}
+	info.ContentHash = ""
+	info.Metadata = withoutCompressionMetadata(info.Metadata)
+	if len(info.Metadata) == 0 {
+		info.Metadata = nil
+	}
+	return info, nil
+}
+
+// isCompressed tells whether a blob is already compressed, from its key or its first bytes
+func (s *CompressingBlobStore) isCompressed(key string, data *bufio.Reader) bool {
+	ext := strings.ToLower(path.Ext(key))
+	for _, uncompressible := range s.UncompressibleExtensions {
+		if ext == uncompressible {
+			return true
+		}
+	}
+
+	head, _ := data.Peek(8)
+	for _, magic := range compressedMagics {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutCompressionMetadata returns a copy of metadata without the keys managed by
+// CompressingBlobStore
+func withoutCompressionMetadata(metadata map[string]string) map[string]string {
+	ret := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		if k != CompressionMetadataKey && k != UncompressedSizeMetadataKey {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// multiCloser closes all its closers, returning the first error
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var firstErr error
+	for _, closer := range c {
+		if err := closer.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// metadataRecordingBlobStore counts the metadata updates made to a MemoryBlobStore
+type metadataRecordingBlobStore struct {
+	*MemoryBlobStore
+	setMetadata int
+}
+
+func (s *metadataRecordingBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	s.setMetadata++
+	return s.MemoryBlobStore.SetMetadata(ctx, key, metadata)
+}
+
+func TestCompressingBlobStoreOverWrappers(t *testing.T) {
+	ctx := context.Background()
+	recorder := &metadataRecordingBlobStore{MemoryBlobStore: NewMemoryBlobStore()}
+	keys, err := NewStaticKeyProvider(bytes.Repeat([]byte{42}, encryptionKeySize))
+	require.NoError(t, err)
+	throttled, err := NewThrottledBlobStore(recorder, ThrottleConfig{})
+	require.NoError(t, err)
+	encrypted := NewEncryptedBlobStore(throttled, keys)
+
+	for _, codec := range []string{"gzip", "zstd"} {
+		store, err := NewCompressingBlobStore(encrypted, codec)
+		require.NoError(t, err, "compression can be layered over throttling and encryption")
+
+		content := strings.Repeat("compressible content, ", 1000)
+		require.NoError(t, store.PutWithMetadata(ctx, codec, strings.NewReader(content), -1, map[string]string{"owner": "morpheo"}))
+		assert.Equal(t, 0, recorder.setMetadata, "blobs of unknown size are committed with their metadata")
+
+		raw, err := recorder.Stat(codec)
+		require.NoError(t, err)
+		assert.Equal(t, codec, raw.Metadata[CompressionMetadataKey])
+		assert.True(t, raw.Size < int64(len(content)), "%s: %d bytes stored for %d", codec, raw.Size, len(content))
+
+		info, err := store.Stat(codec)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(content)), info.Size)
+		assert.Equal(t, map[string]string{"owner": "morpheo"}, info.Metadata)
+		data, err := readBlob(t, store, codec)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(data))
+	}
+}
+
+func TestCompressingBlobStoreRejectsWrongSizes(t *testing.T) {
+	mem := NewMemoryBlobStore()
+	store, err := NewCompressingBlobStore(mem, "zstd")
+	require.NoError(t, err)
+
+	assert.Error(t, store.Put("short", strings.NewReader("data"), 5))
+	assert.Error(t, store.Put("long", strings.NewReader("data"), 3))
+	page, err := mem.List("", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, page.Blobs)
+
+	require.NoError(t, store.Put("exact", strings.NewReader("data"), 4))
+	info, err := store.Stat("exact")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), info.Size)
+}
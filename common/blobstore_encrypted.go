@@ -0,0 +1,566 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/context"
+)
+
+// Encrypted blobs start with a header made of:
+//   - encryptedBlobMagic,
+//   - the size of the plaintext chunks (uint32),
+//   - the ID of the key used to encrypt the blob (uint16 length + bytes),
+//   - the wrapped data key, if any (uint16 length + bytes),
+//   - a random salt.
+//
+// Every blob is encrypted with its own key, derived from the data key and the salt with HKDF, so
+// that blobs never share a (key, nonce) pair even if their data key is the same. The plaintext is
+// then split into chunks, each of them being sealed with AES-GCM. The nonce of a chunk is made of
+// the chunk index (uint32) and a flag set on the last chunk only, so that chunks can't be reordered
+// and the blob can't be truncated. The header is passed as additional data to every chunk.
+const (
+	encryptedBlobMagic = "MBE1"
+	encryptedSaltSize  = 32
+	encryptionKeySize  = 32
+	encryptionKeyInfo  = "morpheo blob encryption"
+
+	// DefaultEncryptionChunkSize is the size of the plaintext chunks used by EncryptedBlobStore
+	DefaultEncryptionChunkSize = 64 << 10
+
+	// MaxEncryptionChunkSize is the largest chunk size EncryptedBlobStore writes or reads (the chunk
+	// size read from a blob's header is only authenticated once the first chunk is decrypted)
+	MaxEncryptionChunkSize = 16 << 20
+)
+
+// KeyProvider provides the AES-256 keys used by EncryptedBlobStore
+type KeyProvider interface {
+	// NewDataKey returns the key to encrypt a new blob with. The key ID and the (optional) wrapped
+	// key are stored in the blob's header and handed back to DataKey when decrypting it.
+	NewDataKey() (key []byte, keyID string, wrappedKey []byte, err error)
+
+	// DataKey returns the key a blob was encrypted with, given the content of its header
+	DataKey(keyID string, wrappedKey []byte) (key []byte, err error)
+}
+
+// StaticKeyProvider encrypts all blobs with the same key
+type StaticKeyProvider struct {
+	key   []byte
+	keyID string
+}
+
+// NewStaticKeyProvider creates a StaticKeyProvider from a 32 bytes key
+func NewStaticKeyProvider(key []byte) (*StaticKeyProvider, error) {
+	if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("[encryption] Invalid key size: %d bytes (expected %d)", len(key), encryptionKeySize)
+	}
+	return &StaticKeyProvider{key: key, keyID: encryptionKeyID(key)}, nil
+}
+
+// NewStaticKeyProviderFromFile creates a StaticKeyProvider from a key file (see ReadKeyFile)
+func NewStaticKeyProviderFromFile(path string) (*StaticKeyProvider, error) {
+	key, err := ReadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewStaticKeyProvider(key)
+}
+
+// NewDataKey returns the static key
+func (p *StaticKeyProvider) NewDataKey() ([]byte, string, []byte, error) {
+	return p.key, p.keyID, nil, nil
+}
+
+// DataKey returns the static key, if the blob has been encrypted with it
+func (p *StaticKeyProvider) DataKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	if keyID != p.keyID {
+		return nil, fmt.Errorf("[encryption] Blob encrypted with unknown key %s", keyID)
+	}
+	return p.key, nil
+}
+
+// EnvelopeKeyProvider encrypts every blob with its own random data key. Data keys are wrapped
+// (encrypted) by a master key and stored in the header of the blobs. Several master keys can be
+// given to allow for key rotation: new blobs are encrypted with the current one, and older blobs
+// can still be read as long as the master key they were encrypted with is known.
+type EnvelopeKeyProvider struct {
+	masterKeys   map[string]cipher.AEAD
+	currentKeyID string
+}
+
+// NewEnvelopeKeyProvider creates an EnvelopeKeyProvider given its master keys (indexed by key ID)
+// and the ID of the one to be used for new blobs
+func NewEnvelopeKeyProvider(masterKeys map[string][]byte, currentKeyID string) (*EnvelopeKeyProvider, error) {
+	if _, ok := masterKeys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("[encryption] Unknown current master key %s", currentKeyID)
+	}
+	p := &EnvelopeKeyProvider{
+		masterKeys:   make(map[string]cipher.AEAD, len(masterKeys)),
+		currentKeyID: currentKeyID,
+	}
+	for keyID, key := range masterKeys {
+		if len(keyID) > 0xffff {
+			return nil, fmt.Errorf("[encryption] Master key ID too long")
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("[encryption] Invalid master key %s: %s", keyID, err)
+		}
+		p.masterKeys[keyID] = aead
+	}
+	return p, nil
+}
+
+// NewDataKey generates a random data key and wraps it with the current master key
+func (p *EnvelopeKeyProvider) NewDataKey() ([]byte, string, []byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", nil, fmt.Errorf("[encryption] Error generating data key: %s", err)
+	}
+
+	master := p.masterKeys[p.currentKeyID]
+	nonce := make([]byte, master.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", nil, fmt.Errorf("[encryption] Error generating nonce: %s", err)
+	}
+	wrapped := master.Seal(nonce, nonce, key, []byte(p.currentKeyID))
+	return key, p.currentKeyID, wrapped, nil
+}
+
+// DataKey unwraps a data key with the master key it was wrapped with
+func (p *EnvelopeKeyProvider) DataKey(keyID string, wrappedKey []byte) ([]byte, error) {
+	master, ok := p.masterKeys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("[encryption] Blob encrypted with unknown master key %s", keyID)
+	}
+	if len(wrappedKey) < master.NonceSize() {
+		return nil, fmt.Errorf("[encryption] Invalid wrapped data key")
+	}
+	nonce, ciphertext := wrappedKey[:master.NonceSize()], wrappedKey[master.NonceSize():]
+	key, err := master.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("[encryption] Error unwrapping data key: %s", err)
+	}
+	return key, nil
+}
+
+// ReadKeyFile reads a 32 bytes key from a file holding it either raw, hex or base64 encoded
+func ReadKeyFile(path string) ([]byte, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("[encryption] Error reading key file %s: %s", path, err)
+	}
+	if len(content) == encryptionKeySize {
+		return content, nil
+	}
+
+	encoded := string(bytes.TrimSpace(content))
+	if key, err := hex.DecodeString(encoded); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(key) == encryptionKeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("[encryption] Key file %s doesn't hold a %d bytes key", path, encryptionKeySize)
+}
+
+// encryptionKeyID derives a (public) identifier from a key
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// blobKey derives the key of a blob from its data key and salt
+func blobKey(dataKey []byte, salt []byte) ([]byte, error) {
+	key := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, dataKey, salt, []byte(encryptionKeyInfo)), key); err != nil {
+		return nil, fmt.Errorf("[encryption] Error deriving blob key: %s", err)
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptedBlobStore wraps a BlobStore to encrypt blobs before they are written to it and decrypt
+// them when they are read, using AES-256-GCM on chunks of the blobs so that they can be streamed.
+// Decryption errors (tampered or truncated blobs, unknown keys) are returned by the readers
+// returned by Get. Note that the sizes and content hashes returned by Stat and List are the ones
+// of the encrypted blobs.
+type EncryptedBlobStore struct {
+	ContextBlobStore
+
+	Keys      KeyProvider
+	ChunkSize int
+}
+
+// NewEncryptedBlobStore wraps store in an EncryptedBlobStore
+func NewEncryptedBlobStore(store BlobStore, keys KeyProvider) *EncryptedBlobStore {
+	return &EncryptedBlobStore{
+		ContextBlobStore: AsContextBlobStore(store),
+		Keys:             keys,
+		ChunkSize:        DefaultEncryptionChunkSize,
+	}
+}
+
+// Put encrypts a blob and streams it to the underlying store
+func (s *EncryptedBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext encrypts a blob and streams it to the underlying store
+func (s *EncryptedBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	r, encryptedSize, err := s.encrypt(data, size)
+	if err != nil {
+		return err
+	}
+	return s.ContextBlobStore.PutWithContext(ctx, key, r, encryptedSize)
+}
+
+// PutWithMetadata encrypts a blob and streams it to the underlying store along with its metadata.
+// The metadata itself isn't encrypted. It fails if the underlying store doesn't support metadata.
+func (s *EncryptedBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	mstore, err := s.metadataStore()
+	if err != nil {
+		return err
+	}
+	r, encryptedSize, err := s.encrypt(data, size)
+	if err != nil {
+		return err
+	}
+	return mstore.PutWithMetadata(ctx, key, r, encryptedSize, metadata)
+}
+
+// SetMetadata replaces the (unencrypted) metadata of a blob of the underlying store
+func (s *EncryptedBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	mstore, err := s.metadataStore()
+	if err != nil {
+		return err
+	}
+	return mstore.SetMetadata(ctx, key, metadata)
+}
+
+func (s *EncryptedBlobStore) metadataStore() (MetadataBlobStore, error) {
+	mstore, ok := s.ContextBlobStore.(MetadataBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("[encryption] Underlying blob store (%T) doesn't support metadata", s.ContextBlobStore)
+	}
+	return mstore, nil
+}
+
+// encrypt returns a reader encrypting data, and the size of the encrypted data (-1 if size is)
+func (s *EncryptedBlobStore) encrypt(data io.Reader, size int64) (io.Reader, int64, error) {
+	r, err := s.newEncryptingReader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	encryptedSize := int64(-1)
+	if size >= 0 {
+		encryptedSize = r.encryptedSize(size)
+	}
+	return r, encryptedSize, nil
+}
+
+// Get returns a reader decrypting a blob of the underlying store
+func (s *EncryptedBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext returns a reader decrypting a blob of the underlying store
+func (s *EncryptedBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := s.ContextBlobStore.GetWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{
+		Reader: &decryptingReader{keys: s.Keys, r: bufio.NewReader(rc)},
+		Closer: rc,
+	}, nil
+}
+
+// encryptingReader encrypts the data read from r
+type encryptingReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int
+	index     uint32
+	done      bool
+
+	plaintext []byte
+	sealed    []byte
+	out       []byte
+}
+
+func (s *EncryptedBlobStore) newEncryptingReader(data io.Reader) (*encryptingReader, error) {
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultEncryptionChunkSize
+	}
+	if chunkSize > MaxEncryptionChunkSize {
+		return nil, fmt.Errorf("[encryption] Chunk size too large: %d bytes (at most %d)", chunkSize, MaxEncryptionChunkSize)
+	}
+
+	dataKey, keyID, wrappedKey, err := s.Keys.NewDataKey()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, encryptedSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("[encryption] Error generating salt: %s", err)
+	}
+	key, err := blobKey(dataKey, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("[encryption] Invalid data key: %s", err)
+	}
+
+	var header bytes.Buffer
+	header.WriteString(encryptedBlobMagic)
+	binary.Write(&header, binary.BigEndian, uint32(chunkSize))
+	binary.Write(&header, binary.BigEndian, uint16(len(keyID)))
+	header.WriteString(keyID)
+	binary.Write(&header, binary.BigEndian, uint16(len(wrappedKey)))
+	header.Write(wrappedKey)
+	header.Write(salt)
+
+	return &encryptingReader{
+		r:         bufio.NewReader(data),
+		aead:      aead,
+		header:    header.Bytes(),
+		chunkSize: chunkSize,
+		plaintext: make([]byte, chunkSize),
+		sealed:    make([]byte, 0, chunkSize+aead.Overhead()),
+		out:       header.Bytes(),
+	}, nil
+}
+
+// encryptedSize returns the size of the encrypted version of a blob of the given size
+func (r *encryptingReader) encryptedSize(size int64) int64 {
+	chunks := (size + int64(r.chunkSize) - 1) / int64(r.chunkSize)
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(len(r.header)) + size + chunks*int64(r.aead.Overhead())
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.sealChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *encryptingReader) sealChunk() error {
+	n, err := io.ReadFull(r.r, r.plaintext)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err != nil
+	if !last {
+		// Let's peek ahead to know whether this chunk is the last one
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonce := chunkNonce(r.aead, r.index, last)
+	r.out = r.aead.Seal(r.sealed[:0], nonce, r.plaintext[:n], r.header)
+	r.index++
+	r.done = last
+	return nil
+}
+
+// decryptingReader decrypts the data read from r
+type decryptingReader struct {
+	keys KeyProvider
+	r    *bufio.Reader
+
+	aead      cipher.AEAD
+	header    []byte
+	chunk     []byte
+	index     uint32
+	done      bool
+	plaintext []byte
+	err       error
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.aead == nil {
+		if r.err = r.readHeader(); r.err != nil {
+			return 0, r.err
+		}
+	}
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.err = r.openChunk(); r.err != nil {
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) readHeader() error {
+	var header bytes.Buffer
+	in := io.TeeReader(r.r, &header)
+
+	magic := make([]byte, len(encryptedBlobMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != encryptedBlobMagic {
+		return fmt.Errorf("[encryption] Blob isn't encrypted (or its header is corrupted)")
+	}
+	var chunkSize uint32
+	if err := binary.Read(in, binary.BigEndian, &chunkSize); err != nil {
+		return fmt.Errorf("[encryption] Error reading blob header: %s", err)
+	}
+	if chunkSize == 0 || chunkSize > MaxEncryptionChunkSize {
+		return fmt.Errorf("[encryption] Invalid chunk size in blob header: %d bytes", chunkSize)
+	}
+	keyID, err := readUint16Prefixed(in)
+	if err != nil {
+		return fmt.Errorf("[encryption] Error reading blob header: %s", err)
+	}
+	wrappedKey, err := readUint16Prefixed(in)
+	if err != nil {
+		return fmt.Errorf("[encryption] Error reading blob header: %s", err)
+	}
+	salt := make([]byte, encryptedSaltSize)
+	if _, err := io.ReadFull(in, salt); err != nil {
+		return fmt.Errorf("[encryption] Error reading blob header: %s", err)
+	}
+	dataKey, err := r.keys.DataKey(string(keyID), wrappedKey)
+	if err != nil {
+		return err
+	}
+	key, err := blobKey(dataKey, salt)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return fmt.Errorf("[encryption] Invalid data key: %s", err)
+	}
+
+	r.aead = aead
+	r.header = header.Bytes()
+	r.chunk = make([]byte, int(chunkSize)+aead.Overhead())
+	return nil
+}
+
+func (r *decryptingReader) openChunk() error {
+	n, err := io.ReadFull(r.r, r.chunk)
+	if err == io.EOF {
+		return fmt.Errorf("[encryption] Blob is truncated")
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := r.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	nonce := chunkNonce(r.aead, r.index, last)
+	plaintext, err := r.aead.Open(r.chunk[:0], nonce, r.chunk[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("[encryption] Error decrypting chunk %d of blob (tampered or truncated blob?): %s", r.index, err)
+	}
+	r.plaintext = plaintext
+	r.index++
+	r.done = last
+	return nil
+}
+
+// chunkNonce returns the nonce of a chunk: zeros followed by its index and the last chunk flag. The
+// key of every blob being unique, so are the nonces.
+func chunkNonce(aead cipher.AEAD, index uint32, last bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint32(nonce[len(nonce)-5:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+func readUint16Prefixed(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
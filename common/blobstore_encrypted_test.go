@@ -0,0 +1,117 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEncryptedBlobStore(t *testing.T) (*EncryptedBlobStore, *MemoryBlobStore, []byte) {
+	key := bytes.Repeat([]byte{42}, encryptionKeySize)
+	keys, err := NewStaticKeyProvider(key)
+	require.NoError(t, err)
+	mem := NewMemoryBlobStore()
+	store := NewEncryptedBlobStore(mem, keys)
+	store.ChunkSize = 16
+	return store, mem, key
+}
+
+func readBlob(t *testing.T, store BlobStore, key string) ([]byte, error) {
+	rc, err := store.Get(key)
+	require.NoError(t, err)
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func TestEncryptedBlobStoreDerivesAKeyPerBlob(t *testing.T) {
+	store, mem, key := newTestEncryptedBlobStore(t)
+	plaintext := strings.Repeat("same plaintext, ", 5)
+
+	require.NoError(t, store.Put("a", strings.NewReader(plaintext), -1))
+	require.NoError(t, store.Put("b", strings.NewReader(plaintext), int64(len(plaintext))))
+
+	a, err := readBlob(t, mem, "a")
+	require.NoError(t, err)
+	b, err := readBlob(t, mem, "b")
+	require.NoError(t, err)
+	assert.Equal(t, encryptedBlobMagic, string(a[:len(encryptedBlobMagic)]))
+	require.Equal(t, len(a), len(b))
+
+	// Blobs have different salts, hence different keys: even their first chunk differs
+	headerSize := len(encryptedBlobMagic) + 4 + 2 + len(encryptionKeyID(key)) + 2 + encryptedSaltSize
+	assert.NotEqual(t, a[headerSize-encryptedSaltSize:headerSize], b[headerSize-encryptedSaltSize:headerSize])
+	assert.NotEqual(t, a[headerSize:headerSize+16], b[headerSize:headerSize+16])
+
+	for _, key := range []string{"a", "b"} {
+		data, err := readBlob(t, store, key)
+		require.NoError(t, err)
+		assert.Equal(t, plaintext, string(data))
+	}
+}
+
+func TestEncryptedBlobStoreRejectsCorruptedBlobs(t *testing.T) {
+	store, mem, _ := newTestEncryptedBlobStore(t)
+	require.NoError(t, store.Put("blob", strings.NewReader("some secret data to protect"), -1))
+	encrypted, err := readBlob(t, mem, "blob")
+	require.NoError(t, err)
+
+	// A huge chunk size must be rejected before anything is allocated
+	corrupted := append([]byte(nil), encrypted...)
+	binary.BigEndian.PutUint32(corrupted[len(encryptedBlobMagic):], 0xffffffff)
+	require.NoError(t, mem.Put("huge", bytes.NewReader(corrupted), int64(len(corrupted))))
+	_, err = readBlob(t, store, "huge")
+	assert.Error(t, err)
+
+	corrupted = append([]byte(nil), encrypted...)
+	corrupted[len(corrupted)-1] ^= 1
+	require.NoError(t, mem.Put("tampered", bytes.NewReader(corrupted), int64(len(corrupted))))
+	_, err = readBlob(t, store, "tampered")
+	assert.Error(t, err)
+
+	require.NoError(t, mem.Put("truncated", bytes.NewReader(encrypted[:len(encrypted)-20]), int64(len(encrypted)-20)))
+	_, err = readBlob(t, store, "truncated")
+	assert.Error(t, err)
+
+	store.ChunkSize = MaxEncryptionChunkSize + 1
+	assert.Error(t, store.Put("too-large-chunks", strings.NewReader("data"), 4))
+}
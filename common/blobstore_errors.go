@@ -0,0 +1,156 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"net/http"
+	"os"
+)
+
+// Errors that blob stores map their native errors onto, so that callers can handle them with
+// errors.Is() whatever the backend, e.g. errors.Is(err, ErrNotFound). The native error remains
+// available through errors.Unwrap() or errors.As().
+var (
+	ErrNotFound      = errors.New("blob not found")
+	ErrAlreadyExists = errors.New("blob already exists")
+	ErrPermission    = errors.New("permission denied")
+	ErrInvalidKey    = errors.New("invalid blob key")
+	ErrInvalidRange  = errors.New("invalid blob range")
+
+	// ErrModified is returned by ConditionalDeleteBlobStore.DeleteIfUnchanged when the blob isn't
+	// the version it was asked to delete anymore
+	ErrModified = errors.New("blob modified")
+)
+
+// BlobError is a backend error that has been classified as one of the sentinel errors above. Its
+// message is the one of the backend error.
+type BlobError struct {
+	Kind error
+	Key  string
+	Err  error
+}
+
+func (err *BlobError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the backend error
+func (err *BlobError) Unwrap() error {
+	return err.Err
+}
+
+// Is makes errors.Is(err, kind) true for the sentinel error err has been classified as
+func (err *BlobError) Is(target error) bool {
+	return target == err.Kind
+}
+
+// newBlobError classifies err as kind, unless one of them is nil
+func newBlobError(kind error, key string, err error) error {
+	if err == nil || kind == nil {
+		return err
+	}
+	return &BlobError{Kind: kind, Key: key, Err: err}
+}
+
+// commonErrorKind returns the sentinel error that all the non nil errors of errs match, if any
+func commonErrorKind(errs []error) error {
+	for _, kind := range []error{ErrNotFound, ErrAlreadyExists, ErrPermission, ErrInvalidKey, ErrInvalidRange, ErrModified} {
+		matched := false
+		for _, err := range errs {
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, kind) {
+				matched = false
+				break
+			}
+			matched = true
+		}
+		if matched {
+			return kind
+		}
+	}
+	return nil
+}
+
+// conditionalBlobError classifies the errors of requests made conditional on the version of a blob,
+// a failed precondition meaning that the blob has been modified
+func conditionalBlobError(statusCode int, key string, err error) error {
+	if statusCode == http.StatusPreconditionFailed {
+		return newBlobError(ErrModified, key, err)
+	}
+	return httpBlobError(statusCode, key, err)
+}
+
+// osBlobError classifies the errors returned by the os package
+func osBlobError(key string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case os.IsNotExist(err):
+		return newBlobError(ErrNotFound, key, err)
+	case os.IsExist(err):
+		return newBlobError(ErrAlreadyExists, key, err)
+	case os.IsPermission(err):
+		return newBlobError(ErrPermission, key, err)
+	default:
+		return err
+	}
+}
+
+// statusErrorKind returns the sentinel error corresponding to an HTTP status code, if any
+func statusErrorKind(statusCode int) error {
+	switch statusCode {
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return ErrAlreadyExists
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrPermission
+	default:
+		return nil
+	}
+}
+
+// httpBlobError classifies an error according to the HTTP status code of the response it results
+// from
+func httpBlobError(statusCode int, key string, err error) error {
+	if kind := statusErrorKind(statusCode); kind != nil {
+		return newBlobError(kind, key, err)
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// assertConditionalBlobErrors checks that a store maps its missing blob and conditional write errors
+// onto ErrNotFound and ErrAlreadyExists
+func assertConditionalBlobErrors(t *testing.T, store ConditionalBlobStore) {
+	_, err := store.Get("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Get: %v", err)
+	_, err = GetBlobRange(context.Background(), store, "missing", 1, 2)
+	assert.True(t, errors.Is(err, ErrNotFound), "GetRange: %v", err)
+	_, err = store.Stat("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Stat: %v", err)
+	err = store.Delete("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Delete: %v", err)
+	err = store.Rename("missing", "renamed")
+	assert.True(t, errors.Is(err, ErrNotFound), "Rename: %v", err)
+
+	require.NoError(t, store.Put("a", strings.NewReader("a"), 1))
+	require.NoError(t, store.Put("b", strings.NewReader("b"), 1))
+	err = store.PutIfAbsent("a", strings.NewReader("c"), 1)
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "PutIfAbsent: %v", err)
+	assert.False(t, errors.Is(err, ErrNotFound))
+	err = store.RenameIfAbsent("b", "a")
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "RenameIfAbsent: %v", err)
+
+	err = store.Put("../escape", strings.NewReader("a"), 1)
+	assert.True(t, errors.Is(err, ErrInvalidKey), "Put: %v", err)
+}
+
+func TestLocalBlobStoreErrors(t *testing.T) {
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+	assertConditionalBlobErrors(t, store)
+
+	err := osBlobError("a", &os.PathError{Op: "open", Path: "a", Err: os.ErrPermission})
+	assert.True(t, errors.Is(err, ErrPermission))
+	var pathErr *os.PathError
+	assert.True(t, errors.As(err, &pathErr), "the os error should remain available")
+}
+
+func TestLocalBlobStorePermissionErrors(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("file permissions aren't enforced for root")
+	}
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+	require.NoError(t, os.MkdirAll(filepath.Join(store.DataDir, "locked"), 0755))
+	require.NoError(t, os.Chmod(filepath.Join(store.DataDir, "locked"), 0))
+	defer os.Chmod(filepath.Join(store.DataDir, "locked"), 0755)
+	_, err := store.Get("locked/blob")
+	assert.True(t, errors.Is(err, ErrPermission), "Get: %v", err)
+	err = store.Put("locked/blob", strings.NewReader("a"), 1)
+	assert.True(t, errors.Is(err, ErrPermission), "Put: %v", err)
+}
+
+func TestMemoryBlobStoreErrors(t *testing.T) {
+	assertConditionalBlobErrors(t, NewMemoryBlobStore())
+}
+
+func TestHTTPBlobStoreErrors(t *testing.T) {
+	statuses := map[string]int{
+		"/missing":   http.StatusNotFound,
+		"/conflict":  http.StatusConflict,
+		"/modified":  http.StatusPreconditionFailed,
+		"/forbidden": http.StatusForbidden,
+		"/anonymous": http.StatusUnauthorized,
+		"/broken":    http.StatusInternalServerError,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[r.URL.Path])
+	}))
+	defer server.Close()
+	store, err := NewHTTPBlobStore(HTTPConfig{BaseURL: server.URL})
+	require.NoError(t, err)
+
+	_, err = store.Get("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Get: %v", err)
+	_, err = store.Stat("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Stat: %v", err)
+	err = store.Delete("missing")
+	assert.True(t, errors.Is(err, ErrNotFound), "Delete: %v", err)
+	exists, err := store.Exists("missing")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	for _, key := range []string{"conflict", "modified"} {
+		err = store.Put(key, strings.NewReader("a"), 1)
+		assert.True(t, errors.Is(err, ErrAlreadyExists), "Put %s: %v", key, err)
+	}
+	for _, key := range []string{"forbidden", "anonymous"} {
+		_, err = store.Get(key)
+		assert.True(t, errors.Is(err, ErrPermission), "Get %s: %v", key, err)
+		err = store.Put(key, strings.NewReader("a"), 1)
+		assert.True(t, errors.Is(err, ErrPermission), "Put %s: %v", key, err)
+	}
+
+	_, err = store.Get("broken")
+	require.Error(t, err)
+	for _, kind := range []error{ErrNotFound, ErrAlreadyExists, ErrPermission} {
+		assert.False(t, errors.Is(err, kind), "a 500 shouldn't match %v", kind)
+	}
+	var statusErr *HTTPStatusError
+	require.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusInternalServerError, statusErr.StatusCode)
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrInjectedFault is the error returned by the operations FaultyBlobStore makes fail, unless the
+// fault specifies another one
+var ErrInjectedFault = errors.New("injected blob store fault")
+
+// Fault describes a fault to inject into the operations of a FaultyBlobStore. Operations are named
+// after the BlobStore methods: "put", "get", "get_range", "delete", "rename", "stat", "exists" and
+// "list" (the key of a list being its prefix).
+type Fault struct {
+	// Op restricts the fault to an operation (any operation if empty)
+	Op string
+
+	// Key restricts the fault to a key, and KeyPrefix to the keys starting with it (any key if
+	// they are empty)
+	Key       string
+	KeyPrefix string
+
+	// Call restricts the fault to the Nth call of the operation, counting from 1 (any call if 0)
+	Call int
+
+	// Latency delays the operation
+	Latency time.Duration
+
+	// Fail makes the operation fail with Err (or ErrInjectedFault if Err is nil)
+	Fail bool
+	Err  error
+
+	// Truncate makes the readers returned by get and get_range fail with io.ErrUnexpectedEOF once
+	// TruncateAfter bytes have been read (unless the blob ends there), as if the connection was lost
+	Truncate      bool
+	TruncateAfter int64
+}
+
+// FaultyBlobStore wraps a BlobStore (typically a MemoryBlobStore) and injects faults into its
+// operations, so that tests can exercise error paths
+type FaultyBlobStore struct {
+	ContextBlobStore
+
+	store  BlobStore
+	mutex  sync.Mutex
+	faults []Fault
+	calls  map[string]int
+}
+
+// NewFaultyBlobStore creates a FaultyBlobStore wrapping store, injecting no fault until told to
+func NewFaultyBlobStore(store BlobStore) *FaultyBlobStore {
+	return &FaultyBlobStore{
+		ContextBlobStore: AsContextBlobStore(store),
+		store:            store,
+		calls:            map[string]int{},
+	}
+}
+
+// Inject adds a fault
+func (s *FaultyBlobStore) Inject(fault Fault) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+// FailNthCall makes the nth call (counting from 1) of an operation fail with err
+func (s *FaultyBlobStore) FailNthCall(op string, n int, err error) {
+	s.Inject(Fault{Op: op, Call: n, Fail: true, Err: err})
+}
+
+// FailKey makes all the operations on a key fail with err
+func (s *FaultyBlobStore) FailKey(key string, err error) {
+	s.Inject(Fault{Key: key, Fail: true, Err: err})
+}
+
+// AddLatency delays all the calls of an operation (of all operations if op is empty)
+func (s *FaultyBlobStore) AddLatency(op string, latency time.Duration) {
+	s.Inject(Fault{Op: op, Latency: latency})
+}
+
+// TruncateReads makes the reads of the blobs whose key starts with keyPrefix fail after n bytes
+func (s *FaultyBlobStore) TruncateReads(keyPrefix string, n int64) {
+	s.Inject(Fault{KeyPrefix: keyPrefix, Truncate: true, TruncateAfter: n})
+}
+
+// Reset removes all the faults and resets the call counters
+func (s *FaultyBlobStore) Reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.faults = nil
+	s.calls = map[string]int{}
+}
+
+// Calls returns the number of calls made so far to an operation
+func (s *FaultyBlobStore) Calls(op string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.calls[op]
+}
+
+// matches tells whether the fault applies to the nth call of an operation on a key
+func (fault *Fault) matches(op string, key string, call int) bool {
+	return (fault.Op == "" || fault.Op == op) &&
+		(fault.Key == "" || fault.Key == key) &&
+		strings.HasPrefix(key, fault.KeyPrefix) &&
+		(fault.Call == 0 || fault.Call == call)
+}
+
+// inject counts a call and applies the matching faults, returning the truncation to apply to the
+// call's reader (a negative one standing for none)
+func (s *FaultyBlobStore) inject(ctx context.Context, op string, key string) (int64, error) {
+	s.mutex.Lock()
+	s.calls[op]++
+	call := s.calls[op]
+	var matching []Fault
+	for _, fault := range s.faults {
+		if fault.matches(op, key, call) {
+			matching = append(matching, fault)
+		}
+	}
+	s.mutex.Unlock()
+
+	truncateAfter := int64(-1)
+	for _, fault := range matching {
+		if fault.Latency > 0 {
+			select {
+			case <-time.After(fault.Latency):
+			case <-ctx.Done():
+				return -1, ctx.Err()
+			}
+		}
+		if fault.Fail {
+			if fault.Err != nil {
+				return -1, fault.Err
+			}
+			return -1, ErrInjectedFault
+		}
+		if fault.Truncate && (truncateAfter < 0 || fault.TruncateAfter < truncateAfter) {
+			truncateAfter = fault.TruncateAfter
+		}
+	}
+	return truncateAfter, nil
+}
+
+// Put injects faults into the underlying store's Put
+func (s *FaultyBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext injects faults into the underlying store's PutWithContext
+func (s *FaultyBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	if _, err := s.inject(ctx, "put", key); err != nil {
+		return err
+	}
+	return s.ContextBlobStore.PutWithContext(ctx, key, data, size)
+}
+
+// Get injects faults into the underlying store's Get
+func (s *FaultyBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext injects faults into the underlying store's GetWithContext
+func (s *FaultyBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	truncateAfter, err := s.inject(ctx, "get", key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.ContextBlobStore.GetWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return truncateReadCloser(rc, truncateAfter), nil
+}
+
+// GetRange injects faults into the underlying store's ranged reads
+func (s *FaultyBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext injects faults into the underlying store's ranged reads
+func (s *FaultyBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	truncateAfter, err := s.inject(ctx, "get_range", key)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := GetBlobRange(ctx, s.store, key, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return truncateReadCloser(rc, truncateAfter), nil
+}
+
+// Delete injects faults into the underlying store's Delete
+func (s *FaultyBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext injects faults into the underlying store's DeleteWithContext
+func (s *FaultyBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	if _, err := s.inject(ctx, "delete", key); err != nil {
+		return err
+	}
+	return s.ContextBlobStore.DeleteWithContext(ctx, key)
+}
+
+// Rename injects faults into the underlying store's Rename
+func (s *FaultyBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext injects faults into the underlying store's RenameWithContext
+func (s *FaultyBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if _, err := s.inject(ctx, "rename", key); err != nil {
+		return err
+	}
+	return s.ContextBlobStore.RenameWithContext(ctx, key, newKey)
+}
+
+// Stat injects faults into the underlying store's Stat
+func (s *FaultyBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext injects faults into the underlying store's StatWithContext
+func (s *FaultyBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if _, err := s.inject(ctx, "stat", key); err != nil {
+		return nil, err
+	}
+	return s.ContextBlobStore.StatWithContext(ctx, key)
+}
+
+// Exists injects faults into the underlying store's Exists
+func (s *FaultyBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext injects faults into the underlying store's ExistsWithContext
+func (s *FaultyBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	if _, err := s.inject(ctx, "exists", key); err != nil {
+		return false, err
+	}
+	return s.ContextBlobStore.ExistsWithContext(ctx, key)
+}
+
+// List injects faults into the underlying store's List
+func (s *FaultyBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext injects faults into the underlying store's ListWithContext
+func (s *FaultyBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if _, err := s.inject(ctx, "list", prefix); err != nil {
+		return nil, err
+	}
+	return s.ContextBlobStore.ListWithContext(ctx, prefix, pageToken, pageSize)
+}
+
+// truncateReadCloser returns a reader failing with io.ErrUnexpectedEOF after n bytes if rc has more
+// to read (unless n is negative)
+func truncateReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+	return &readCloser{Reader: &truncatedReader{r: rc, remaining: n}, Closer: rc}
+}
+
+type truncatedReader struct {
+	r         io.Reader
+	remaining int64
+	truncated bool
+}
+
+func (r *truncatedReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		// Only cut the blob short if there is something left to cut
+		if !r.truncated {
+			if _, err := io.ReadFull(r.r, make([]byte, 1)); err == io.EOF {
+				return 0, io.EOF
+			}
+			r.truncated = true
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestFaultyBlobStoreFailNthCall(t *testing.T) {
+	store := NewFaultyBlobStore(NewMemoryBlobStore())
+	errBoom := errors.New("boom")
+	store.FailNthCall("put", 2, errBoom)
+
+	assert.NoError(t, store.Put("a", strings.NewReader("a"), 1))
+	assert.Equal(t, errBoom, store.Put("b", strings.NewReader("b"), 1))
+	assert.NoError(t, store.Put("c", strings.NewReader("c"), 1))
+	assert.Equal(t, 3, store.Calls("put"))
+	exists, err := store.Exists("b")
+	require.NoError(t, err)
+	assert.False(t, exists, "the failed put shouldn't have reached the store")
+
+	store.Reset()
+	assert.Equal(t, 0, store.Calls("put"))
+	assert.NoError(t, store.Put("b", strings.NewReader("b"), 1))
+	assert.NoError(t, store.Put("b", strings.NewReader("b"), 1))
+}
+
+func TestFaultyBlobStoreFailKey(t *testing.T) {
+	store := NewFaultyBlobStore(NewMemoryBlobStore())
+	store.FailKey("a/b", nil)
+
+	assert.Equal(t, ErrInjectedFault, store.Put("a/b", strings.NewReader("a"), 1))
+	assert.NoError(t, store.Put("a/bc", strings.NewReader("a"), 1))
+	assert.NoError(t, store.Put("a/b/c", strings.NewReader("a"), 1))
+	_, err := store.Stat("a/b")
+	assert.Equal(t, ErrInjectedFault, err)
+
+	store.Reset()
+	store.Inject(Fault{Op: "get", KeyPrefix: "a/b", Fail: true})
+	_, err = store.Get("a/bc")
+	assert.Equal(t, ErrInjectedFault, err)
+	_, err = store.Stat("a/bc")
+	assert.NoError(t, err)
+}
+
+func TestFaultyBlobStoreLatency(t *testing.T) {
+	store := NewFaultyBlobStore(NewMemoryBlobStore())
+	store.AddLatency("put", 50*time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, store.Put("a", strings.NewReader("a"), 1))
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	start = time.Now()
+	_, err := store.Stat("a")
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) < 50*time.Millisecond, "other operations shouldn't be delayed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = store.PutWithContext(ctx, "b", strings.NewReader("b"), 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	exists, err := store.Exists("b")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestFaultyBlobStoreTruncateReads(t *testing.T) {
+	store := NewFaultyBlobStore(NewMemoryBlobStore())
+	require.NoError(t, store.Put("long", strings.NewReader("0123456789"), 10))
+	require.NoError(t, store.Put("short", strings.NewReader("0123"), 4))
+	store.TruncateReads("", 4)
+
+	rc, err := store.Get("long")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, "0123", string(data))
+
+	rc, err = store.Get("short")
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.NoError(t, err, "a blob ending at the truncation point should be read entirely")
+	assert.Equal(t, "0123", string(data))
+
+	rc, err = GetBlobRange(context.Background(), store, "long", 5, -1)
+	require.NoError(t, err)
+	buf := make([]byte, 3)
+	_, err = io.ReadFull(rc, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "567", string(buf))
+	_, err = io.ReadFull(rc, buf)
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	for i := 0; i < 3; i++ {
+		_, err = rc.Read(buf)
+		assert.Equal(t, io.ErrUnexpectedEOF, err, "a truncated read should keep failing")
+	}
+	rc.Close()
+}
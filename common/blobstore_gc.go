@@ -36,75 +36,357 @@
 package common
 
 import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 )
 
 // GCBlobStore implements the interface Blobstore for Google Cloud Storage
 type GCBlobStore struct {
-	bucket *storage.BucketHandle
+	bucket     *storage.BucketHandle
+	bucketName string
+
+	// Service account credentials used to sign URLs
+	googleAccessID string
+	privateKey     []byte
+}
+
+// GCConfig describes how to reach a Google Cloud Storage bucket. Only Bucket is mandatory.
+type GCConfig struct {
+	Bucket string
+
+	// GoogleAccessID (the email address of a service account) and PrivateKey (its PEM encoded
+	// private key) are needed to issue signed URLs. They are read from the service account key file
+	// pointed to by $GOOGLE_APPLICATION_CREDENTIALS when GoogleAccessID is empty.
+	GoogleAccessID string
+	PrivateKey     []byte
 }
 
 // NewGCBlobStore creates a new Google Cloud Blobstore
 func NewGCBlobStore(bucketName string) (*GCBlobStore, error) {
+	return NewGCBlobStoreWithConfig(GCConfig{Bucket: bucketName})
+}
+
+// NewGCBlobStoreWithConfig creates a new Google Cloud Blobstore from a GCConfig
+func NewGCBlobStoreWithConfig(conf GCConfig) (*GCBlobStore, error) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("[gc-storage] Error creating client: %s", err)
 	}
-	bucket := client.Bucket(bucketName)
+	if conf.GoogleAccessID == "" {
+		conf.GoogleAccessID, conf.PrivateKey = gcServiceAccountKey(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"))
+	}
+	bucket := client.Bucket(conf.Bucket)
 	return &GCBlobStore{
-		bucket: bucket,
+		bucket:         bucket,
+		bucketName:     conf.Bucket,
+		googleAccessID: conf.GoogleAccessID,
+		privateKey:     conf.PrivateKey,
 	}, nil
 }
 
 // Put streams a file to GC
 func (s *GCBlobStore) Put(key string, r io.Reader, size int64) error {
-	obj := s.bucket.Object(key)
+	return s.PutWithContext(context.Background(), key, r, size)
+}
+
+// PutWithContext streams a file to GC. The upload is aborted (and the object left untouched) if
+// ctx is done before it completes.
+func (s *GCBlobStore) PutWithContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, r, size, nil)
+}
 
-	w := obj.NewWriter(context.Background())
+// PutWithMetadata streams a file to GC, attaching the given metadata to the object
+func (s *GCBlobStore) PutWithMetadata(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string) error {
+	return s.put(ctx, key, s.bucket.Object(key), r, metadata)
+}
+
+// PutIfAbsent streams a file to GC, unless there already is an object under the same key
+func (s *GCBlobStore) PutIfAbsent(key string, r io.Reader, size int64) error {
+	return s.PutIfAbsentWithContext(context.Background(), key, r, size)
+}
+
+// PutIfAbsentWithContext streams a file to GC, unless there already is an object under the same
+// key (using a precondition on the object's generation)
+func (s *GCBlobStore) PutIfAbsentWithContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	return s.put(ctx, key, s.bucket.Object(key).If(storage.Conditions{DoesNotExist: true}), r, nil)
+}
+
+func (s *GCBlobStore) put(ctx context.Context, key string, obj *storage.ObjectHandle, r io.Reader, metadata map[string]string) error {
+	// Cancelling the writer's context is the only way to abort an upload without committing it
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := obj.NewWriter(ctx)
+	w.Metadata = metadata
 
 	n, err := io.Copy(w, r)
 	if err != nil {
-		return fmt.Errorf("[gc-storage] Error uploading file (%d bytes written): %s", n, err)
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error uploading file (%d bytes written): %w", n, err))
 	}
 	if err := w.Close(); err != nil {
-		return fmt.Errorf("[gc-storage] Error uploading file: Error closing object: %s", err)
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error uploading file: Error closing object: %w", err))
+	}
+	return nil
+}
+
+// SetMetadata replaces the metadata of an object
+func (s *GCBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	// An empty (but non nil) map is required to delete all the existing metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	_, err := s.bucket.Object(key).Update(ctx, storage.ObjectAttrsToUpdate{Metadata: metadata})
+	if err != nil {
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error updating file metadata: %w", err))
 	}
 	return nil
 }
 
 // Get retrieve a data with the specified uuid
 func (s *GCBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext retrieves a data with the specified uuid, the download being aborted as soon as
+// ctx is done
+func (s *GCBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
 	obj := s.bucket.Object(key)
-	r, err := obj.NewReader(context.Background())
+	r, err := obj.NewReader(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("[gc-storage] Error retrieving file: %s", err)
+		return nil, gcBlobError(key, fmt.Errorf("[gc-storage] Error retrieving file: %w", err))
+	}
+	return r, nil
+}
+
+// GetRange retrieves a part of a data with the specified uuid
+func (s *GCBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext retrieves a part of a data with the specified uuid, the download being
+// aborted as soon as ctx is done
+func (s *GCBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		length = -1
+	}
+	r, err := s.bucket.Object(key).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcBlobError(key, fmt.Errorf("[gc-storage] Error retrieving file range: %w", err))
 	}
 	return r, nil
 }
 
 // Delete deletes a data with the specified uuid
 func (s *GCBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a data with the specified uuid
+func (s *GCBlobStore) DeleteWithContext(ctx context.Context, key string) error {
 	obj := s.bucket.Object(key)
-	if err := obj.Delete(context.Background()); err != nil {
-		return fmt.Errorf("[gc-storage] Error deleting file: %s", err)
+	if err := obj.Delete(ctx); err != nil {
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error deleting file: %w", err))
+	}
+	return nil
+}
+
+// DeleteIfUnchanged deletes an object, unless its generation isn't version anymore
+func (s *GCBlobStore) DeleteIfUnchanged(ctx context.Context, key string, version string) error {
+	generation, err := strconv.ParseInt(version, 10, 64)
+	if err != nil {
+		return fmt.Errorf("[gc-storage] Invalid generation %q for %s: %s", version, key, err)
+	}
+	obj := s.bucket.Object(key).If(storage.Conditions{GenerationMatch: generation})
+	if err := obj.Delete(ctx); err != nil {
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) {
+			return conditionalBlobError(apiErr.Code, key, fmt.Errorf("[gc-storage] Error deleting file: %w", err))
+		}
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error deleting file: %w", err))
 	}
 	return nil
 }
 
 // Rename renames a data with the specified uuid
 func (s *GCBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext renames a data with the specified uuid
+func (s *GCBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	return s.rename(ctx, key, s.bucket.Object(newKey))
+}
+
+// RenameIfAbsent renames an object, unless there already is an object under the new key
+func (s *GCBlobStore) RenameIfAbsent(key string, newKey string) error {
+	return s.RenameIfAbsentWithContext(context.Background(), key, newKey)
+}
+
+// RenameIfAbsentWithContext renames an object, unless there already is an object under the new key
+// (using a precondition on the copy)
+func (s *GCBlobStore) RenameIfAbsentWithContext(ctx context.Context, key string, newKey string) error {
+	return s.rename(ctx, key, s.bucket.Object(newKey).If(storage.Conditions{DoesNotExist: true}))
+}
+
+func (s *GCBlobStore) rename(ctx context.Context, key string, objDest *storage.ObjectHandle) error {
 	objSrc := s.bucket.Object(key)
-	objDest := s.bucket.Object(newKey)
-	if _, err := objDest.CopierFrom(objSrc).Run(context.Background()); err != nil {
-		return fmt.Errorf("[gc-storage] Error renaming file: %s", err)
+	if _, err := objDest.CopierFrom(objSrc).Run(ctx); err != nil {
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error renaming file: %w", err))
+	}
+	if err := objSrc.Delete(ctx); err != nil {
+		return gcBlobError(key, fmt.Errorf("[gc-storage] Error deleting old file: %w", err))
 	}
-	if err := objSrc.Delete(context.Background()); err != nil {
-		return fmt.Errorf("[gc-storage] Error deleting old file: %s", err)
+	return nil
+}
+
+// Copy copies an object (and its metadata) server-side
+func (s *GCBlobStore) Copy(src string, dst string) error {
+	return s.CopyWithContext(context.Background(), src, dst)
+}
+
+// CopyWithContext copies an object (and its metadata) server-side
+func (s *GCBlobStore) CopyWithContext(ctx context.Context, src string, dst string) error {
+	if _, err := s.bucket.Object(dst).CopierFrom(s.bucket.Object(src)).Run(ctx); err != nil {
+		return gcBlobError(src, fmt.Errorf("[gc-storage] Error copying file: %w", err))
 	}
 	return nil
 }
+
+// Stat returns information on an object, from its attributes
+func (s *GCBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on an object, from its attributes
+func (s *GCBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	attrs, err := s.bucket.Object(key).Attrs(ctx)
+	if err != nil {
+		return nil, gcBlobError(key, fmt.Errorf("[gc-storage] Error retrieving file attributes: %w", err))
+	}
+	info := gcBlobInfo(attrs)
+	info.Metadata = lowerKeys(attrs.Metadata)
+	return &info, nil
+}
+
+// Exists checks whether an object exists
+func (s *GCBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether an object exists
+func (s *GCBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	_, err := s.StatWithContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List lists the objects of the bucket whose key starts with prefix
+func (s *GCBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext lists the objects of the bucket whose key starts with prefix
+func (s *GCBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: prefix})
+
+	var objects []*storage.ObjectAttrs
+	nextPageToken, err := iterator.NewPager(it, pageSize, pageToken).NextPage(&objects)
+	if err != nil {
+		return nil, gcBlobError(prefix, fmt.Errorf("[gc-storage] Error listing files: %w", err))
+	}
+
+	page := &BlobPage{NextPageToken: nextPageToken}
+	for _, attrs := range objects {
+		page.Blobs = append(page.Blobs, gcBlobInfo(attrs))
+	}
+	return page, nil
+}
+
+// SignedURL returns a signed URL granting method on an object for ttl. It requires service account
+// credentials (see GCConfig).
+func (s *GCBlobStore) SignedURL(key string, method string, ttl time.Duration) (string, error) {
+	method, err := checkSignedURLRequest(key, method, ttl)
+	if err != nil {
+		return "", err
+	}
+	if s.googleAccessID == "" {
+		return "", errors.New("[gc-storage] No service account credentials to sign URLs with")
+	}
+	signedURL, err := storage.SignedURL(s.bucketName, key, &storage.SignedURLOptions{
+		GoogleAccessID: s.googleAccessID,
+		PrivateKey:     s.privateKey,
+		Method:         method,
+		Expires:        time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", fmt.Errorf("[gc-storage] Error signing %s URL for %s: %s", method, key, err)
+	}
+	return signedURL, nil
+}
+
+// gcServiceAccountKey returns the email address and private key held by a service account key file,
+// or empty values if path isn't one
+func gcServiceAccountKey(path string) (string, []byte) {
+	if path == "" {
+		return "", nil
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil
+	}
+	var key struct {
+		Type        string `json:"type"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(content, &key); err != nil || key.Type != "service_account" {
+		return "", nil
+	}
+	return key.ClientEmail, []byte(key.PrivateKey)
+}
+
+// gcBlobError classifies an error returned by the Google Cloud Storage client
+func gcBlobError(key string, err error) error {
+	var apiErr *googleapi.Error
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist), errors.Is(err, storage.ErrBucketNotExist):
+		return newBlobError(ErrNotFound, key, err)
+	case errors.As(err, &apiErr):
+		return httpBlobError(apiErr.Code, key, err)
+	default:
+		return err
+	}
+}
+
+func gcBlobInfo(attrs *storage.ObjectAttrs) BlobInfo {
+	info := BlobInfo{
+		Key:     attrs.Name,
+		Size:    attrs.Size,
+		ModTime: attrs.Updated,
+		Version: strconv.FormatInt(attrs.Generation, 10),
+	}
+	if len(attrs.MD5) > 0 {
+		info.ContentHash = "md5:" + hex.EncodeToString(attrs.MD5)
+	}
+	return info
+}
@@ -0,0 +1,502 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// HTTPConfig describes how to reach the HTTP server behind an HTTPBlobStore
+type HTTPConfig struct {
+	// BaseURL is the URL of the directory (or WebDAV collection) where blobs are stored
+	BaseURL string
+
+	// WebDAV enables the WebDAV methods required for Rename (MOVE) and List (PROPFIND), and makes
+	// Put create the parent collections of blobs (MKCOL)
+	WebDAV bool
+
+	// Basic authentication credentials, or bearer token, if any
+	Username    string
+	Password    string
+	BearerToken string
+
+	// Client is the HTTP client to use (http.DefaultClient if nil)
+	Client *http.Client
+}
+
+// HTTPBlobStore is a BlobStore implementation storing blobs on a plain HTTP file server (with
+// PUT/GET/DELETE support) or on a WebDAV server
+type HTTPBlobStore struct {
+	baseURL *url.URL
+	conf    HTTPConfig
+}
+
+// HTTPStatusError is returned by the HTTP based blob stores when the server answers with an
+// unexpected status code
+type HTTPStatusError struct {
+	Prefix     string
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (err *HTTPStatusError) Error() string {
+	return fmt.Sprintf("%s Unexpected status code (%d %s) performing %s request against %s: %s", err.Prefix, err.StatusCode, http.StatusText(err.StatusCode), err.Method, err.URL, err.Body)
+}
+
+// Is maps the status code onto the sentinel errors (ErrNotFound for a 404...)
+func (err *HTTPStatusError) Is(target error) bool {
+	kind := statusErrorKind(err.StatusCode)
+	return kind != nil && target == kind
+}
+
+// newHTTPStatusError builds an HTTPStatusError from a response, consuming (and closing) its body
+func newHTTPStatusError(prefix string, resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &HTTPStatusError{
+		Prefix:     prefix,
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Body:       string(body),
+	}
+}
+
+// NewHTTPBlobStore creates a new HTTPBlobStore
+func NewHTTPBlobStore(conf HTTPConfig) (*HTTPBlobStore, error) {
+	baseURL, err := url.Parse(strings.TrimSuffix(conf.BaseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("[http-storage] Invalid base URL %s: %s", conf.BaseURL, err)
+	}
+	if baseURL.Scheme != "http" && baseURL.Scheme != "https" {
+		return nil, fmt.Errorf("[http-storage] Invalid base URL %s: not an HTTP(S) URL", conf.BaseURL)
+	}
+	if conf.Client == nil {
+		conf.Client = http.DefaultClient
+	}
+	return &HTTPBlobStore{baseURL: baseURL, conf: conf}, nil
+}
+
+// Put uploads a blob with a PUT request
+func (s *HTTPBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext uploads a blob with a PUT request (after having created its parent collections on
+// WebDAV servers)
+func (s *HTTPBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	if s.conf.WebDAV {
+		if err := s.mkcolParents(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	resp, err := s.do(ctx, http.MethodPut, s.keyURL(key), data, size, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return newHTTPStatusError("[http-storage]", resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// mkcolParents creates the parent collections of a key, if they don't exist yet
+func (s *HTTPBlobStore) mkcolParents(ctx context.Context, key string) error {
+	elems := strings.Split(key, "/")
+	for i := 1; i < len(elems); i++ {
+		resp, err := s.do(ctx, "MKCOL", s.keyURL(strings.Join(elems[:i], "/"))+"/", nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		// 405 Method Not Allowed means that the collection already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return newHTTPStatusError("[http-storage]", resp)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Get downloads a blob with a GET request
+func (s *HTTPBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext downloads a blob with a GET request
+func (s *HTTPBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(ctx, key, 0, -1)
+}
+
+// GetRange downloads a part of a blob with a GET request with a Range header
+func (s *HTTPBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext downloads a part of a blob with a GET request with a Range header
+func (s *HTTPBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	if err := validateBlobKey(key); err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	header := http.Header{}
+	if offset > 0 || length > 0 {
+		header.Set("Range", httpRange(offset, length))
+	}
+	resp, err := s.do(ctx, http.MethodGet, s.keyURL(key), nil, 0, header)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// The server ignored our Range header
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil && err != io.EOF {
+			resp.Body.Close()
+			return nil, err
+		}
+		return limitReadCloser(resp.Body, length), nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	default:
+		return nil, newHTTPStatusError("[http-storage]", resp)
+	}
+}
+
+// Delete deletes a blob with a DELETE request
+func (s *HTTPBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a blob with a DELETE request
+func (s *HTTPBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	resp, err := s.do(ctx, http.MethodDelete, s.keyURL(key), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusAccepted {
+		return newHTTPStatusError("[http-storage]", resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Rename moves a blob with a WebDAV MOVE request
+func (s *HTTPBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext moves a blob with a WebDAV MOVE request
+func (s *HTTPBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if !s.conf.WebDAV {
+		return fmt.Errorf("[http-storage] Rename requires a WebDAV server")
+	}
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	if err := validateBlobKey(newKey); err != nil {
+		return err
+	}
+	if err := s.mkcolParents(ctx, newKey); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Destination", s.keyURL(newKey))
+	header.Set("Overwrite", "T")
+	resp, err := s.do(ctx, "MOVE", s.keyURL(key), nil, 0, header)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return newHTTPStatusError("[http-storage]", resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Stat returns information on a blob, using a HEAD request
+func (s *HTTPBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on a blob, using a HEAD request
+func (s *HTTPBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if err := validateBlobKey(key); err != nil {
+		return nil, err
+	}
+	resp, err := s.do(ctx, http.MethodHead, s.keyURL(key), nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newHTTPStatusError("[http-storage]", resp)
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &BlobInfo{
+		Key:     key,
+		Size:    resp.ContentLength,
+		ModTime: modTime,
+	}, nil
+}
+
+// Exists checks whether a blob exists, using a HEAD request
+func (s *HTTPBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether a blob exists, using a HEAD request
+func (s *HTTPBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	_, err := s.StatWithContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List lists blobs by walking WebDAV collections with PROPFIND requests
+func (s *HTTPBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext lists blobs by walking WebDAV collections with PROPFIND requests. As WebDAV has
+// no notion of pagination, the whole tree under prefix is walked for every page.
+func (s *HTTPBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if !s.conf.WebDAV {
+		return nil, fmt.Errorf("[http-storage] List requires a WebDAV server")
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = prefix[:i]
+		if err := validateBlobKey(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	var blobs []BlobInfo
+	collections := []string{dir}
+	for len(collections) > 0 {
+		collection := collections[0]
+		collections = collections[1:]
+
+		entries, err := s.propfind(ctx, collection)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.collection {
+				if strings.HasPrefix(entry.key+"/", prefix) || strings.HasPrefix(prefix, entry.key+"/") {
+					collections = append(collections, entry.key)
+				}
+				continue
+			}
+			if strings.HasPrefix(entry.key, prefix) && entry.key > pageToken {
+				blobs = append(blobs, entry.BlobInfo)
+			}
+		}
+	}
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	page := &BlobPage{Blobs: blobs}
+	if len(blobs) > pageSize {
+		page.Blobs = blobs[:pageSize]
+		page.NextPageToken = blobs[pageSize-1].Key
+	}
+	return page, nil
+}
+
+type webDAVEntry struct {
+	BlobInfo
+	key        string
+	collection bool
+}
+
+type webDAVMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+				ResourceType  struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const webDAVPropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><getcontentlength/><getlastmodified/><resourcetype/></prop></propfind>`
+
+// propfind lists the direct children of a collection ("" being the base collection)
+func (s *HTTPBlobStore) propfind(ctx context.Context, collection string) ([]webDAVEntry, error) {
+	collectionURL := s.baseURL.String() + "/"
+	if collection != "" {
+		collectionURL = s.keyURL(collection) + "/"
+	}
+
+	header := http.Header{}
+	header.Set("Depth", "1")
+	header.Set("Content-Type", "application/xml")
+	body := strings.NewReader(webDAVPropfindBody)
+	resp, err := s.do(ctx, "PROPFIND", collectionURL, body, int64(body.Len()), header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && collection != "" {
+		resp.Body.Close()
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, newHTTPStatusError("[http-storage]", resp)
+	}
+	defer resp.Body.Close()
+
+	var multistatus webDAVMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&multistatus); err != nil {
+		return nil, fmt.Errorf("[http-storage] Error parsing PROPFIND response from %s: %s", collectionURL, err)
+	}
+
+	var entries []webDAVEntry
+	for _, r := range multistatus.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, fmt.Errorf("[http-storage] Invalid href in PROPFIND response: %s", r.Href)
+		}
+		key := strings.Trim(strings.TrimPrefix(href.Path, s.baseURL.Path), "/")
+		if key == collection {
+			continue
+		}
+
+		entry := webDAVEntry{key: key}
+		entry.Key = key
+		for _, propstat := range r.Propstat {
+			prop := propstat.Prop
+			if prop.ResourceType.Collection != nil {
+				entry.collection = true
+			}
+			if prop.ContentLength != "" {
+				entry.Size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			}
+			if prop.LastModified != "" {
+				entry.ModTime, _ = http.ParseTime(prop.LastModified)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// keyURL returns the (escaped) URL of a key
+func (s *HTTPBlobStore) keyURL(key string) string {
+	u := *s.baseURL
+	u.Path = path.Join(s.baseURL.Path, key)
+	return u.String()
+}
+
+func (s *HTTPBlobStore) do(ctx context.Context, method string, url string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, fmt.Errorf("[http-storage] Error building %s request against %s: %s", method, url, err)
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	switch {
+	case s.conf.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+s.conf.BearerToken)
+	case s.conf.Username != "":
+		req.SetBasicAuth(s.conf.Username, s.conf.Password)
+	}
+
+	resp, err := s.conf.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("[http-storage] Error performing %s request against %s: %s", method, url, err)
+	}
+	return resp, nil
+}
+
+// httpRange returns the value of an HTTP Range header. A negative length stands for "up to the
+// end".
+func httpRange(offset int64, length int64) string {
+	if length < 0 {
+		return fmt.Sprintf("bytes=%d-", offset)
+	}
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
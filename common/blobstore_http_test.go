@@ -0,0 +1,153 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+	"golang.org/x/net/webdav"
+)
+
+// newTestWebDAVServer serves an in-memory WebDAV tree under /dav, with basic authentication
+func newTestWebDAVServer(t *testing.T) *httptest.Server {
+	dav := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "morpheo" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		dav.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPBlobStoreWebDAV(t *testing.T) {
+	ctx := context.Background()
+	server := newTestWebDAVServer(t)
+	store, err := NewHTTPBlobStore(HTTPConfig{
+		BaseURL:  server.URL + "/dav/",
+		WebDAV:   true,
+		Username: "morpheo",
+		Password: "secret",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.PutWithContext(ctx, "algo/v1/model.tar", strings.NewReader("model"), 5))
+	data, err := readBlob(t, store, "algo/v1/model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "model", string(data))
+
+	info, err := store.Stat("algo/v1/model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.False(t, info.ModTime.IsZero())
+
+	rc, err := store.GetRange("algo/v1/model.tar", 1, 3)
+	require.NoError(t, err)
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "ode", string(data))
+
+	require.NoError(t, store.Put("algo/v2/model.tar", strings.NewReader("model v2"), -1))
+	require.NoError(t, store.Put("algorithms", strings.NewReader("list"), 4))
+	require.NoError(t, store.Put("data/a", strings.NewReader("a"), 1))
+	require.NoError(t, store.Rename("algo/v2/model.tar", "algo/v3/model name.tar"))
+	exists, err := store.Exists("algo/v2/model.tar")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	var keys []string
+	pageToken := ""
+	for {
+		page, err := store.List("algo", pageToken, 2)
+		require.NoError(t, err)
+		for _, blob := range page.Blobs {
+			keys = append(keys, blob.Key)
+			assert.NotZero(t, blob.Size, blob.Key)
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"algo/v1/model.tar", "algo/v3/model name.tar", "algorithms"}, keys)
+
+	page, err := store.List("algo/v3/", "", 0)
+	require.NoError(t, err)
+	require.Len(t, page.Blobs, 1)
+	assert.Equal(t, "algo/v3/model name.tar", page.Blobs[0].Key)
+	assert.Equal(t, int64(8), page.Blobs[0].Size)
+
+	require.NoError(t, store.Delete("algo/v1/model.tar"))
+	_, err = store.Get("algo/v1/model.tar")
+	assert.True(t, errors.Is(err, ErrNotFound), "Get on a deleted key: %v", err)
+	_, err = store.Stat("algo/v1/model.tar")
+	assert.True(t, errors.Is(err, ErrNotFound), "Stat on a deleted key: %v", err)
+	page, err = store.List("missing/", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, page.Blobs)
+}
+
+func TestHTTPBlobStorePlainServer(t *testing.T) {
+	server := newTestWebDAVServer(t)
+	store, err := NewHTTPBlobStore(HTTPConfig{BaseURL: server.URL + "/dav", Username: "morpheo", Password: "secret"})
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put("model.tar", strings.NewReader("model"), 5))
+	data, err := readBlob(t, store, "model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "model", string(data))
+
+	assert.Error(t, store.Rename("model.tar", "other.tar"), "Rename requires WebDAV")
+	_, err = store.List("", "", 0)
+	assert.Error(t, err, "List requires WebDAV")
+
+	store.conf.Password = "wrong"
+	_, err = store.Stat("model.tar")
+	assert.True(t, errors.Is(err, ErrPermission), "Stat with wrong credentials: %v", err)
+}
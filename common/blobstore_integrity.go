@@ -0,0 +1,243 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// IntegrityMetadataKey is the metadata key under which IntegrityBlobStore records the hex encoded
+// SHA-256 digest of the blobs it writes
+const IntegrityMetadataKey = "sha256"
+
+// IntegrityError is returned when the size or the digest of a blob doesn't match the expected one,
+// be it when writing or reading it
+type IntegrityError struct {
+	Key      string
+	Field    string
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("[integrity] %s mismatch for blob %s: expected %s, got %s", e.Field, e.Key, e.Expected, e.Actual)
+}
+
+// IntegrityBlobStore wraps a MetadataBlobStore to detect corrupted or tampered blobs. The SHA-256
+// digest of every blob is computed while it is streamed to the underlying store, and recorded in its
+// metadata: along with the blob when it is known beforehand (see PutWithDigest), right after the
+// blob has been committed otherwise (readers may then briefly see the blob without its digest).
+// Writes whose byte count differs from the announced size (unless it is negative, meaning unknown)
+// or whose digest differs from the expected one are rejected. Reads fail on EOF if the content
+// doesn't match the recorded digest, so readers should only trust the data once they've reached the
+// end of it.
+type IntegrityBlobStore struct {
+	MetadataBlobStore
+
+	// RequireDigest makes Get fail on blobs that have no recorded digest (instead of returning them
+	// unchecked)
+	RequireDigest bool
+}
+
+// NewIntegrityBlobStore wraps store (which must support metadata) in an IntegrityBlobStore
+func NewIntegrityBlobStore(store BlobStore) (*IntegrityBlobStore, error) {
+	mstore, ok := store.(MetadataBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("[integrity] Underlying blob store (%T) doesn't support metadata", store)
+	}
+	return &IntegrityBlobStore{MetadataBlobStore: mstore}, nil
+}
+
+// Put writes a blob to the underlying store along with its digest
+func (s *IntegrityBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithDigest(context.Background(), key, data, size, "")
+}
+
+// PutWithContext writes a blob to the underlying store along with its digest
+func (s *IntegrityBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithDigest(ctx, key, data, size, "")
+}
+
+// PutWithMetadata writes a blob to the underlying store along with its digest and the given
+// metadata
+func (s *IntegrityBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	return s.put(ctx, key, data, size, "", metadata)
+}
+
+// PutWithDigest streams a blob to the underlying store, rejecting it if its hex encoded SHA-256
+// digest isn't expectedDigest. An empty expectedDigest disables the check.
+func (s *IntegrityBlobStore) PutWithDigest(ctx context.Context, key string, data io.Reader, size int64, expectedDigest string) error {
+	return s.put(ctx, key, data, size, expectedDigest, nil)
+}
+
+func (s *IntegrityBlobStore) put(ctx context.Context, key string, data io.Reader, size int64, expectedDigest string, metadata map[string]string) error {
+	meta := make(map[string]string, len(metadata)+1)
+	for k, v := range metadata {
+		meta[k] = v
+	}
+	r := newDigestReader(key, data, size, expectedDigest)
+	if expectedDigest != "" {
+		meta[IntegrityMetadataKey] = expectedDigest
+	}
+	if err := s.MetadataBlobStore.PutWithMetadata(ctx, key, r, size, meta); err != nil {
+		if r.err != nil {
+			return r.err
+		}
+		return err
+	}
+
+	// The underlying store may have stopped reading before EOF (after size bytes for instance): in
+	// that case, the blob it committed needs to be checked (and removed) a posteriori
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		if r.err != nil {
+			s.MetadataBlobStore.DeleteWithContext(ctx, key)
+		}
+		return err
+	}
+	if expectedDigest != "" {
+		return nil
+	}
+
+	meta[IntegrityMetadataKey] = r.digest()
+	return s.MetadataBlobStore.SetMetadata(ctx, key, meta)
+}
+
+// Get returns a reader on a blob that fails on EOF if the blob doesn't match its recorded size and
+// digest
+func (s *IntegrityBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext returns a reader on a blob that fails on EOF if the blob doesn't match its
+// recorded size and digest
+func (s *IntegrityBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	info, err := s.MetadataBlobStore.StatWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	digest := info.Metadata[IntegrityMetadataKey]
+	if digest == "" && s.RequireDigest {
+		return nil, fmt.Errorf("[integrity] Blob %s has no recorded digest", key)
+	}
+
+	rc, err := s.MetadataBlobStore.GetWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if digest == "" {
+		return rc, nil
+	}
+	return &digestReadCloser{
+		digestReader: newDigestReader(key, rc, info.Size, digest),
+		Closer:       rc,
+	}, nil
+}
+
+// digestReader computes the SHA-256 digest of the data it reads and, on EOF, returns an
+// IntegrityError instead of io.EOF if the byte count or the digest doesn't match the expected one.
+// It also fails as soon as more bytes than expected have been read.
+type digestReader struct {
+	key            string
+	r              io.Reader
+	hash           hash.Hash
+	n              int64
+	size           int64
+	expectedDigest string
+	err            error
+}
+
+func newDigestReader(key string, r io.Reader, size int64, expectedDigest string) *digestReader {
+	return &digestReader{
+		key:            key,
+		r:              r,
+		hash:           sha256.New(),
+		size:           size,
+		expectedDigest: expectedDigest,
+	}
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.r.Read(p)
+	r.hash.Write(p[:n])
+	r.n += int64(n)
+
+	if r.size >= 0 && r.n > r.size {
+		r.err = r.sizeError()
+		return n, r.err
+	}
+	if err != io.EOF {
+		return n, err
+	}
+
+	if r.size >= 0 && r.n != r.size {
+		r.err = r.sizeError()
+	} else if r.expectedDigest != "" && r.digest() != r.expectedDigest {
+		r.err = &IntegrityError{Key: r.key, Field: "sha256", Expected: r.expectedDigest, Actual: r.digest()}
+	}
+	if r.err != nil {
+		return n, r.err
+	}
+	return n, io.EOF
+}
+
+func (r *digestReader) sizeError() error {
+	return &IntegrityError{
+		Key:      r.key,
+		Field:    "size",
+		Expected: strconv.FormatInt(r.size, 10),
+		Actual:   strconv.FormatInt(r.n, 10),
+	}
+}
+
+func (r *digestReader) digest() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+type digestReadCloser struct {
+	*digestReader
+	io.Closer
+}
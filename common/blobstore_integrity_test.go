@@ -0,0 +1,114 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// streamCheckingBlobStore fails the writes whose data has been read entirely before being given to
+// the store
+type streamCheckingBlobStore struct {
+	*MemoryBlobStore
+	source *strings.Reader
+}
+
+func (s *streamCheckingBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	if s.source.Len() == 0 {
+		return errors.New("blob spooled before being written")
+	}
+	return s.MemoryBlobStore.PutWithMetadata(ctx, key, data, size, metadata)
+}
+
+func TestIntegrityBlobStoreStreamsBlobs(t *testing.T) {
+	ctx := context.Background()
+	source := strings.NewReader("content")
+	mem := NewMemoryBlobStore()
+	store, err := NewIntegrityBlobStore(&streamCheckingBlobStore{MemoryBlobStore: mem, source: source})
+	require.NoError(t, err)
+
+	require.NoError(t, store.PutWithMetadata(ctx, "blob", source, -1, map[string]string{"owner": "me"}))
+	info, err := mem.Stat("blob")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"owner":              "me",
+		IntegrityMetadataKey: "ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73",
+	}, info.Metadata)
+	data, err := readBlob(t, store, "blob")
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
+
+func TestIntegrityBlobStoreRejectsMismatches(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryBlobStore()
+	store, err := NewIntegrityBlobStore(mem)
+	require.NoError(t, err)
+
+	for _, size := range []int64{0, 6, 8} {
+		err := store.PutWithContext(ctx, "blob", strings.NewReader("content"), size)
+		var integrityErr *IntegrityError
+		require.True(t, errors.As(err, &integrityErr), "size %d: %v", size, err)
+		assert.Equal(t, "size", integrityErr.Field)
+		exists, err := mem.Exists("blob")
+		require.NoError(t, err)
+		assert.False(t, exists, "size %d", size)
+	}
+	require.NoError(t, store.PutWithContext(ctx, "empty", strings.NewReader(""), 0))
+
+	err = store.PutWithDigest(ctx, "blob", strings.NewReader("content"), 7, strings.Repeat("0", 64))
+	var integrityErr *IntegrityError
+	require.True(t, errors.As(err, &integrityErr), "%v", err)
+	assert.Equal(t, "sha256", integrityErr.Field)
+	exists, err := mem.Exists("blob")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// Tampered blobs fail on EOF
+	require.NoError(t, store.PutWithContext(ctx, "blob", strings.NewReader("content"), 7))
+	info, err := mem.Stat("blob")
+	require.NoError(t, err)
+	require.NoError(t, mem.PutWithMetadata(ctx, "blob", strings.NewReader("CONTENT"), 7, info.Metadata))
+	_, err = readBlob(t, store, "blob")
+	assert.True(t, errors.As(err, &integrityErr), "%v", err)
+}
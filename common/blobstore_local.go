@@ -36,14 +36,43 @@
 package common
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Directories, relative to the data directory, where LocalBlobStore keeps its own files. Keys can't
+// point inside of them, nor go through symbolic links pointing outside of the data directory.
+const (
+	localInternalDir = ".blobstore"
+	localMetaDir     = localInternalDir + "/meta"
+	localTmpDir      = localInternalDir + "/tmp"
 )
 
-// LocalBlobStore is a BlobStore implementations that stores data on the local hard drive
+// LocalBlobStore is a BlobStore implementations that stores data on the local hard drive. Files are
+// written to a temporary location first and only moved to their final path once they've been
+// entirely written and synced to disk, so that a crash never leaves a truncated blob behind.
 type LocalBlobStore struct {
 	DataDir string
+
+	// Signer issues the URLs returned by SignedURL, to be served by a SignedURLHandler on this store
+	Signer *HMACURLSigner
+}
+
+// localBlobMeta is what LocalBlobStore records about each blob it writes
+type localBlobMeta struct {
+	SHA256   string            `json:"sha256"`
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // NewLocalBlobStore creates a new local Blobstore given a data directory
@@ -56,43 +85,617 @@ func NewLocalBlobStore(dataDir string) (BlobStore, error) {
 // Put writes a file in the data directory (and creates necessarry sub-directories if there are
 // forward slashes in the key name)
 func (s *LocalBlobStore) Put(key string, data io.Reader, size int64) error {
-	datapath := filepath.Join(s.DataDir, key)
+	return s.PutWithContext(context.Background(), key, data, size)
+}
 
-	parent := filepath.Dir(datapath)
-	_, err := os.Stat(parent)
-	if os.IsNotExist(err) {
-		err := os.MkdirAll(parent, 0755)
-		if err != nil {
-			return err
-		}
+// PutWithContext is the same as Put, except that the copy is aborted as soon as ctx is done
+func (s *LocalBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, data, size, nil)
+}
+
+// PutWithMetadata writes a file in the data directory and records its SHA-256 digest along with the
+// given metadata
+func (s *LocalBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	return s.put(ctx, key, data, metadata, os.Rename)
+}
+
+// PutIfAbsent writes a file in the data directory, unless there already is one under the same key
+func (s *LocalBlobStore) PutIfAbsent(key string, data io.Reader, size int64) error {
+	return s.PutIfAbsentWithContext(context.Background(), key, data, size)
+}
+
+// PutIfAbsentWithContext is the same as PutIfAbsent, except that the copy is aborted as soon as
+// ctx is done. The file is hard linked to its final path, which fails if the path already exists.
+func (s *LocalBlobStore) PutIfAbsentWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.put(ctx, key, data, nil, linkNoReplace)
+}
+
+// put writes a file to the temporary directory, and then moves it to the key's path with commit
+func (s *LocalBlobStore) put(ctx context.Context, key string, data io.Reader, metadata map[string]string, commit func(tmpPath string, path string) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	datapath, err := s.path(key)
+	if err != nil {
+		return err
 	}
 
-	file, err := os.Create(datapath)
-	defer file.Close()
+	hash := sha256.New()
+	err = s.writeFile(datapath, commit, func(w io.Writer) error {
+		_, err := io.Copy(io.MultiWriter(w, hash), newContextReader(ctx, data))
+		return err
+	})
 	if err != nil {
+		return osBlobError(key, err)
+	}
+
+	err = s.writeMeta(key, &localBlobMeta{
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+		Metadata: lowerKeys(metadata),
+	})
+	return osBlobError(key, err)
+}
+
+// SetMetadata replaces the metadata recorded for a file on disk
+func (s *LocalBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
-	_, err = io.Copy(file, data)
-	return err
+	datapath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(datapath); err != nil {
+		return osBlobError(key, err)
+	}
+	meta, err := s.readMeta(key)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		meta = &localBlobMeta{}
+	}
+	meta.Metadata = lowerKeys(metadata)
+	return osBlobError(key, s.writeMeta(key, meta))
 }
 
 // Get returns an io.ReadCloser on the data living under the provided key. The retriever must
 // explicitely call the Close() method on it when he's done reading.
 func (s *LocalBlobStore) Get(key string) (data io.ReadCloser, err error) {
-	datapath := filepath.Join(s.DataDir, key)
-	return os.Open(datapath)
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext is the same as Get, except that reads on the returned io.ReadCloser fail once ctx
+// is done
+func (s *LocalBlobStore) GetWithContext(ctx context.Context, key string) (data io.ReadCloser, err error) {
+	file, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return newContextReadCloser(ctx, file), nil
+}
+
+// GetRange returns an io.ReadCloser on a part of the file living under the provided key
+func (s *LocalBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext is the same as GetRange, except that reads on the returned io.ReadCloser fail
+// once ctx is done
+func (s *LocalBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	file, err := s.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return limitReadCloser(newContextReadCloser(ctx, file), length), nil
+}
+
+func (s *LocalBlobStore) open(ctx context.Context, key string) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	datapath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(datapath)
+	if err != nil {
+		return nil, osBlobError(key, err)
+	}
+	return file, nil
 }
 
 // Delete removes the file on disk
 func (s *LocalBlobStore) Delete(key string) error {
-	datapath := filepath.Join(s.DataDir, key)
-	return os.Remove(datapath)
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext removes the file on disk, unless ctx is already done
+func (s *LocalBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	datapath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(datapath); err != nil {
+		return osBlobError(key, err)
+	}
+	if err := os.Remove(s.metaPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Copy copies a file on disk, along with its metadata
+func (s *LocalBlobStore) Copy(src string, dst string) error {
+	return s.CopyWithContext(context.Background(), src, dst)
+}
+
+// CopyWithContext is the same as Copy, except that the copy is aborted as soon as ctx is done
+func (s *LocalBlobStore) CopyWithContext(ctx context.Context, src string, dst string) error {
+	file, err := s.open(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	meta, err := s.readMeta(src)
+	if err != nil {
+		return err
+	}
+	var metadata map[string]string
+	if meta != nil {
+		metadata = meta.Metadata
+	}
+	return s.put(ctx, dst, file, metadata, os.Rename)
 }
 
 // Rename renames the file on disk
 func (s *LocalBlobStore) Rename(key string, newKey string) error {
-	datapath := filepath.Join(s.DataDir, key)
-	newDatapath := filepath.Join(s.DataDir, newKey)
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext renames the file on disk, unless ctx is already done
+func (s *LocalBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	datapath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	newDatapath, err := s.path(newKey)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(datapath); err != nil {
+		return osBlobError(key, err)
+	}
+	if err := mkdirParent(newDatapath); err != nil {
+		return osBlobError(newKey, err)
+	}
+	if err := os.Rename(datapath, newDatapath); err != nil {
+		return osBlobError(key, err)
+	}
+
+	return s.renameMeta(key, newKey)
+}
+
+// RenameIfAbsent renames the file on disk, unless there already is a file under the new key
+func (s *LocalBlobStore) RenameIfAbsent(key string, newKey string) error {
+	return s.RenameIfAbsentWithContext(context.Background(), key, newKey)
+}
+
+// RenameIfAbsentWithContext is the same as RenameIfAbsent, unless ctx is already done. The file is
+// hard linked to its new path (which fails if the path already exists) before being unlinked from
+// the old one.
+func (s *LocalBlobStore) RenameIfAbsentWithContext(ctx context.Context, key string, newKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	datapath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	newDatapath, err := s.path(newKey)
+	if err != nil {
+		return err
+	}
+
+	if fi, err := os.Lstat(datapath); err != nil {
+		return osBlobError(key, err)
+	} else if !fi.Mode().IsRegular() {
+		return newBlobError(ErrNotFound, key, &os.PathError{Op: "rename", Path: datapath, Err: os.ErrNotExist})
+	}
+	if err := mkdirParent(newDatapath); err != nil {
+		return osBlobError(newKey, err)
+	}
+	if err := os.Link(datapath, newDatapath); err != nil {
+		return osBlobError(newKey, err)
+	}
+	if err := syncDir(filepath.Dir(newDatapath)); err != nil {
+		return err
+	}
+	if err := os.Remove(datapath); err != nil {
+		return osBlobError(key, err)
+	}
+
+	return s.renameMeta(key, newKey)
+}
+
+// renameMeta moves what is recorded about a renamed blob along with it. If nothing is recorded
+// about it (it wasn't written through the LocalBlobStore), whatever was recorded about the blob it
+// replaced is removed, so that it doesn't inherit its digest and metadata.
+func (s *LocalBlobStore) renameMeta(key string, newKey string) error {
+	newMetaPath := s.metaPath(newKey)
+	if err := mkdirParent(newMetaPath); err != nil {
+		return err
+	}
+	err := os.Rename(s.metaPath(key), newMetaPath)
+	if os.IsNotExist(err) {
+		err = os.Remove(newMetaPath)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stat returns the size, modification time, SHA-256 digest and metadata of a file on disk. Files
+// that weren't written through the LocalBlobStore have no digest nor metadata.
+func (s *LocalBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext is the same as Stat, unless ctx is already done
+func (s *LocalBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	datapath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(datapath)
+	if err != nil {
+		return nil, osBlobError(key, err)
+	}
+	if fi.IsDir() {
+		return nil, newBlobError(ErrNotFound, key, &os.PathError{Op: "stat", Path: datapath, Err: os.ErrNotExist})
+	}
+
+	info := &BlobInfo{
+		Key:     key,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+	}
+	meta, err := s.readMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		info.ContentHash = "sha256:" + meta.SHA256
+		info.Metadata = meta.Metadata
+	}
+	return info, nil
+}
+
+// Exists checks whether a file exists on disk
+func (s *LocalBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext is the same as Exists, unless ctx is already done
+func (s *LocalBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	_, err := s.StatWithContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List walks the data directory and returns the files whose keys start with prefix. The returned
+// BlobInfo structures carry no digest nor metadata.
+func (s *LocalBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext is the same as List, except that the walk is aborted as soon as ctx is done
+func (s *LocalBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+
+	// Only walk the deepest directory containing all the keys with the given prefix
+	root, dirKey := s.DataDir, ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		var err error
+		if root, err = s.path(prefix[:i]); err != nil {
+			return nil, err
+		}
+		dirKey = prefix[:i+1]
+	}
+
+	if fi, err := os.Stat(root); os.IsNotExist(err) || (err == nil && !fi.IsDir()) {
+		return &BlobPage{}, nil
+	}
+
+	// One more blob than asked for tells whether there is a next page
+	lister := &localLister{ctx: ctx, prefix: prefix, pageToken: pageToken, limit: pageSize + 1}
+	if err := lister.walk(root, dirKey); err != nil && err != errLocalListDone {
+		return nil, err
+	}
+
+	page := &BlobPage{Blobs: lister.blobs}
+	if len(lister.blobs) > pageSize {
+		page.Blobs = lister.blobs[:pageSize]
+		page.NextPageToken = lister.blobs[pageSize-1].Key
+	}
+	return page, nil
+}
+
+// errLocalListDone stops a localLister's walk once it has found enough blobs
+var errLocalListDone = errors.New("[local-storage] Listing done")
+
+// localLister walks a directory tree in the lexicographical order of the keys, skipping the
+// subtrees whose keys are all before the page token or don't match the prefix, and stops as soon as
+// it found limit blobs. Listing a page therefore doesn't walk the whole tree.
+type localLister struct {
+	ctx       context.Context
+	prefix    string
+	pageToken string
+	limit     int
+	blobs     []BlobInfo
+}
+
+// walk lists the directory at path, whose entries' keys are dirKey followed by their name
+func (l *localLister) walk(path string, dirKey string) error {
+	if err := l.ctx.Err(); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	// The keys of a directory's blobs are its own key followed by a slash, which has to be taken into
+	// account when sorting ("a.b" comes before "a/b")
+	sortKey := func(fi os.FileInfo) string {
+		if fi.IsDir() {
+			return fi.Name() + "/"
+		}
+		return fi.Name()
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortKey(entries[i]) < sortKey(entries[j]) })
+
+	for _, fi := range entries {
+		key := dirKey + fi.Name()
+		if fi.IsDir() {
+			subtree := key + "/"
+			if key == localInternalDir || !l.overlaps(subtree) {
+				continue
+			}
+			if err := l.walk(filepath.Join(path, fi.Name()), subtree); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(key, l.prefix) || key <= l.pageToken {
+			continue
+		}
+		l.blobs = append(l.blobs, BlobInfo{Key: key, Size: fi.Size(), ModTime: fi.ModTime()})
+		if len(l.blobs) >= l.limit {
+			return errLocalListDone
+		}
+	}
+	return nil
+}
+
+// overlaps tells whether a subtree, whose keys all start with the given string, may hold keys
+// matching the prefix and coming after the page token
+func (l *localLister) overlaps(subtree string) bool {
+	if !strings.HasPrefix(subtree, l.prefix) && !strings.HasPrefix(l.prefix, subtree) {
+		return false
+	}
+	// If the page token doesn't start with subtree, either all of its keys are before the token or
+	// all of them are after it
+	return subtree > l.pageToken || strings.HasPrefix(l.pageToken, subtree)
+}
+
+// AbortIncompleteUploads removes the temporary files that were created more than olderThan ago
+// and never moved to their final path (by a crashed process for instance)
+func (s *LocalBlobStore) AbortIncompleteUploads(ctx context.Context, olderThan time.Duration) error {
+	tmpDir := filepath.Join(s.DataDir, localTmpDir)
+	files, err := ioutil.ReadDir(tmpDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() && time.Since(fi.ModTime()) >= olderThan {
+			if err := os.Remove(filepath.Join(tmpDir, fi.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// SignedURL returns a URL granting method on a blob for ttl, issued by the store's Signer
+func (s *LocalBlobStore) SignedURL(key string, method string, ttl time.Duration) (string, error) {
+	if s.Signer == nil {
+		return "", errors.New("[local-storage] No URL signer configured")
+	}
+	if err := validateLocalKey(key); err != nil {
+		return "", err
+	}
+	return s.Signer.Sign(key, method, ttl)
+}
+
+// path validates a key and returns the path of the corresponding file
+func (s *LocalBlobStore) path(key string) (string, error) {
+	if err := validateLocalKey(key); err != nil {
+		return "", err
+	}
+	datapath := filepath.Join(s.DataDir, filepath.FromSlash(key))
+	if err := s.checkSymlinks(key, datapath); err != nil {
+		return "", err
+	}
+	return datapath, nil
+}
+
+func validateLocalKey(key string) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	if key == localInternalDir || strings.HasPrefix(key, localInternalDir+"/") {
+		return &InvalidKeyError{Key: key, Reason: "reserved path"}
+	}
+	return nil
+}
 
-	return os.Rename(datapath, newDatapath)
+// checkSymlinks makes sure that datapath (or its deepest existing parent directory) doesn't resolve
+// to a path outside of the data directory
+func (s *LocalBlobStore) checkSymlinks(key string, datapath string) error {
+	root, err := filepath.EvalSymlinks(s.DataDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	path := datapath
+	resolved, err := filepath.EvalSymlinks(path)
+	for os.IsNotExist(err) && path != filepath.Clean(s.DataDir) {
+		path = filepath.Dir(path)
+		resolved, err = filepath.EvalSymlinks(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return &InvalidKeyError{Key: key, Reason: "symbolic link pointing outside of the data directory"}
+	}
+	return nil
+}
+
+// writeAtomically writes a file to the store's temporary directory using write, syncs it to disk
+// and then moves it to path
+func (s *LocalBlobStore) writeAtomically(path string, write func(w io.Writer) error) error {
+	return s.writeFile(path, os.Rename, write)
+}
+
+// writeFile is the same as writeAtomically, except that the file is moved to path by commit
+func (s *LocalBlobStore) writeFile(path string, commit func(tmpPath string, path string) error, write func(w io.Writer) error) (err error) {
+	tmpDir := filepath.Join(s.DataDir, localTmpDir)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+	if err := mkdirParent(path); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(tmpDir, "put-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	if err = write(file); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(file.Name(), 0644); err != nil {
+		return err
+	}
+	if err = commit(file.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// linkNoReplace moves a file to path, unless path already exists
+func linkNoReplace(tmpPath string, path string) error {
+	if err := os.Link(tmpPath, path); err != nil {
+		return err
+	}
+	return os.Remove(tmpPath)
+}
+
+// syncDir flushes a directory entry to disk, so that a rename in it survives a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *LocalBlobStore) metaPath(key string) string {
+	return filepath.Join(s.DataDir, localMetaDir, filepath.FromSlash(key)+".json")
+}
+
+func (s *LocalBlobStore) writeMeta(key string, meta *localBlobMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return s.writeAtomically(s.metaPath(key), func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+}
+
+// readMeta returns the recorded metadata of a blob, or nil if there is none
+func (s *LocalBlobStore) readMeta(key string) (*localBlobMeta, error) {
+	content, err := ioutil.ReadFile(s.metaPath(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := &localBlobMeta{}
+	if err := json.Unmarshal(content, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// mkdirParent creates the parent directory of path, if it doesn't exist yet
+func mkdirParent(path string) error {
+	parent := filepath.Dir(path)
+	_, err := os.Stat(parent)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(parent, 0755)
+	}
+	return err
 }
@@ -0,0 +1,230 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func newTestLocalBlobStore(t *testing.T) (*LocalBlobStore, func()) {
+	dir, err := ioutil.TempDir("", "blobstore")
+	require.NoError(t, err)
+	return &LocalBlobStore{DataDir: filepath.Join(dir, "data")}, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalBlobStoreRoundTrip(t *testing.T) {
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	require.NoError(t, store.PutWithMetadata(ctx, "a/b/blob", strings.NewReader("content"), 7, map[string]string{"Owner": "me"}))
+	data, err := readBlob(t, store, "a/b/blob")
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	info, err := store.Stat("a/b/blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+	assert.Equal(t, "sha256:ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73", info.ContentHash)
+	assert.Equal(t, map[string]string{"owner": "me"}, info.Metadata)
+
+	rc, err := store.GetRange("a/b/blob", 2, 3)
+	require.NoError(t, err)
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "nte", string(data))
+
+	exists, err := store.Exists("a/b")
+	require.NoError(t, err)
+	assert.False(t, exists, "directories aren't blobs")
+
+	require.NoError(t, store.Delete("a/b/blob"))
+	exists, err = store.Exists("a/b/blob")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	_, err = os.Stat(store.metaPath("a/b/blob"))
+	assert.True(t, os.IsNotExist(err), "the metadata of deleted blobs is removed")
+
+	// Nothing is left behind in the temporary directory
+	entries, err := ioutil.ReadDir(filepath.Join(store.DataDir, localTmpDir))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestLocalBlobStoreCancelledPut(t *testing.T) {
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := store.PutWithContext(ctx, "blob", strings.NewReader("content"), 7)
+	assert.Equal(t, context.Canceled, err)
+	exists, err := store.Exists("blob")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestLocalBlobStoreListPages(t *testing.T) {
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+
+	keys := []string{"a.b", "a/b", "a/c/d", "a/c/e", "a0", "b/a", "ba"}
+	for _, key := range []string{"ba", "a/c/e", "a0", "a/b", "b/a", "a.b", "a/c/d"} {
+		require.NoError(t, store.Put(key, strings.NewReader(key), int64(len(key))))
+	}
+
+	for _, pageSize := range []int{1, 2, 3, 100} {
+		var listed []string
+		pageToken := ""
+		for pages := 0; ; pages++ {
+			require.True(t, pages <= len(keys), "page size %d: too many pages", pageSize)
+			page, err := store.List("", pageToken, pageSize)
+			require.NoError(t, err)
+			assert.True(t, len(page.Blobs) <= pageSize)
+			for _, blob := range page.Blobs {
+				listed = append(listed, blob.Key)
+				assert.Equal(t, int64(len(blob.Key)), blob.Size)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			pageToken = page.NextPageToken
+		}
+		assert.Equal(t, keys, listed, "page size %d", pageSize)
+	}
+
+	for prefix, expected := range map[string][]string{
+		"a/":   {"a/b", "a/c/d", "a/c/e"},
+		"a/c":  {"a/c/d", "a/c/e"},
+		"b":    {"b/a", "ba"},
+		"a.":   {"a.b"},
+		"none": nil,
+		"x/y/": nil,
+	} {
+		page, err := store.List(prefix, "", 0)
+		require.NoError(t, err)
+		var listed []string
+		for _, blob := range page.Blobs {
+			listed = append(listed, blob.Key)
+		}
+		assert.Equal(t, expected, listed, "prefix %s", prefix)
+	}
+}
+
+func TestLocalBlobStoreRename(t *testing.T) {
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	require.NoError(t, store.PutWithMetadata(ctx, "src", strings.NewReader("source"), 6, map[string]string{"name": "src"}))
+	require.NoError(t, store.PutWithMetadata(ctx, "dst/blob", strings.NewReader("destination"), 11, map[string]string{"name": "dst"}))
+	require.NoError(t, store.Rename("src", "dst/blob"))
+	data, err := readBlob(t, store, "dst/blob")
+	require.NoError(t, err)
+	assert.Equal(t, "source", string(data))
+	info, err := store.Stat("dst/blob")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"name": "src"}, info.Metadata)
+	exists, err := store.Exists("src")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	// A blob that wasn't written through the store doesn't inherit what was recorded about the blob
+	// it replaces
+	require.NoError(t, ioutil.WriteFile(filepath.Join(store.DataDir, "foreign"), []byte("foreign"), 0644))
+	require.NoError(t, store.Rename("foreign", "dst/blob"))
+	info, err = store.Stat("dst/blob")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), info.Size)
+	assert.Empty(t, info.ContentHash)
+	assert.Empty(t, info.Metadata)
+
+	err = store.Rename("missing", "dst/blob")
+	assert.True(t, errors.Is(err, ErrNotFound), "%v", err)
+
+	require.NoError(t, store.Put("other", strings.NewReader("other"), 5))
+	err = store.RenameIfAbsent("other", "dst/blob")
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "%v", err)
+	require.NoError(t, store.RenameIfAbsent("other", "new"))
+	info, err = store.Stat("new")
+	require.NoError(t, err)
+	assert.Equal(t, "sha256:d9298a10d1b0735837dc4bd85dac641b0f3cef27a47e5d53a54f2f3f5b2fcffa", info.ContentHash)
+}
+
+func TestLocalBlobStoreRejectsEscapingKeys(t *testing.T) {
+	store, cleanup := newTestLocalBlobStore(t)
+	defer cleanup()
+	require.NoError(t, store.Put("blob", strings.NewReader("content"), 7))
+
+	outside := filepath.Join(filepath.Dir(store.DataDir), "outside")
+	require.NoError(t, os.Mkdir(outside, 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(store.DataDir, "link")))
+
+	for _, key := range []string{
+		"",
+		"../blob",
+		"a/../../blob",
+		"/etc/passwd",
+		"a//b",
+		"./blob",
+		"a\\b",
+		".blobstore/meta/blob.json",
+		"link/blob",
+	} {
+		err := store.Put(key, strings.NewReader("evil"), 4)
+		assert.True(t, errors.Is(err, ErrInvalidKey), "put %q: %v", key, err)
+		_, err = store.Get(key)
+		assert.True(t, errors.Is(err, ErrInvalidKey), "get %q: %v", key, err)
+		err = store.Rename("blob", key)
+		assert.True(t, errors.Is(err, ErrInvalidKey), "rename to %q: %v", key, err)
+	}
+
+	entries, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	_, err = store.List("link/", "", 0)
+	assert.True(t, errors.Is(err, ErrInvalidKey), "%v", err)
+}
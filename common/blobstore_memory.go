@@ -0,0 +1,402 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MemoryBlobStore is a BlobStore keeping blobs in memory. It is meant for tests and for
+// short-lived processes that don't need their blobs to outlive them.
+type MemoryBlobStore struct {
+	mutex      sync.RWMutex
+	blobs      map[string]*memoryBlob
+	generation int64
+}
+
+type memoryBlob struct {
+	data       []byte
+	modTime    time.Time
+	sha256     string
+	metadata   map[string]string
+	generation int64
+}
+
+// NewMemoryBlobStore creates a new, empty, MemoryBlobStore
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{blobs: map[string]*memoryBlob{}}
+}
+
+// Put stores a blob in memory
+func (s *MemoryBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext stores a blob in memory
+func (s *MemoryBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, data, size, nil)
+}
+
+// PutWithMetadata stores a blob and its metadata in memory
+func (s *MemoryBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	return s.put(ctx, key, data, metadata, false)
+}
+
+// PutIfAbsent stores a blob in memory, unless there already is one under the same key
+func (s *MemoryBlobStore) PutIfAbsent(key string, data io.Reader, size int64) error {
+	return s.PutIfAbsentWithContext(context.Background(), key, data, size)
+}
+
+// PutIfAbsentWithContext stores a blob in memory, unless there already is one under the same key
+func (s *MemoryBlobStore) PutIfAbsentWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.put(ctx, key, data, nil, true)
+}
+
+func (s *MemoryBlobStore) put(ctx context.Context, key string, data io.Reader, metadata map[string]string, ifAbsent bool) error {
+	if err := validateBlobKey(key); err != nil {
+		return err
+	}
+	content, err := ioutil.ReadAll(newContextReader(ctx, data))
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(content)
+	blob := &memoryBlob{
+		data:     content,
+		modTime:  time.Now(),
+		sha256:   hex.EncodeToString(sum[:]),
+		metadata: lowerKeys(metadata),
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.blobs[key]; ok && ifAbsent {
+		return memoryAlreadyExists("put", key)
+	}
+	s.store(key, blob)
+	return nil
+}
+
+// SetMetadata replaces the metadata of a blob
+func (s *MemoryBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return memoryNotFound("setmetadata", key)
+	}
+	updated := *blob
+	updated.metadata = lowerKeys(metadata)
+	s.store(key, &updated)
+	return nil
+}
+
+// Get returns a reader on a blob
+func (s *MemoryBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext returns a reader on a blob
+func (s *MemoryBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(ctx, key, 0, -1)
+}
+
+// GetRange returns a reader on a part of a blob
+func (s *MemoryBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext returns a reader on a part of a blob
+func (s *MemoryBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	blob, err := s.blob("open", key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Blobs are never modified in place, so their data can be shared with readers
+	data := blob.data
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return ioutil.NopCloser(newContextReader(ctx, bytes.NewReader(data))), nil
+}
+
+// Delete deletes a blob
+func (s *MemoryBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a blob
+func (s *MemoryBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.blobs[key]; !ok {
+		return memoryNotFound("remove", key)
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// DeleteIfUnchanged deletes a blob, unless it has been modified since version was returned by Stat or
+// List
+func (s *MemoryBlobStore) DeleteIfUnchanged(ctx context.Context, key string, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return memoryNotFound("remove", key)
+	}
+	if strconv.FormatInt(blob.generation, 10) != version {
+		return newBlobError(ErrModified, key, fmt.Errorf("[memory-storage] Blob %s isn't version %s anymore", key, version))
+	}
+	delete(s.blobs, key)
+	return nil
+}
+
+// Copy copies a blob and its metadata
+func (s *MemoryBlobStore) Copy(src string, dst string) error {
+	return s.CopyWithContext(context.Background(), src, dst)
+}
+
+// CopyWithContext copies a blob and its metadata
+func (s *MemoryBlobStore) CopyWithContext(ctx context.Context, src string, dst string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validateBlobKey(dst); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blob, ok := s.blobs[src]
+	if !ok {
+		return memoryNotFound("copy", src)
+	}
+	copied := *blob
+	copied.modTime = time.Now()
+	s.store(dst, &copied)
+	return nil
+}
+
+// Rename renames a blob
+func (s *MemoryBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext renames a blob
+func (s *MemoryBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validateBlobKey(newKey); err != nil {
+		return err
+	}
+	return s.rename(key, newKey, false)
+}
+
+// RenameIfAbsent renames a blob, unless there already is a blob under the new key
+func (s *MemoryBlobStore) RenameIfAbsent(key string, newKey string) error {
+	return s.RenameIfAbsentWithContext(context.Background(), key, newKey)
+}
+
+// RenameIfAbsentWithContext renames a blob, unless there already is a blob under the new key
+func (s *MemoryBlobStore) RenameIfAbsentWithContext(ctx context.Context, key string, newKey string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := validateBlobKey(newKey); err != nil {
+		return err
+	}
+	return s.rename(key, newKey, true)
+}
+
+func (s *MemoryBlobStore) rename(key string, newKey string, ifAbsent bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return memoryNotFound("rename", key)
+	}
+	if _, ok := s.blobs[newKey]; ok && ifAbsent {
+		return memoryAlreadyExists("rename", newKey)
+	}
+	delete(s.blobs, key)
+	s.blobs[newKey] = blob
+	return nil
+}
+
+// Stat returns information on a blob
+func (s *MemoryBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on a blob
+func (s *MemoryBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	blob, err := s.blob("stat", key)
+	if err != nil {
+		return nil, err
+	}
+	info := blob.info(key)
+	return &info, nil
+}
+
+// Exists checks whether a blob exists
+func (s *MemoryBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether a blob exists
+func (s *MemoryBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.blobs[key]
+	return ok, nil
+}
+
+// List returns the blobs whose keys start with prefix
+func (s *MemoryBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext returns the blobs whose keys start with prefix
+func (s *MemoryBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+
+	s.mutex.RLock()
+	var blobs []BlobInfo
+	for key, blob := range s.blobs {
+		if strings.HasPrefix(key, prefix) && key > pageToken {
+			blobs = append(blobs, blob.info(key))
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Key < blobs[j].Key })
+	page := &BlobPage{Blobs: blobs}
+	if len(blobs) > pageSize {
+		page.Blobs = blobs[:pageSize]
+		page.NextPageToken = blobs[pageSize-1].Key
+	}
+	return page, nil
+}
+
+// store stores a blob under a key, giving it a new generation. It must be called with the mutex
+// held.
+func (s *MemoryBlobStore) store(key string, blob *memoryBlob) {
+	s.generation++
+	blob.generation = s.generation
+	s.blobs[key] = blob
+}
+
+func (s *MemoryBlobStore) blob(op string, key string) (*memoryBlob, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	blob, ok := s.blobs[key]
+	if !ok {
+		return nil, memoryNotFound(op, key)
+	}
+	return blob, nil
+}
+
+func (b *memoryBlob) info(key string) BlobInfo {
+	info := BlobInfo{
+		Key:         key,
+		Size:        int64(len(b.data)),
+		ModTime:     b.modTime,
+		ContentHash: "sha256:" + b.sha256,
+		Version:     strconv.FormatInt(b.generation, 10),
+	}
+	if b.metadata != nil {
+		info.Metadata = make(map[string]string, len(b.metadata))
+		for k, v := range b.metadata {
+			info.Metadata[k] = v
+		}
+	}
+	return info
+}
+
+// memoryAlreadyExists mimics the errors returned by the LocalBlobStore for conditional writes
+func memoryAlreadyExists(op string, key string) error {
+	return newBlobError(ErrAlreadyExists, key, &os.PathError{Op: op, Path: key, Err: os.ErrExist})
+}
+
+// memoryNotFound mimics the errors returned by the LocalBlobStore for missing blobs
+func memoryNotFound(op string, key string) error {
+	return newBlobError(ErrNotFound, key, &os.PathError{Op: op, Path: key, Err: os.ErrNotExist})
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// MetricsBlobStore counts the calls made to a BlobStore, their errors, their duration and the
+// number of bytes transferred, per operation
+type MetricsBlobStore struct {
+	ContextBlobStore
+
+	store BlobStore
+	mutex sync.Mutex
+	stats map[string]*OperationStats
+}
+
+// OperationStats holds the statistics of one kind of BlobStore operation. The duration of a Get
+// only covers the opening of the blob, not the time spent reading it.
+type OperationStats struct {
+	Calls    int64
+	Errors   int64
+	Bytes    int64
+	Duration time.Duration
+}
+
+// NewMetricsBlobStore creates a new MetricsBlobStore around store
+func NewMetricsBlobStore(store BlobStore) *MetricsBlobStore {
+	return &MetricsBlobStore{
+		ContextBlobStore: AsContextBlobStore(store),
+		store:            store,
+		stats:            map[string]*OperationStats{},
+	}
+}
+
+// Stats returns a snapshot of the statistics of every operation called so far, by operation name
+// ("put", "get", "delete"...)
+func (s *MetricsBlobStore) Stats() map[string]OperationStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make(map[string]OperationStats, len(s.stats))
+	for op, opStats := range s.stats {
+		stats[op] = *opStats
+	}
+	return stats
+}
+
+// Publish exposes the statistics as an expvar variable (served as JSON on /debug/vars by
+// net/http). It fails if the name is already taken.
+func (s *MetricsBlobStore) Publish(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("[metrics] Error publishing blob store metrics: expvar %s already exists", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} { return s.Stats() }))
+	return nil
+}
+
+func (s *MetricsBlobStore) record(op string, start time.Time, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, ok := s.stats[op]
+	if !ok {
+		stats = &OperationStats{}
+		s.stats[op] = stats
+	}
+	stats.Calls++
+	stats.Duration += time.Since(start)
+	if err != nil {
+		stats.Errors++
+	}
+}
+
+func (s *MetricsBlobStore) addBytes(op string, n int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if stats, ok := s.stats[op]; ok {
+		stats.Bytes += n
+	}
+}
+
+// Put uploads a blob, counting the bytes read from data
+func (s *MetricsBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext uploads a blob, counting the bytes read from data
+func (s *MetricsBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	start := time.Now()
+	counter := &countingReader{r: data}
+	err := s.ContextBlobStore.PutWithContext(ctx, key, counter, size)
+	s.record("put", start, err)
+	s.addBytes("put", counter.n)
+	return err
+}
+
+// Get downloads a blob, counting the bytes read from the returned reader
+func (s *MetricsBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext downloads a blob, counting the bytes read from the returned reader
+func (s *MetricsBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := s.ContextBlobStore.GetWithContext(ctx, key)
+	s.record("get", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return s.countReads("get", rc), nil
+}
+
+// GetRange downloads a part of a blob, counting the bytes read from the returned reader
+func (s *MetricsBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext downloads a part of a blob, counting the bytes read from the returned reader
+func (s *MetricsBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := GetBlobRange(ctx, s.store, key, offset, length)
+	s.record("get_range", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return s.countReads("get_range", rc), nil
+}
+
+// Delete deletes a blob
+func (s *MetricsBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a blob
+func (s *MetricsBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.ContextBlobStore.DeleteWithContext(ctx, key)
+	s.record("delete", start, err)
+	return err
+}
+
+// Rename renames a blob
+func (s *MetricsBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext renames a blob
+func (s *MetricsBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	start := time.Now()
+	err := s.ContextBlobStore.RenameWithContext(ctx, key, newKey)
+	s.record("rename", start, err)
+	return err
+}
+
+// Stat returns information on a blob
+func (s *MetricsBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on a blob
+func (s *MetricsBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	start := time.Now()
+	info, err := s.ContextBlobStore.StatWithContext(ctx, key)
+	s.record("stat", start, err)
+	return info, err
+}
+
+// Exists checks whether a blob exists
+func (s *MetricsBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether a blob exists
+func (s *MetricsBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	exists, err := s.ContextBlobStore.ExistsWithContext(ctx, key)
+	s.record("exists", start, err)
+	return exists, err
+}
+
+// List lists blobs
+func (s *MetricsBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext lists blobs
+func (s *MetricsBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	start := time.Now()
+	page, err := s.ContextBlobStore.ListWithContext(ctx, prefix, pageToken, pageSize)
+	s.record("list", start, err)
+	return page, err
+}
+
+func (s *MetricsBlobStore) countReads(op string, rc io.ReadCloser) io.ReadCloser {
+	return &readCloser{
+		Reader: &countingReader{r: rc, onRead: func(n int) { s.addBytes(op, int64(n)) }},
+		Closer: rc,
+	}
+}
+
+// countingReader counts the bytes read through it, optionally reporting each read
+type countingReader struct {
+	r      io.Reader
+	n      int64
+	onRead func(n int)
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if r.onRead != nil && n > 0 {
+		r.onRead(n)
+	}
+	return n, err
+}
@@ -40,7 +40,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"strings"
+	"path"
+
+	"golang.org/x/net/context"
 )
 
 // This little perverts make Put and Get calls fail
@@ -49,7 +51,11 @@ const (
 	ViciousDevilUUID = "2cd41d08-ef54-4a15-95a1-2e84ca72a22c"
 )
 
-// MOCKBlobStore is a BlobStore implementations for tests
+const fakeFileContent = "fakeFileContent"
+
+// MOCKBlobStore is a BlobStore implementations for tests. It discards writes and serves the same
+// fake content for every key: tests needing data to round-trip should use a MemoryBlobStore
+// instead (wrapped in a FaultyBlobStore to test error paths).
 type MOCKBlobStore struct {
 }
 
@@ -64,32 +70,130 @@ func NewMOCKBlobStore(dataDir string) (BlobStore, error) {
 // Put writes a file in the data directory (and creates necessarry sub-directories if there are
 // forward slashes in the key name)
 func (s *MOCKBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext is the same as Put, but fails if ctx is done
+func (s *MOCKBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, data, size, nil)
+}
+
+// PutWithMetadata is the same as Put, the metadata being discarded
+func (s *MOCKBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if size == NaughtySize {
 		return fmt.Errorf("[fake-blobstore] What a naughty size")
 	}
 	return nil
 }
 
+// SetMetadata discards the metadata
+func (s *MOCKBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	return ctx.Err()
+}
+
 // Get returns an io.ReadCloser on the data living under the provided key. The retriever must
 // explicitely call the Close() method on it when he's done reading.
 func (s *MOCKBlobStore) Get(key string) (data io.ReadCloser, err error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext is the same as Get, but fails if ctx is done
+func (s *MOCKBlobStore) GetWithContext(ctx context.Context, key string) (data io.ReadCloser, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	// Check if uuid (end of key) is the ViciousDevilUUID
-	if strings.SplitAfter(key, "/")[1] == ViciousDevilUUID {
+	if path.Base(key) == ViciousDevilUUID {
 		return nil, fmt.Errorf("[fake-blobstore] Runnin' With the Devil")
 	}
 	return fakeFile(), nil
 }
 
+// GetRange returns a part of the fake file
+func (s *MOCKBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext is the same as GetRange, but fails if ctx is done
+func (s *MOCKBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	rc, err := s.GetWithContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, rc, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return limitReadCloser(rc, length), nil
+}
+
 // Delete remove the file
 func (s *MOCKBlobStore) Delete(key string) (err error) {
-	return nil
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext is the same as Delete, but fails if ctx is done
+func (s *MOCKBlobStore) DeleteWithContext(ctx context.Context, key string) (err error) {
+	return ctx.Err()
 }
 
 // Rename renames the file
 func (s *MOCKBlobStore) Rename(key string, newKey string) (err error) {
-	return nil
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext is the same as Rename, but fails if ctx is done
+func (s *MOCKBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) (err error) {
+	return ctx.Err()
+}
+
+// Stat returns fake information on the fake file
+func (s *MOCKBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext is the same as Stat, but fails if ctx is done
+func (s *MOCKBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &BlobInfo{
+		Key:  key,
+		Size: int64(len(fakeFileContent)),
+	}, nil
+}
+
+// Exists always returns true
+func (s *MOCKBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext is the same as Exists, but fails if ctx is done
+func (s *MOCKBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// List returns an empty page
+func (s *MOCKBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext is the same as List, but fails if ctx is done
+func (s *MOCKBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &BlobPage{}, nil
 }
 
 func fakeFile() io.ReadCloser {
-	return ioutil.NopCloser(bytes.NewBuffer([]byte("fakeFileContent")))
+	return ioutil.NopCloser(bytes.NewBufferString(fakeFileContent))
 }
@@ -0,0 +1,605 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/net/context"
+)
+
+// Prefixes of the keys under which ReplicatedBlobStore keeps its own blobs on its replicas:
+//   - the blobs that were deleted (tombstones holding the deletion time), that Repair relies on not
+//     to bring back blobs whose deletion some replicas missed,
+//   - the blobs being written, that are only moved to their key once the write quorum is reached.
+const (
+	replicaInternalPrefix  = ".replicated/"
+	replicaTombstonePrefix = replicaInternalPrefix + "tombstones/"
+	replicaStagingPrefix   = replicaInternalPrefix + "staging/"
+)
+
+// ReplicatedBlobStore mirrors blobs over several underlying stores (its replicas). Writes are sent
+// to all of them in parallel and succeed as long as WriteQuorum replicas succeed. Reads are served
+// by the first replica (in the order they were given) that answers without error.
+//
+// Replicas that missed a write or a deletion (or were added later on) can be brought up to date with
+// Repair. Deletions (and renames) are recorded as tombstones on the replicas, under
+// replicaTombstonePrefix. Blobs are written under replicaStagingPrefix first, and only renamed to
+// their key once the write quorum is reached, so that failed writes don't overwrite the previous
+// version of a blob. Both prefixes are hidden from listings.
+type ReplicatedBlobStore struct {
+	replicas    []ContextBlobStore
+	WriteQuorum int
+}
+
+// ReplicaRepairReport sums up what ReplicatedBlobStore.Repair did
+type ReplicaRepairReport struct {
+	Checked int
+	Copied  int
+
+	// Deleted is the number of blobs deleted from replicas that missed their deletion
+	Deleted int
+
+	// Conflicts lists the keys whose content differs between replicas (different sizes, or different
+	// content hashes of the same kind), or whose deletion time can't be compared with the
+	// modification time of their blobs. They are left untouched.
+	Conflicts []string
+
+	// Errors holds the errors that prevented keys from being copied to some replicas
+	Errors []error
+}
+
+// NewReplicatedBlobStore creates a ReplicatedBlobStore over the given replicas
+func NewReplicatedBlobStore(writeQuorum int, replicas ...BlobStore) (*ReplicatedBlobStore, error) {
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("[replicated-storage] No replica provided")
+	}
+	if writeQuorum < 1 || writeQuorum > len(replicas) {
+		return nil, fmt.Errorf("[replicated-storage] Invalid write quorum %d for %d replicas", writeQuorum, len(replicas))
+	}
+	s := &ReplicatedBlobStore{WriteQuorum: writeQuorum}
+	for _, replica := range replicas {
+		s.replicas = append(s.replicas, AsContextBlobStore(replica))
+	}
+	return s, nil
+}
+
+// Put writes a blob to all the replicas
+func (s *ReplicatedBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext streams a blob to all the replicas in parallel, under a staging key, and renames it
+// to its key once the write quorum is reached. Slower replicas slow the others down, since the data
+// is only read once. Replicas that fail are dropped along the way.
+func (s *ReplicatedBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	if strings.HasPrefix(key, replicaInternalPrefix) {
+		return &InvalidKeyError{Key: key, Reason: "reserved for replication"}
+	}
+	stagingKey := replicaStagingPrefix + uuid.NewV4().String()
+	writers := make([]*io.PipeWriter, len(s.replicas))
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range s.replicas {
+		pr, pw := io.Pipe()
+		writers[i] = pw
+		wg.Add(1)
+		go func(i int, replica ContextBlobStore) {
+			defer wg.Done()
+			errs[i] = replica.PutWithContext(ctx, stagingKey, pr, size)
+			// Unblock the writer if the replica gave up before reading everything
+			if errs[i] != nil {
+				pr.CloseWithError(errs[i])
+			} else {
+				pr.Close()
+			}
+		}(i, replica)
+	}
+
+	readErr := fanOut(data, writers)
+	for _, pw := range writers {
+		pw.CloseWithError(readErr)
+	}
+	wg.Wait()
+
+	// The staged blob is on the replicas without error
+	staged := make([]bool, len(errs))
+	count := 0
+	for i, err := range errs {
+		staged[i] = err == nil
+		if staged[i] {
+			count++
+		}
+	}
+	if readErr != nil {
+		s.discard(stagingKey, staged)
+		return fmt.Errorf("[replicated-storage] Error reading blob %s: %s", key, readErr)
+	}
+	if count < s.WriteQuorum {
+		s.discard(stagingKey, staged)
+		return s.checkQuorum("writing", key, errs)
+	}
+
+	// Replicas that fail to move the blob to its key keep its previous version
+	for i, replica := range s.replicas {
+		if !staged[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, replica ContextBlobStore) {
+			defer wg.Done()
+			if errs[i] = replica.RenameWithContext(ctx, stagingKey, key); errs[i] == nil {
+				staged[i] = false
+			}
+		}(i, replica)
+	}
+	wg.Wait()
+	s.discard(stagingKey, staged)
+	if err := s.checkQuorum("writing", key, errs); err != nil {
+		return err
+	}
+
+	// The blob may have been deleted before: its tombstones are outdated
+	s.onAll(func(replica ContextBlobStore) error {
+		return deleteIfExists(ctx, replica, replicaTombstonePrefix+key)
+	})
+	return nil
+}
+
+// discard deletes a staged blob from the replicas it is still on. Failures are only logged: staged
+// blobs are hidden from listings.
+func (s *ReplicatedBlobStore) discard(stagingKey string, staged []bool) {
+	// The context of the Put may be the reason why it failed, let's not use it to clean things up
+	ctx := context.Background()
+	for i, ok := range staged {
+		if !ok {
+			continue
+		}
+		if err := deleteIfExists(ctx, s.replicas[i], stagingKey); err != nil {
+			log.Printf("[replicated-storage] Error deleting staged blob %s from replica %d: %s", stagingKey, i, err)
+		}
+	}
+}
+
+// bury records the deletion of a blob on all the replicas. It only fails if no replica recorded it:
+// Repair just needs to find it on one of them.
+func (s *ReplicatedBlobStore) bury(ctx context.Context, key string) error {
+	tombstone := time.Now().UTC().Format(time.RFC3339Nano)
+	errs := s.onAll(func(replica ContextBlobStore) error {
+		return replica.PutWithContext(ctx, replicaTombstonePrefix+key, strings.NewReader(tombstone), int64(len(tombstone)))
+	})
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("replica %d: %s", i, err))
+		}
+	}
+	if len(failures) == len(errs) {
+		err := fmt.Errorf("[replicated-storage] Error recording deletion of %s: %s", key, strings.Join(failures, "; "))
+		return newBlobError(commonErrorKind(errs), key, err)
+	}
+	if len(failures) > 0 {
+		log.Printf("[replicated-storage] Error recording deletion of %s on some replicas: %s", key, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// deleteIfExists deletes a blob, not failing if it doesn't exist
+func deleteIfExists(ctx context.Context, store ContextBlobStore, key string) error {
+	err := store.DeleteWithContext(ctx, key)
+	if err != nil {
+		if exists, existsErr := store.ExistsWithContext(ctx, key); existsErr == nil && !exists {
+			return nil
+		}
+	}
+	return err
+}
+
+// fanOut copies r to all the writers, dropping the ones returning errors. Only read errors are
+// returned.
+func fanOut(r io.Reader, writers []*io.PipeWriter) error {
+	alive := make([]bool, len(writers))
+	for i := range alive {
+		alive[i] = true
+	}
+
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			anyAlive := false
+			for i, w := range writers {
+				if alive[i] {
+					if _, werr := w.Write(buf[:n]); werr != nil {
+						alive[i] = false
+					}
+					anyAlive = anyAlive || alive[i]
+				}
+			}
+			if !anyAlive {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Get reads a blob from the first replica that has it
+func (s *ReplicatedBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext reads a blob from the first replica that has it
+func (s *ReplicatedBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	var data io.ReadCloser
+	err := s.firstHealthy(ctx, key, func(replica ContextBlobStore) (err error) {
+		data, err = replica.GetWithContext(ctx, key)
+		return err
+	})
+	return data, err
+}
+
+// Delete deletes a blob from all the replicas
+func (s *ReplicatedBlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a blob from all the replicas, after recording its deletion so that
+// Repair deletes it from the replicas that miss it. Replicas that don't have the blob count as
+// successes.
+func (s *ReplicatedBlobStore) DeleteWithContext(ctx context.Context, key string) error {
+	if err := s.bury(ctx, key); err != nil {
+		return err
+	}
+	errs := s.onAll(func(replica ContextBlobStore) error {
+		return deleteIfExists(ctx, replica, key)
+	})
+	return s.checkQuorum("deleting", key, errs)
+}
+
+// Rename renames a blob on all the replicas
+func (s *ReplicatedBlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext renames a blob on all the replicas, recording the deletion of the old key
+func (s *ReplicatedBlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if strings.HasPrefix(newKey, replicaInternalPrefix) {
+		return &InvalidKeyError{Key: newKey, Reason: "reserved for replication"}
+	}
+	if err := s.bury(ctx, key); err != nil {
+		return err
+	}
+	errs := s.onAll(func(replica ContextBlobStore) error {
+		err := replica.RenameWithContext(ctx, key, newKey)
+		if err == nil {
+			err = deleteIfExists(ctx, replica, replicaTombstonePrefix+newKey)
+		}
+		return err
+	})
+	return s.checkQuorum("renaming", key, errs)
+}
+
+// Stat returns information on a blob from the first replica that has it
+func (s *ReplicatedBlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on a blob from the first replica that has it
+func (s *ReplicatedBlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	var info *BlobInfo
+	err := s.firstHealthy(ctx, key, func(replica ContextBlobStore) (err error) {
+		info, err = replica.StatWithContext(ctx, key)
+		return err
+	})
+	return info, err
+}
+
+// Exists checks whether any replica has a blob
+func (s *ReplicatedBlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether any replica has a blob
+func (s *ReplicatedBlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	var lastErr error
+	for _, replica := range s.replicas {
+		exists, err := replica.ExistsWithContext(ctx, key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if exists {
+			return true, nil
+		}
+	}
+	// A replica that failed to answer may have the blob
+	return false, lastErr
+}
+
+// List lists the blobs of the first replica that answers
+func (s *ReplicatedBlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext lists the blobs of the first replica that answers. Page tokens being specific to
+// each replica, a listing should only be carried on as long as the same replica answers: Repair
+// should be used to make sure that all replicas have the same content. Tombstones and staged blobs
+// are filtered out, so pages may hold fewer than pageSize blobs.
+func (s *ReplicatedBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	var page *BlobPage
+	err := s.firstHealthy(ctx, prefix, func(replica ContextBlobStore) (err error) {
+		page, err = replica.ListWithContext(ctx, prefix, pageToken, pageSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	blobs := page.Blobs[:0]
+	for _, blob := range page.Blobs {
+		if !strings.HasPrefix(blob.Key, replicaInternalPrefix) {
+			blobs = append(blobs, blob)
+		}
+	}
+	page.Blobs = blobs
+	return page, nil
+}
+
+// Repair lists the blobs whose key starts with prefix on all the replicas, deletes the ones whose
+// deletion was recorded after their last modification, and copies the missing ones from the
+// replica holding their most recent version. Tombstones are removed once they've been applied to
+// all the replicas, or once the blob has been written again.
+//
+// Copies are compared using their content hashes when the replicas provide hashes of the same kind,
+// and their sizes otherwise. Tombstones are compared with the modification times of the blobs, so
+// the clocks of the replicas should be in sync with the clock of the processes deleting blobs.
+func (s *ReplicatedBlobStore) Repair(ctx context.Context, prefix string) (*ReplicaRepairReport, error) {
+	// For each key, the blob on each replica (nil if it's missing), and its latest deletion time
+	blobs := map[string][]*BlobInfo{}
+	buried := map[string]time.Time{}
+	for i, replica := range s.replicas {
+		err := WalkBlobs(ctx, replica, prefix, func(info BlobInfo) error {
+			if strings.HasPrefix(info.Key, replicaInternalPrefix) {
+				return nil
+			}
+			if _, ok := blobs[info.Key]; !ok {
+				blobs[info.Key] = make([]*BlobInfo, len(s.replicas))
+			}
+			blobs[info.Key][i] = &info
+			return nil
+		})
+		if err == nil {
+			err = WalkBlobs(ctx, replica, replicaTombstonePrefix+prefix, func(info BlobInfo) error {
+				deletedAt, err := readTombstone(ctx, replica, info.Key)
+				if err != nil {
+					return err
+				}
+				key := strings.TrimPrefix(info.Key, replicaTombstonePrefix)
+				if deletedAt.After(buried[key]) {
+					buried[key] = deletedAt
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[replicated-storage] Error listing replica %d: %w", i, err)
+		}
+	}
+	for key := range buried {
+		if _, ok := blobs[key]; !ok {
+			blobs[key] = make([]*BlobInfo, len(s.replicas))
+		}
+	}
+
+	report := &ReplicaRepairReport{}
+	for key, replicaBlobs := range blobs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		report.Checked++
+		if err := s.repairKey(ctx, key, replicaBlobs, buried[key], report); err != nil {
+			report.Errors = append(report.Errors, err)
+		}
+	}
+	return report, nil
+}
+
+// repairKey applies a blob's deletion (if it was recorded after the last modification of the blob)
+// or copies its most recent version to the replicas that miss it
+func (s *ReplicatedBlobStore) repairKey(ctx context.Context, key string, replicaBlobs []*BlobInfo, deletedAt time.Time, report *ReplicaRepairReport) error {
+	if !deletedAt.IsZero() {
+		for _, blob := range replicaBlobs {
+			if blob != nil && blob.ModTime.IsZero() {
+				// Without modification time, we can't tell whether the blob was written again
+				report.Conflicts = append(report.Conflicts, key)
+				return nil
+			}
+		}
+		for i, blob := range replicaBlobs {
+			if blob == nil || blob.ModTime.After(deletedAt) {
+				continue
+			}
+			if err := deleteIfExists(ctx, s.replicas[i], key); err != nil {
+				return fmt.Errorf("[replicated-storage] Error deleting %s from replica %d: %s", key, i, err)
+			}
+			replicaBlobs[i] = nil
+			report.Deleted++
+		}
+	}
+
+	source := -1
+	for i, blob := range replicaBlobs {
+		if blob == nil {
+			continue
+		}
+		if source >= 0 && !sameReplicaContent(*replicaBlobs[source], *blob) {
+			report.Conflicts = append(report.Conflicts, key)
+			return nil
+		}
+		if source < 0 || blob.ModTime.After(replicaBlobs[source].ModTime) {
+			source = i
+		}
+	}
+
+	if source >= 0 {
+		for i, blob := range replicaBlobs {
+			if blob != nil {
+				continue
+			}
+			if err := s.copyBlob(ctx, key, replicaBlobs[source].Size, s.replicas[source], s.replicas[i]); err != nil {
+				return fmt.Errorf("[replicated-storage] Error copying %s to replica %d: %s", key, i, err)
+			}
+			report.Copied++
+		}
+	}
+
+	// All the replicas now agree: either the blob is gone, or it was written after its deletion
+	if !deletedAt.IsZero() {
+		for i, replica := range s.replicas {
+			if err := deleteIfExists(ctx, replica, replicaTombstonePrefix+key); err != nil {
+				return fmt.Errorf("[replicated-storage] Error removing tombstone of %s from replica %d: %s", key, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// sameReplicaContent tells whether two copies of a blob may hold the same content: they must have
+// the same size and, if they have content hashes of the same kind, the same hash. ETags are only
+// compared when they're equal, since the ETags of identical blobs may differ (multipart uploads).
+func sameReplicaContent(a BlobInfo, b BlobInfo) bool {
+	if a.Size != b.Size {
+		return false
+	}
+	algoA, sumA := splitContentHash(a.ContentHash)
+	algoB, sumB := splitContentHash(b.ContentHash)
+	if algoA == "" || algoA != algoB || algoA == "etag" {
+		return true
+	}
+	return sumA == sumB
+}
+
+// readTombstone returns the deletion time recorded in a tombstone
+func readTombstone(ctx context.Context, store ContextBlobStore, key string) (time.Time, error) {
+	rc, err := store.GetWithContext(ctx, key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, 64))
+	if err != nil {
+		return time.Time{}, err
+	}
+	deletedAt, err := time.Parse(time.RFC3339Nano, string(data))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("[replicated-storage] Invalid tombstone %s: %s", key, err)
+	}
+	return deletedAt, nil
+}
+
+func (s *ReplicatedBlobStore) copyBlob(ctx context.Context, key string, size int64, from ContextBlobStore, to ContextBlobStore) error {
+	data, err := from.GetWithContext(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return to.PutWithContext(ctx, key, data, size)
+}
+
+// firstHealthy calls op on the replicas, in order, until it succeeds
+func (s *ReplicatedBlobStore) firstHealthy(ctx context.Context, key string, op func(replica ContextBlobStore) error) error {
+	var errs []string
+	var rawErrs []error
+	for i, replica := range s.replicas {
+		err := op(replica)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		errs = append(errs, fmt.Sprintf("replica %d: %s", i, err))
+		rawErrs = append(rawErrs, err)
+	}
+	err := fmt.Errorf("[replicated-storage] All replicas failed for %s: %s", key, strings.Join(errs, "; "))
+	return newBlobError(commonErrorKind(rawErrs), key, err)
+}
+
+// onAll calls op on all the replicas in parallel and returns their errors
+func (s *ReplicatedBlobStore) onAll(op func(replica ContextBlobStore) error) []error {
+	errs := make([]error, len(s.replicas))
+	var wg sync.WaitGroup
+	for i, replica := range s.replicas {
+		wg.Add(1)
+		go func(i int, replica ContextBlobStore) {
+			defer wg.Done()
+			errs[i] = op(replica)
+		}(i, replica)
+	}
+	wg.Wait()
+	return errs
+}
+
+// checkQuorum returns an error if fewer than WriteQuorum operations succeeded, and logs the failures
+// otherwise
+func (s *ReplicatedBlobStore) checkQuorum(operation string, key string, errs []error) error {
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("replica %d: %s", i, err))
+		}
+	}
+	if len(errs)-len(failures) < s.WriteQuorum {
+		err := fmt.Errorf("[replicated-storage] Write quorum (%d/%d) not reached %s %s: %s", s.WriteQuorum, len(errs), operation, key, strings.Join(failures, "; "))
+		return newBlobError(commonErrorKind(errs), key, err)
+	}
+	if len(failures) > 0 {
+		log.Printf("[replicated-storage] Error %s %s on some replicas (quorum reached): %s", operation, key, strings.Join(failures, "; "))
+	}
+	return nil
+}
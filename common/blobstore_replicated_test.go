@@ -0,0 +1,184 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func newTestReplicatedBlobStore(t *testing.T) (*ReplicatedBlobStore, []*MemoryBlobStore, []*FaultyBlobStore) {
+	var mems []*MemoryBlobStore
+	var faulty []*FaultyBlobStore
+	var replicas []BlobStore
+	for i := 0; i < 3; i++ {
+		mem := NewMemoryBlobStore()
+		mems = append(mems, mem)
+		faulty = append(faulty, NewFaultyBlobStore(mem))
+		replicas = append(replicas, faulty[i])
+	}
+	store, err := NewReplicatedBlobStore(2, replicas...)
+	require.NoError(t, err)
+	return store, mems, faulty
+}
+
+func replicaHas(t *testing.T, store BlobStore, key string) bool {
+	exists, err := store.Exists(key)
+	require.NoError(t, err)
+	return exists
+}
+
+func TestReplicatedBlobStoreRepairCopiesMissingBlobs(t *testing.T) {
+	store, mems, faulty := newTestReplicatedBlobStore(t)
+
+	faulty[2].Inject(Fault{Op: "put", Fail: true})
+	require.NoError(t, store.Put("blob", strings.NewReader("data"), 4))
+	faulty[2].Reset()
+	assert.False(t, replicaHas(t, mems[2], "blob"))
+
+	report, err := store.Repair(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Copied)
+	assert.Empty(t, report.Errors)
+	assert.True(t, replicaHas(t, mems[2], "blob"))
+}
+
+func TestReplicatedBlobStoreRepairDoesNotResurrectDeletedBlobs(t *testing.T) {
+	store, mems, faulty := newTestReplicatedBlobStore(t)
+	require.NoError(t, store.Put("blob", strings.NewReader("data"), 4))
+	time.Sleep(time.Millisecond)
+
+	// Replica 2 is down while the blob is deleted
+	faulty[2].Inject(Fault{Fail: true})
+	require.NoError(t, store.Delete("blob"))
+	faulty[2].Reset()
+	assert.True(t, replicaHas(t, mems[2], "blob"))
+
+	// Tombstones are hidden from listings
+	page, err := store.List("", "", 0)
+	require.NoError(t, err)
+	assert.Empty(t, page.Blobs)
+
+	report, err := store.Repair(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, report.Deleted)
+	assert.Equal(t, 0, report.Copied)
+	assert.Empty(t, report.Errors)
+	for _, mem := range mems {
+		assert.False(t, replicaHas(t, mem, "blob"))
+		assert.False(t, replicaHas(t, mem, replicaTombstonePrefix+"blob"), "tombstones are removed once applied")
+	}
+
+	// A blob written again after its deletion is kept
+	require.NoError(t, store.Put("blob", strings.NewReader("new"), 3))
+	report, err = store.Repair(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Deleted)
+	for _, mem := range mems {
+		assert.True(t, replicaHas(t, mem, "blob"))
+	}
+}
+
+func TestReplicatedBlobStoreRollsBackFailedWrites(t *testing.T) {
+	store, mems, faulty := newTestReplicatedBlobStore(t)
+
+	// Only replica 0 accepts the write: the quorum isn't reached
+	faulty[1].Inject(Fault{Op: "put", Fail: true})
+	faulty[2].Inject(Fault{Op: "put", Fail: true})
+	assert.Error(t, store.Put("blob", strings.NewReader("data"), 4))
+	faulty[1].Reset()
+	faulty[2].Reset()
+	assert.False(t, replicaHas(t, mems[0], "blob"))
+
+	report, err := store.Repair(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Copied)
+	for _, mem := range mems {
+		assert.False(t, replicaHas(t, mem, "blob"))
+	}
+}
+
+func TestReplicatedBlobStoreKeepsPreviousVersionOnFailedOverwrite(t *testing.T) {
+	store, mems, faulty := newTestReplicatedBlobStore(t)
+	require.NoError(t, store.Put("blob", strings.NewReader("v1"), 2))
+
+	faulty[1].Inject(Fault{Op: "put", Fail: true})
+	faulty[2].Inject(Fault{Op: "put", Fail: true})
+	assert.Error(t, store.Put("blob", strings.NewReader("v2"), 2))
+	faulty[1].Reset()
+	faulty[2].Reset()
+	for i, mem := range mems {
+		data, err := readBlob(t, mem, "blob")
+		require.NoError(t, err)
+		assert.Equal(t, "v1", string(data), "replica %d", i)
+		page, err := mem.List(replicaInternalPrefix, "", 0)
+		require.NoError(t, err)
+		assert.Empty(t, page.Blobs, "replica %d: the staged blob is discarded", i)
+	}
+
+	// With the quorum reached, the replica that failed keeps the previous version until repaired
+	faulty[2].Inject(Fault{Op: "put", Fail: true})
+	require.NoError(t, store.Put("blob", strings.NewReader("v2"), 2))
+	faulty[2].Reset()
+	for i, expected := range []string{"v2", "v2", "v1"} {
+		data, err := readBlob(t, mems[i], "blob")
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(data), "replica %d", i)
+	}
+	page, err := store.List("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, page.Blobs, 1)
+	assert.Equal(t, "blob", page.Blobs[0].Key)
+}
+
+func TestReplicatedBlobStoreRepairReportsConflicts(t *testing.T) {
+	store, mems, _ := newTestReplicatedBlobStore(t)
+
+	// Same size, different content: memory stores provide SHA-256 hashes, which tell them apart
+	require.NoError(t, mems[0].Put("blob", strings.NewReader("aaaa"), 4))
+	require.NoError(t, mems[1].Put("blob", strings.NewReader("bbbb"), 4))
+
+	report, err := store.Repair(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"blob"}, report.Conflicts)
+	assert.Equal(t, 0, report.Copied)
+	assert.False(t, replicaHas(t, mems[2], "blob"))
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RetentionRule expires the blobs whose key starts with Prefix once they haven't been modified for
+// MaxAge. A zero MaxAge keeps the blobs forever, which is useful to protect a sub-prefix of another
+// rule's prefix.
+type RetentionRule struct {
+	Prefix string
+	MaxAge time.Duration
+}
+
+// RetentionPolicy is a set of retention rules. When several rules match a key, the one with the
+// longest prefix applies.
+type RetentionPolicy struct {
+	Rules []RetentionRule
+
+	// IncompleteUploadsMaxAge, if positive, also cleans up the leftovers of the uploads that were
+	// started that long ago and never completed, on the stores that keep such leftovers (S3
+	// multipart uploads, LocalBlobStore temporary files)
+	IncompleteUploadsMaxAge time.Duration
+}
+
+// RetentionReport sums up what ApplyRetentionPolicy did (or would have done, in dry-run mode)
+type RetentionReport struct {
+	DryRun  bool
+	Scanned int
+
+	// Expired lists the blobs that were deleted (or would have been, in dry-run mode)
+	Expired      []BlobInfo
+	ExpiredBytes int64
+
+	// Skipped lists the expired blobs that were modified or deleted while the policy was being
+	// applied, and were therefore left alone
+	Skipped []string
+
+	// Undated lists the blobs matched by a rule whose store reported no modification time: their age
+	// being unknown, they were left alone
+	Undated []string
+
+	Errors []error
+}
+
+// incompleteUploadsCleaner is implemented by the stores that can clean up the leftovers of
+// interrupted uploads
+type incompleteUploadsCleaner interface {
+	AbortIncompleteUploads(ctx context.Context, olderThan time.Duration) error
+}
+
+// ApplyRetentionPolicy lists the blobs of store matching the policy's rules and deletes the
+// expired ones. In dry-run mode, nothing is deleted: the report lists the blobs that would be.
+//
+// Ages are measured against the time at which ApplyRetentionPolicy is called. On the stores that
+// support conditional deletes (see ConditionalDeleteBlobStore), expired blobs are only deleted if
+// they haven't been modified since they were listed. On the other ones, every expired blob is
+// stat'ed again right before being deleted, and skipped if it was overwritten in the meantime: a
+// blob overwritten between that last check and its deletion would still be deleted, so the shortest
+// MaxAge should remain well above the time it takes to write a blob.
+func ApplyRetentionPolicy(ctx context.Context, store BlobStore, policy RetentionPolicy, dryRun bool) (*RetentionReport, error) {
+	now := time.Now()
+	cstore := AsContextBlobStore(store)
+	dstore, conditional := store.(ConditionalDeleteBlobStore)
+	report := &RetentionReport{DryRun: dryRun}
+
+	if policy.IncompleteUploadsMaxAge > 0 && !dryRun {
+		if cleaner, ok := store.(incompleteUploadsCleaner); ok {
+			if err := cleaner.AbortIncompleteUploads(ctx, policy.IncompleteUploadsMaxAge); err != nil {
+				report.Errors = append(report.Errors, err)
+			}
+		}
+	}
+
+	for _, prefix := range retentionWalkPrefixes(policy.Rules) {
+		err := WalkBlobs(ctx, store, prefix, func(info BlobInfo) error {
+			report.Scanned++
+			rule, ok := policy.rule(info.Key)
+			if !ok || rule.MaxAge <= 0 {
+				return nil
+			}
+			if info.ModTime.IsZero() {
+				report.Undated = append(report.Undated, info.Key)
+				return nil
+			}
+			if now.Sub(info.ModTime) < rule.MaxAge {
+				return nil
+			}
+			if dryRun {
+				report.Expired = append(report.Expired, info)
+				report.ExpiredBytes += info.Size
+				return nil
+			}
+
+			if !conditional || info.Version == "" {
+				// The blob may have been overwritten since it's been listed
+				current, err := cstore.StatWithContext(ctx, info.Key)
+				switch {
+				case errors.Is(err, ErrNotFound):
+					report.Skipped = append(report.Skipped, info.Key)
+					return nil
+				case err != nil:
+					return report.deleteError(ctx, info.Key, err)
+				case current.ModTime.IsZero():
+					report.Undated = append(report.Undated, info.Key)
+					return nil
+				case now.Sub(current.ModTime) < rule.MaxAge:
+					report.Skipped = append(report.Skipped, info.Key)
+					return nil
+				}
+				info = *current
+			}
+
+			var err error
+			if conditional && info.Version != "" {
+				err = dstore.DeleteIfUnchanged(ctx, info.Key, info.Version)
+			} else {
+				err = cstore.DeleteWithContext(ctx, info.Key)
+			}
+			switch {
+			case errors.Is(err, ErrModified), errors.Is(err, ErrNotFound):
+				report.Skipped = append(report.Skipped, info.Key)
+			case err != nil:
+				return report.deleteError(ctx, info.Key, err)
+			default:
+				report.Expired = append(report.Expired, info)
+				report.ExpiredBytes += info.Size
+			}
+			return nil
+		})
+		if err != nil {
+			return report, fmt.Errorf("[retention] Error listing blobs under %q: %w", prefix, err)
+		}
+	}
+	return report, nil
+}
+
+// deleteError records the failure to delete an expired blob, unless it is due to ctx being done (in
+// which case the walk is interrupted)
+func (r *RetentionReport) deleteError(ctx context.Context, key string, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	r.Errors = append(r.Errors, fmt.Errorf("[retention] Error deleting expired blob %s: %s", key, err))
+	return nil
+}
+
+// rule returns the rule applying to a key: the one with the longest matching prefix
+func (p *RetentionPolicy) rule(key string) (RetentionRule, bool) {
+	var match RetentionRule
+	found := false
+	for _, rule := range p.Rules {
+		if strings.HasPrefix(key, rule.Prefix) && (!found || len(rule.Prefix) > len(match.Prefix)) {
+			match = rule
+			found = true
+		}
+	}
+	return match, found
+}
+
+// retentionWalkPrefixes returns the prefixes to list to find all the blobs matched by rules, leaving
+// out the prefixes that are covered by shorter ones
+func retentionWalkPrefixes(rules []RetentionRule) []string {
+	var prefixes []string
+	for _, rule := range rules {
+		prefixes = append(prefixes, rule.Prefix)
+	}
+	sort.Strings(prefixes)
+
+	var walk []string
+	for _, prefix := range prefixes {
+		if len(walk) > 0 && strings.HasPrefix(prefix, walk[len(walk)-1]) {
+			continue
+		}
+		walk = append(walk, prefix)
+	}
+	return walk
+}
@@ -0,0 +1,113 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// racyBlobStore overwrites a blob right after it's been listed, as a concurrent writer could
+type racyBlobStore struct {
+	*MemoryBlobStore
+	overwrite string
+}
+
+func (s *racyBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	page, err := s.MemoryBlobStore.ListWithContext(ctx, prefix, pageToken, pageSize)
+	if err == nil && s.overwrite != "" {
+		err = s.MemoryBlobStore.Put(s.overwrite, strings.NewReader("new content"), -1)
+	}
+	return page, err
+}
+
+// undatedBlobStore doesn't report modification times
+type undatedBlobStore struct {
+	*MemoryBlobStore
+}
+
+func (s *undatedBlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	page, err := s.MemoryBlobStore.ListWithContext(ctx, prefix, pageToken, pageSize)
+	if page != nil {
+		for i := range page.Blobs {
+			page.Blobs[i].ModTime = time.Time{}
+		}
+	}
+	return page, err
+}
+
+func TestApplyRetentionPolicySkipsBlobsModifiedAfterListing(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryBlobStore()
+	require.NoError(t, mem.Put("tmp/expired", strings.NewReader("old"), -1))
+	require.NoError(t, mem.Put("tmp/racy", strings.NewReader("old"), -1))
+	time.Sleep(10 * time.Millisecond)
+
+	store := &racyBlobStore{MemoryBlobStore: mem, overwrite: "tmp/racy"}
+	policy := RetentionPolicy{Rules: []RetentionRule{{Prefix: "tmp/", MaxAge: 5 * time.Millisecond}}}
+	report, err := ApplyRetentionPolicy(ctx, store, policy, false)
+	require.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	require.Len(t, report.Expired, 1)
+	assert.Equal(t, "tmp/expired", report.Expired[0].Key)
+	assert.Equal(t, []string{"tmp/racy"}, report.Skipped)
+
+	data, err := readBlob(t, mem, "tmp/racy")
+	require.NoError(t, err)
+	assert.Equal(t, "new content", string(data))
+}
+
+func TestApplyRetentionPolicyReportsUndatedBlobs(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryBlobStore()
+	require.NoError(t, mem.Put("tmp/undated", strings.NewReader("data"), -1))
+
+	policy := RetentionPolicy{Rules: []RetentionRule{{Prefix: "tmp/", MaxAge: time.Nanosecond}}}
+	for _, dryRun := range []bool{true, false} {
+		report, err := ApplyRetentionPolicy(ctx, &undatedBlobStore{mem}, policy, dryRun)
+		require.NoError(t, err)
+		assert.Empty(t, report.Expired)
+		assert.Equal(t, []string{"tmp/undated"}, report.Undated)
+	}
+	exists, err := mem.Exists("tmp/undated")
+	require.NoError(t, err)
+	assert.True(t, exists, "blobs of unknown age are kept")
+}
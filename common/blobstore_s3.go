@@ -37,18 +37,38 @@ package common
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
-	"path/filepath"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
 )
 
-// S3BlobStore is a BlobStore implementations that stores data on AWS-S3
+// s3PresignExpiry is the lifetime of the presigned upload URLs used by Put, when the context it is
+// given carries no deadline
+const s3PresignExpiry = 10 * time.Minute
+
+// s3DefaultRegion is used when no region is configured, which is common with S3-compatible servers
+const s3DefaultRegion = "us-east-1"
+
+// S3BlobStore is a BlobStore implementations that stores data on AWS-S3 or on an S3-compatible
+// server
 type S3BlobStore struct {
 	session *s3Session
 }
@@ -57,6 +77,44 @@ type s3Session struct {
 	bucket StorageBucket
 	s3     *s3.S3
 	sess   *session.Session
+	client *http.Client
+	conf   S3Config
+}
+
+// S3Config describes how to reach an S3 bucket, hosted on AWS or by any S3-compatible server (such
+// as Minio). Only Bucket is mandatory.
+type S3Config struct {
+	Bucket string
+	Region string
+
+	// Endpoint is the URL of an S3-compatible server (AWS is used if it is empty). If it has no
+	// scheme, HTTPS is used unless DisableSSL is set.
+	Endpoint   string
+	DisableSSL bool
+
+	// PathStyle makes requests address the bucket in the URL path (http://host/bucket/key) rather
+	// than in the hostname (http://bucket.host/key), as required by most S3-compatible servers
+	PathStyle bool
+
+	// Static credentials. The default AWS credential chain (environment, shared credentials file,
+	// EC2 role...) is used if AccessKeyID is empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// CABundle is the path to a PEM file holding the certificate authorities to trust (in addition
+	// to the system ones) when connecting to Endpoint
+	CABundle           string
+	InsecureSkipVerify bool
+
+	// Blobs larger than MultipartThreshold (or of unknown size) are uploaded in parts of PartSize
+	// bytes, UploadConcurrency of them being sent in parallel. Each part is retried up to PartRetries
+	// times (a negative value disables retries). Up to (UploadConcurrency + 1) * PartSize bytes are
+	// buffered in memory during an upload. Zero values stand for the defaults.
+	MultipartThreshold int64
+	PartSize           int64
+	UploadConcurrency  int
+	PartRetries        int
 }
 
 // StorageBucket is the S3 bucket where data is stored
@@ -67,25 +125,79 @@ type StorageBucket struct {
 
 // Put streams a file to S3, given its size and uuid
 func (s *S3BlobStore) Put(key string, r io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, r, size)
+}
+
+// PutWithContext streams a file to S3, aborting the upload as soon as ctx is done. The presigned
+// upload URL expires with ctx's deadline, if it has one.
+func (s *S3BlobStore) PutWithContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, r, size, nil)
+}
+
+// PutWithMetadata streams a file to S3, storing the given metadata as x-amz-meta-* headers. Large
+// files (and files of unknown size, when size is negative) are sent using a multipart upload.
+func (s *S3BlobStore) PutWithMetadata(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string) error {
+	return s.put(ctx, key, r, size, metadata, false)
+}
+
+// PutIfAbsent streams a file to S3, unless there already is an object under the same key
+func (s *S3BlobStore) PutIfAbsent(key string, r io.Reader, size int64) error {
+	return s.PutIfAbsentWithContext(context.Background(), key, r, size)
+}
+
+// PutIfAbsentWithContext streams a file to S3, unless there already is an object under the same
+// key. It relies on S3 conditional writes (If-None-Match: *), which S3-compatible servers may not
+// support.
+func (s *S3BlobStore) PutIfAbsentWithContext(ctx context.Context, key string, r io.Reader, size int64) error {
+	return s.put(ctx, key, r, size, nil, true)
+}
+
+func (s *S3BlobStore) put(ctx context.Context, key string, r io.Reader, size int64, metadata map[string]string, ifAbsent bool) error {
 	sess := s.session
 
+	if size < 0 || size > sess.conf.MultipartThreshold {
+		return s.putMultipart(ctx, key, r, metadata, ifAbsent)
+	}
+
+	expiry := s3PresignExpiry
+	if deadline, ok := ctx.Deadline(); ok {
+		expiry = time.Until(deadline)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if expiry <= 0 {
+		return context.DeadlineExceeded
+	}
+
 	// Upload logic using a custom, presigned URL based, streaming uploader
-	prereq, _ := sess.s3.PutObjectRequest(&s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket: &sess.bucket.Name,
 		Key:    &key,
-	})
-	presignedURL, err := prereq.Presign(10 * time.Minute)
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	prereq, _ := sess.s3.PutObjectRequest(input)
+	presignedURL, signedHeaders, err := prereq.PresignRequest(expiry)
 	if err != nil {
 		return fmt.Errorf("[s3-storage] Error presigning request: %s", err)
 	}
 
 	req, err := http.NewRequest(http.MethodPut, presignedURL, r)
-	req.ContentLength = size
 	if err != nil {
 		return fmt.Errorf("[s3-storage] Error constructing presigned request: %s", err)
 	}
+	for name, values := range signedHeaders {
+		req.Header[name] = values
+	}
+	if ifAbsent {
+		req.Header.Set("If-None-Match", "*")
+	}
+	req.ContentLength = size
+	req = req.WithContext(ctx)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := sess.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("[s3-storage] Error uploading file: %s", err)
 	}
@@ -98,33 +210,107 @@ func (s *S3BlobStore) Put(key string, r io.Reader, size int64) error {
 	}
 
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("[s3-storage] Error uploading file (code: %d): %s", resp.StatusCode, buf.Bytes())
+		return httpBlobError(resp.StatusCode, key, fmt.Errorf("[s3-storage] Error uploading file (code: %d): %s", resp.StatusCode, buf.Bytes()))
 	}
 
 	return nil
 }
 
+// SetMetadata replaces the metadata of an object by copying it onto itself
+func (s *S3BlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	if err := s.copy(ctx, key, key, metadata); err != nil {
+		return fmt.Errorf("[s3-storage] Error updating metadata of %s: %w", key, err)
+	}
+	return nil
+}
+
 // Get retrieve a data with the specified uuid
 func (s *S3BlobStore) Get(key string) (data io.ReadCloser, err error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext retrieves a data with the specified uuid, the download being aborted as soon as
+// ctx is done
+func (s *S3BlobStore) GetWithContext(ctx context.Context, key string) (data io.ReadCloser, err error) {
 	session := s.session
-	file, err := session.s3.GetObject(&s3.GetObjectInput{
+	file, err := session.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: &session.bucket.Name,
 		Key:    &key,
 	})
 	if err != nil {
-		return nil, err
+		return nil, s3BlobError(key, err)
 	}
 	return file.Body, err
 }
 
+// GetRange retrieves a part of a data with the specified uuid, using an HTTP range request
+func (s *S3BlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext retrieves a part of a data with the specified uuid, using an HTTP range
+// request. The download is aborted as soon as ctx is done.
+func (s *S3BlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := checkBlobRange(key, offset); err != nil {
+		return nil, err
+	}
+	// An HTTP range can't be empty
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+
+	session := s.session
+	file, err := session.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &session.bucket.Name,
+		Key:    &key,
+		Range:  &byteRange,
+	})
+	if err != nil {
+		return nil, s3BlobError(key, err)
+	}
+	return file.Body, nil
+}
+
 // Delete deletes a data with the specified uuid
 func (s *S3BlobStore) Delete(key string) error {
+	return s.DeleteWithContext(context.Background(), key)
+}
+
+// DeleteWithContext deletes a data with the specified uuid
+func (s *S3BlobStore) DeleteWithContext(ctx context.Context, key string) error {
 	session := s.session
-	_, err := session.s3.DeleteObject(&s3.DeleteObjectInput{
+	_, err := session.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
 		Bucket: &session.bucket.Name,
 		Key:    &key,
 	})
 	if err != nil {
+		return s3BlobError(key, err)
+	}
+	return nil
+}
+
+// DeleteIfUnchanged deletes an object, with an If-Match condition on its ETag
+func (s *S3BlobStore) DeleteIfUnchanged(ctx context.Context, key string, version string) error {
+	session := s.session
+	_, err := session.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: &session.bucket.Name,
+		Key:    &key,
+	}, func(r *request.Request) {
+		// The SDK has no field for conditional deletes, the header is added to the signed request
+		r.HTTPRequest.Header.Set("If-Match", version)
+	})
+	if err != nil {
+		var reqErr awserr.RequestFailure
+		if errors.As(err, &reqErr) {
+			return conditionalBlobError(reqErr.StatusCode(), key, err)
+		}
 		return err
 	}
 	return nil
@@ -132,28 +318,318 @@ func (s *S3BlobStore) Delete(key string) error {
 
 // Rename renames a data with the specified uuid
 func (s *S3BlobStore) Rename(key string, newKey string) error {
+	return s.RenameWithContext(context.Background(), key, newKey)
+}
+
+// RenameWithContext renames a data with the specified uuid
+func (s *S3BlobStore) RenameWithContext(ctx context.Context, key string, newKey string) error {
+	if err := s.CopyWithContext(ctx, key, newKey); err != nil {
+		return err
+	}
+	if err := s.DeleteWithContext(ctx, key); err != nil {
+		return s3BlobError(key, fmt.Errorf("Error deleting old key %s: %w", key, err))
+	}
+	return nil
+}
+
+// Copy copies an object (and its metadata) server-side
+func (s *S3BlobStore) Copy(src string, dst string) error {
+	return s.CopyWithContext(context.Background(), src, dst)
+}
+
+// CopyWithContext copies an object (and its metadata) server-side
+func (s *S3BlobStore) CopyWithContext(ctx context.Context, src string, dst string) error {
+	return s.copy(ctx, src, dst, nil)
+}
+
+// copy copies an object server-side, replacing its metadata unless metadata is nil. Objects too
+// large for a CopyObject request are copied part by part.
+func (s *S3BlobStore) copy(ctx context.Context, src string, dst string, metadata map[string]string) error {
 	session := s.session
-	_, err := session.s3.CopyObject(&s3.CopyObjectInput{
+	head, err := session.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &session.bucket.Name,
+		Key:    &src,
+	})
+	if err != nil {
+		return s3BlobError(src, err)
+	}
+	if aws.Int64Value(head.ContentLength) > s3MaxCopyObjectSize {
+		return s.copyMultipart(ctx, src, dst, head, metadata)
+	}
+
+	input := &s3.CopyObjectInput{
 		Bucket:     &session.bucket.Name,
-		CopySource: aws.String(filepath.Join(session.bucket.Name, key)),
-		Key:        &newKey,
+		CopySource: aws.String(s3CopySource(session.bucket.Name, src)),
+		Key:        &dst,
+	}
+	if metadata != nil {
+		input.Metadata = aws.StringMap(metadata)
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveReplace)
+	}
+	if _, err := session.s3.CopyObjectWithContext(ctx, input); err != nil {
+		return s3BlobError(src, err)
+	}
+	return nil
+}
+
+// s3CopySource returns the URL encoded X-Amz-Copy-Source designating an object
+func s3CopySource(bucket string, key string) string {
+	return url.PathEscape(path.Join(bucket, key))
+}
+
+// RenameIfAbsent renames an object, unless there already is an object under the new key
+func (s *S3BlobStore) RenameIfAbsent(key string, newKey string) error {
+	return s.RenameIfAbsentWithContext(context.Background(), key, newKey)
+}
+
+// RenameIfAbsentWithContext renames an object, unless there already is an object under the new
+// key. As S3 copies can't be made conditional on the destination, the object is downloaded and
+// uploaded again with PutIfAbsent before the original one is deleted.
+func (s *S3BlobStore) RenameIfAbsentWithContext(ctx context.Context, key string, newKey string) error {
+	session := s.session
+	obj, err := session.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: &session.bucket.Name,
+		Key:    &key,
 	})
 	if err != nil {
+		return s3BlobError(key, err)
+	}
+	defer obj.Body.Close()
+
+	metadata := map[string]string{}
+	for k, v := range obj.Metadata {
+		metadata[k] = aws.StringValue(v)
+	}
+	if err := s.put(ctx, newKey, obj.Body, aws.Int64Value(obj.ContentLength), metadata, true); err != nil {
 		return err
 	}
-	if err = s.Delete(key); err != nil {
-		return fmt.Errorf("Error deleting old key %s: %s", key, err)
+	if err := s.DeleteWithContext(ctx, key); err != nil {
+		return s3BlobError(key, fmt.Errorf("Error deleting old key %s: %w", key, err))
 	}
 	return nil
 }
 
-func initWithBucket(bucket StorageBucket) (ret *s3Session) {
-	ret = &s3Session{
-		bucket: bucket,
-		sess:   session.New(aws.NewConfig().WithRegion(bucket.Region)),
+// Stat returns information on an object, using a HEAD request
+func (s *S3BlobStore) Stat(key string) (*BlobInfo, error) {
+	return s.StatWithContext(context.Background(), key)
+}
+
+// StatWithContext returns information on an object, using a HEAD request
+func (s *S3BlobStore) StatWithContext(ctx context.Context, key string) (*BlobInfo, error) {
+	session := s.session
+	head, err := session.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: &session.bucket.Name,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, s3BlobError(key, err)
+	}
+
+	metadata := map[string]string{}
+	for k, v := range head.Metadata {
+		metadata[k] = aws.StringValue(v)
+	}
+	return &BlobInfo{
+		Key:         key,
+		Size:        aws.Int64Value(head.ContentLength),
+		ModTime:     aws.TimeValue(head.LastModified),
+		ContentHash: s3ContentHash(head.ETag),
+		Metadata:    lowerKeys(metadata),
+		Version:     aws.StringValue(head.ETag),
+	}, nil
+}
+
+// Exists checks whether an object exists, using a HEAD request
+func (s *S3BlobStore) Exists(key string) (bool, error) {
+	return s.ExistsWithContext(context.Background(), key)
+}
+
+// ExistsWithContext checks whether an object exists, using a HEAD request
+func (s *S3BlobStore) ExistsWithContext(ctx context.Context, key string) (bool, error) {
+	_, err := s.StatWithContext(ctx, key)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// List lists the objects of the bucket whose key starts with prefix
+func (s *S3BlobStore) List(prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	return s.ListWithContext(context.Background(), prefix, pageToken, pageSize)
+}
+
+// ListWithContext lists the objects of the bucket whose key starts with prefix
+func (s *S3BlobStore) ListWithContext(ctx context.Context, prefix string, pageToken string, pageSize int) (*BlobPage, error) {
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	session := s.session
+	input := &s3.ListObjectsV2Input{
+		Bucket:  &session.bucket.Name,
+		Prefix:  &prefix,
+		MaxKeys: aws.Int64(int64(pageSize)),
+	}
+	if pageToken != "" {
+		input.ContinuationToken = &pageToken
+	}
+	out, err := session.s3.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return nil, s3BlobError(prefix, fmt.Errorf("[s3-storage] Error listing objects: %w", err))
 	}
-	ret.s3 = s3.New(ret.sess)
-	return ret
+
+	page := &BlobPage{}
+	for _, obj := range out.Contents {
+		page.Blobs = append(page.Blobs, BlobInfo{
+			Key:         aws.StringValue(obj.Key),
+			Size:        aws.Int64Value(obj.Size),
+			ModTime:     aws.TimeValue(obj.LastModified),
+			ContentHash: s3ContentHash(obj.ETag),
+			Version:     aws.StringValue(obj.ETag),
+		})
+	}
+	if aws.BoolValue(out.IsTruncated) {
+		page.NextPageToken = aws.StringValue(out.NextContinuationToken)
+	}
+	return page, nil
+}
+
+// SignedURL returns a presigned URL granting method on an object for ttl (up to 7 days)
+func (s *S3BlobStore) SignedURL(key string, method string, ttl time.Duration) (string, error) {
+	method, err := checkSignedURLRequest(key, method, ttl)
+	if err != nil {
+		return "", err
+	}
+	sess := s.session
+
+	var req *request.Request
+	switch method {
+	case "GET":
+		req, _ = sess.s3.GetObjectRequest(&s3.GetObjectInput{Bucket: &sess.bucket.Name, Key: &key})
+	case "HEAD":
+		req, _ = sess.s3.HeadObjectRequest(&s3.HeadObjectInput{Bucket: &sess.bucket.Name, Key: &key})
+	case "PUT":
+		req, _ = sess.s3.PutObjectRequest(&s3.PutObjectInput{Bucket: &sess.bucket.Name, Key: &key})
+	}
+	signedURL, err := req.Presign(ttl)
+	if err != nil {
+		return "", fmt.Errorf("[s3-storage] Error presigning %s request for %s: %s", method, key, err)
+	}
+	return signedURL, nil
+}
+
+// s3BlobError classifies an error returned by the S3 API according to its HTTP status code
+func s3BlobError(key string, err error) error {
+	var reqErr awserr.RequestFailure
+	if errors.As(err, &reqErr) {
+		return httpBlobError(reqErr.StatusCode(), key, err)
+	}
+	return err
+}
+
+// s3ContentHash turns an S3 ETag into a BlobInfo content hash. The ETag of objects that weren't
+// uploaded in several parts is the MD5 digest of their content.
+func s3ContentHash(etag *string) string {
+	tag := strings.Trim(aws.StringValue(etag), `"`)
+	switch {
+	case tag == "":
+		return ""
+	case strings.Contains(tag, "-"):
+		return "etag:" + tag
+	default:
+		return "md5:" + tag
+	}
+}
+
+func initWithConfig(conf S3Config) (*s3Session, error) {
+	if conf.Region == "" {
+		conf.Region = s3DefaultRegion
+	}
+	if conf.PartSize <= 0 {
+		conf.PartSize = s3DefaultPartSize
+	}
+	if conf.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("[s3-storage] Part size must be at least %d bytes", s3MinPartSize)
+	}
+	if conf.MultipartThreshold <= 0 {
+		conf.MultipartThreshold = conf.PartSize
+	}
+	if conf.UploadConcurrency <= 0 {
+		conf.UploadConcurrency = s3DefaultUploadConcurrency
+	}
+	if conf.PartRetries == 0 {
+		conf.PartRetries = s3DefaultPartRetries
+	} else if conf.PartRetries < 0 {
+		conf.PartRetries = 0
+	}
+
+	client, err := newS3HTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConf := aws.NewConfig().
+		WithRegion(conf.Region).
+		WithHTTPClient(client).
+		WithS3ForcePathStyle(conf.PathStyle).
+		WithDisableSSL(conf.DisableSSL)
+	if conf.Endpoint != "" {
+		awsConf = awsConf.WithEndpoint(conf.Endpoint)
+	}
+	if conf.AccessKeyID != "" {
+		awsConf = awsConf.WithCredentials(credentials.NewStaticCredentials(conf.AccessKeyID, conf.SecretAccessKey, conf.SessionToken))
+	}
+
+	sess, err := session.NewSession(awsConf)
+	if err != nil {
+		return nil, fmt.Errorf("[s3-storage] Error creating session: %s", err)
+	}
+	return &s3Session{
+		bucket: NewStorageBucket(conf.Bucket, conf.Region),
+		s3:     s3.New(sess),
+		sess:   sess,
+		client: client,
+		conf:   conf,
+	}, nil
+}
+
+// newS3HTTPClient returns the HTTP client to be used for a given S3 configuration: the default one
+// unless custom TLS settings are required
+func newS3HTTPClient(conf S3Config) (*http.Client, error) {
+	if conf.CABundle == "" && !conf.InsecureSkipVerify {
+		return http.DefaultClient, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: conf.InsecureSkipVerify}
+	if conf.CABundle != "" {
+		pem, err := ioutil.ReadFile(conf.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("[s3-storage] Error reading CA bundle %s: %s", conf.CABundle, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("[s3-storage] No valid certificate found in CA bundle %s", conf.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	// Same settings as http.DefaultTransport, with our TLS configuration
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsConfig,
+		},
+	}, nil
 }
 
 // NewStorageBucket creates a new StorageBucket
@@ -163,8 +639,17 @@ func NewStorageBucket(name, region string) StorageBucket {
 
 // NewS3BlobStore creates a new S3Blobstore with default bucket
 func NewS3BlobStore(awsBucket string, awsRegion string) (*S3BlobStore, error) {
-	bucket := NewStorageBucket(awsBucket, awsRegion)
-	s := new(S3BlobStore)
-	s.session = initWithBucket(bucket)
-	return s, nil
+	return NewS3BlobStoreWithConfig(S3Config{Bucket: awsBucket, Region: awsRegion})
+}
+
+// NewS3BlobStoreWithConfig creates a new S3Blobstore talking to AWS or to any S3-compatible server
+func NewS3BlobStoreWithConfig(conf S3Config) (*S3BlobStore, error) {
+	if conf.Bucket == "" {
+		return nil, fmt.Errorf("[s3-storage] No bucket name provided")
+	}
+	sess, err := initWithConfig(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &S3BlobStore{session: sess}, nil
 }
@@ -0,0 +1,390 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+// Multipart upload settings (S3 limits parts to 5MB at least, except for the last one, and uploads
+// to 10000 parts)
+const (
+	s3MinPartSize              = 5 << 20
+	s3MaxPartSize              = 5 << 30
+	s3MaxParts                 = 10000
+	s3DefaultPartSize          = 64 << 20
+	s3DefaultUploadConcurrency = 4
+	s3DefaultPartRetries       = 3
+	s3PartRetryBackoff         = 500 * time.Millisecond
+)
+
+// s3MaxCopyObjectSize is the size of the largest object a single CopyObject request can copy.
+// Larger objects are copied part by part, with UploadPartCopy requests.
+var s3MaxCopyObjectSize int64 = 5 << 30
+
+type s3Part struct {
+	number int64
+	data   []byte
+}
+
+// putMultipart uploads a file to S3 in parts, sending several of them in parallel and retrying
+// failed ones. If the upload can't be completed, it is aborted so that S3 frees the parts that have
+// already been uploaded.
+func (s *S3BlobStore) putMultipart(ctx context.Context, key string, r io.Reader, metadata map[string]string, ifAbsent bool) error {
+	sess := s.session
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: &sess.bucket.Name,
+		Key:    &key,
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	upload, err := sess.s3.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return s3BlobError(key, fmt.Errorf("[s3-storage] Error creating multipart upload: %w", err))
+	}
+
+	var opts []request.Option
+	if ifAbsent {
+		// The SDK has no field for conditional writes, the header is added to the signed request
+		opts = append(opts, func(r *request.Request) {
+			r.HTTPRequest.Header.Set("If-None-Match", "*")
+		})
+	}
+
+	completed, err := s.uploadParts(ctx, key, upload.UploadId, r)
+	return s.completeMultipart(ctx, key, upload.UploadId, completed, err, opts...)
+}
+
+// completeMultipart completes a multipart upload once its parts have been uploaded, or aborts it
+// (so that S3 frees its parts) if they couldn't be
+func (s *S3BlobStore) completeMultipart(ctx context.Context, key string, uploadID *string, completed []*s3.CompletedPart, err error, opts ...request.Option) error {
+	sess := s.session
+	if err == nil {
+		_, err = sess.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          &sess.bucket.Name,
+			Key:             &key,
+			UploadId:        uploadID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		}, opts...)
+		if err != nil {
+			err = s3BlobError(key, fmt.Errorf("[s3-storage] Error completing multipart upload: %w", err))
+		}
+	}
+	if err != nil {
+		// ctx may be the reason why we're failing, let's not use it to clean things up
+		_, abortErr := sess.s3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   &sess.bucket.Name,
+			Key:      &key,
+			UploadId: uploadID,
+		})
+		if abortErr != nil {
+			log.Printf("[s3-storage] Error aborting multipart upload %s of %s: %s", aws.StringValue(uploadID), key, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// uploadParts reads r in chunks and uploads them as the parts of a multipart upload
+func (s *S3BlobStore) uploadParts(ctx context.Context, key string, uploadID *string, r io.Reader) ([]*s3.CompletedPart, error) {
+	conf := s.session.conf
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		completed []*s3.CompletedPart
+		firstErr  error
+	)
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	parts := make(chan s3Part)
+	for i := 0; i < conf.UploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				etag, err := s.uploadPart(ctx, key, uploadID, part)
+				if err != nil {
+					fail(err)
+					continue
+				}
+				mutex.Lock()
+				completed = append(completed, &s3.CompletedPart{
+					ETag:       etag,
+					PartNumber: aws.Int64(part.number),
+				})
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	// Parts are read sequentially and handed over to the uploading goroutines. There always is at
+	// least one part, even for empty files.
+	for number := int64(1); ctx.Err() == nil; number++ {
+		if number > s3MaxParts {
+			fail(fmt.Errorf("[s3-storage] File too large to be uploaded in %d parts of %d bytes", s3MaxParts, conf.PartSize))
+			break
+		}
+		buf := make([]byte, conf.PartSize)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			fail(fmt.Errorf("[s3-storage] Error reading file to upload: %s", err))
+			break
+		}
+		if n == 0 && number > 1 {
+			break
+		}
+		select {
+		case parts <- s3Part{number: number, data: buf[:n]}:
+		case <-ctx.Done():
+		}
+		if err != nil {
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+	return completed, nil
+}
+
+// uploadPart uploads a single part, retrying with an exponential backoff if it fails
+func (s *S3BlobStore) uploadPart(ctx context.Context, key string, uploadID *string, part s3Part) (etag *string, err error) {
+	sess := s.session
+	err = s.retryPart(ctx, "uploading", key, part.number, func() error {
+		out, err := sess.s3.UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:        &sess.bucket.Name,
+			Key:           &key,
+			UploadId:      uploadID,
+			PartNumber:    aws.Int64(part.number),
+			Body:          bytes.NewReader(part.data),
+			ContentLength: aws.Int64(int64(len(part.data))),
+		})
+		if err == nil {
+			etag = out.ETag
+		}
+		return err
+	})
+	return etag, err
+}
+
+// retryPart performs a part request, retrying it with an exponential backoff if it fails
+func (s *S3BlobStore) retryPart(ctx context.Context, action string, key string, number int64, do func() error) (err error) {
+	backoff := s3PartRetryBackoff
+	for attempt := 0; ; attempt++ {
+		if err = do(); err == nil {
+			return nil
+		}
+		if attempt >= s.session.conf.PartRetries {
+			break
+		}
+
+		log.Printf("[s3-storage] Error %s part %d of %s (attempt %d), retrying in %s: %s", action, number, key, attempt+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("[s3-storage] Error %s part %d of %s: %s", action, number, key, err)
+}
+
+// copyMultipart copies an object too large for a CopyObject request part by part, with
+// UploadPartCopy requests. As such copies don't carry the metadata of the source object over, it
+// is given to the multipart upload (unless metadata replaces it).
+func (s *S3BlobStore) copyMultipart(ctx context.Context, src string, dst string, head *s3.HeadObjectOutput, metadata map[string]string) error {
+	sess := s.session
+	if metadata == nil {
+		metadata = aws.StringValueMap(head.Metadata)
+	}
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      &sess.bucket.Name,
+		Key:         &dst,
+		ContentType: head.ContentType,
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	upload, err := sess.s3.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return s3BlobError(dst, fmt.Errorf("[s3-storage] Error creating multipart upload: %w", err))
+	}
+
+	completed, err := s.copyParts(ctx, src, dst, upload.UploadId, aws.Int64Value(head.ContentLength))
+	return s.completeMultipart(ctx, dst, upload.UploadId, completed, err)
+}
+
+// copyParts copies the byte ranges of an object as the parts of a multipart upload,
+// UploadConcurrency of them at a time
+func (s *S3BlobStore) copyParts(ctx context.Context, src string, key string, uploadID *string, size int64) ([]*s3.CompletedPart, error) {
+	sess := s.session
+	partSize := sess.conf.PartSize
+	if partSize*s3MaxParts < size {
+		partSize = (size + s3MaxParts - 1) / s3MaxParts
+	}
+	if partSize > s3MaxPartSize {
+		return nil, fmt.Errorf("[s3-storage] Object %s too large to be copied in %d parts", src, s3MaxParts)
+	}
+	count := (size + partSize - 1) / partSize
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		firstErr error
+	)
+	completed := make([]*s3.CompletedPart, count)
+	numbers := make(chan int64)
+	for i := 0; i < sess.conf.UploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				first := (number - 1) * partSize
+				last := first + partSize - 1
+				if last >= size {
+					last = size - 1
+				}
+				var out *s3.UploadPartCopyOutput
+				err := s.retryPart(ctx, "copying", key, number, func() (err error) {
+					out, err = sess.s3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+						Bucket:          &sess.bucket.Name,
+						Key:             &key,
+						UploadId:        uploadID,
+						PartNumber:      aws.Int64(number),
+						CopySource:      aws.String(s3CopySource(sess.bucket.Name, src)),
+						CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+					})
+					return err
+				})
+				if err != nil {
+					mutex.Lock()
+					if firstErr == nil {
+						firstErr = s3BlobError(src, err)
+						cancel()
+					}
+					mutex.Unlock()
+					continue
+				}
+				completed[number-1] = &s3.CompletedPart{
+					ETag:       out.CopyPartResult.ETag,
+					PartNumber: aws.Int64(number),
+				}
+			}
+		}()
+	}
+
+	for number := int64(1); number <= count && ctx.Err() == nil; number++ {
+		select {
+		case numbers <- number:
+		case <-ctx.Done():
+		}
+	}
+	close(numbers)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return completed, nil
+}
+
+// AbortIncompleteUploads aborts the multipart uploads that were started more than olderThan ago and
+// never completed nor aborted (by a crashed process for instance), so that S3 frees their parts
+func (s *S3BlobStore) AbortIncompleteUploads(ctx context.Context, olderThan time.Duration) error {
+	sess := s.session
+	input := &s3.ListMultipartUploadsInput{Bucket: &sess.bucket.Name}
+	for {
+		out, err := sess.s3.ListMultipartUploadsWithContext(ctx, input)
+		if err != nil {
+			return fmt.Errorf("[s3-storage] Error listing multipart uploads: %s", err)
+		}
+		for _, upload := range out.Uploads {
+			if time.Since(aws.TimeValue(upload.Initiated)) < olderThan {
+				continue
+			}
+			_, err := sess.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   &sess.bucket.Name,
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return fmt.Errorf("[s3-storage] Error aborting multipart upload %s: %s", aws.StringValue(upload.UploadId), err)
+			}
+		}
+		if !aws.BoolValue(out.IsTruncated) {
+			return nil
+		}
+		input.KeyMarker = out.NextKeyMarker
+		input.UploadIdMarker = out.NextUploadIdMarker
+	}
+}
@@ -0,0 +1,716 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeS3 is a minimal, in-memory, S3-compatible server (in the fashion of Minio) serving a single
+// bucket with path-style addressing. It only accepts requests signed with its access key.
+type fakeS3 struct {
+	bucket    string
+	accessKey string
+
+	mutex    sync.Mutex
+	objects  map[string]*fakeS3Object
+	uploads  map[string]*fakeS3Upload
+	uploadID int
+	requests []string
+}
+
+type fakeS3Object struct {
+	data     []byte
+	metadata map[string]string
+	etag     string
+	modTime  time.Time
+}
+
+type fakeS3Upload struct {
+	key      string
+	metadata map[string]string
+	parts    map[int]*fakeS3Object
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3BlobStore) {
+	f := &fakeS3{
+		bucket:    "morpheo",
+		accessKey: "minio-access-key",
+		objects:   map[string]*fakeS3Object{},
+		uploads:   map[string]*fakeS3Upload{},
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	store, err := NewS3BlobStoreWithConfig(S3Config{
+		Bucket:          f.bucket,
+		Endpoint:        server.URL,
+		PathStyle:       true,
+		AccessKeyID:     f.accessKey,
+		SecretAccessKey: "minio-secret-key",
+		PartSize:        s3MinPartSize,
+	})
+	require.NoError(t, err)
+	return f, store
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	query := r.URL.Query()
+	credential := query.Get("X-Amz-Credential")
+	if credential == "" {
+		credential = r.Header.Get("Authorization")
+	}
+	if !strings.Contains(credential, f.accessKey+"/") {
+		f.error(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != f.bucket {
+		f.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := ""
+	if len(path) == 2 {
+		key = path[1]
+	}
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	op := r.Method
+	switch {
+	case key == "" && r.Method == http.MethodGet && uploads:
+		op = "ListMultipartUploads"
+		f.listUploads(w)
+	case key == "" && r.Method == http.MethodGet:
+		op = "ListObjectsV2"
+		f.list(w, query)
+	case r.Method == http.MethodPost && uploads:
+		op = "CreateMultipartUpload"
+		f.createUpload(w, r, key)
+	case r.Method == http.MethodPut && uploadID != "" && r.Header.Get("X-Amz-Copy-Source") != "":
+		op = "UploadPartCopy"
+		f.uploadPartCopy(w, r, uploadID, query.Get("partNumber"))
+	case r.Method == http.MethodPut && uploadID != "":
+		op = "UploadPart"
+		f.uploadPart(w, r, uploadID, query.Get("partNumber"))
+	case r.Method == http.MethodPost && uploadID != "":
+		op = "CompleteMultipartUpload"
+		f.completeUpload(w, r, key, uploadID)
+	case r.Method == http.MethodDelete && uploadID != "":
+		op = "AbortMultipartUpload"
+		delete(f.uploads, uploadID)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		op = "CopyObject"
+		f.copyObject(w, r, key)
+	case r.Method == http.MethodPut:
+		op = "PutObject"
+		f.putObject(w, r, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.getObject(w, r, key)
+	case r.Method == http.MethodDelete:
+		if obj, ok := f.objects[key]; ok && r.Header.Get("If-Match") != "" && r.Header.Get("If-Match") != `"`+obj.etag+`"` {
+			f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			break
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+	f.requests = append(f.requests, op)
+}
+
+func (f *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) xml(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (f *fakeS3) count(op string) (n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, request := range f.requests {
+		if request == op {
+			n++
+		}
+	}
+	return n
+}
+
+func fakeS3Metadata(header http.Header) map[string]string {
+	metadata := map[string]string{}
+	for name := range header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			metadata[strings.ToLower(name[len("x-amz-meta-"):])] = header.Get(name)
+		}
+	}
+	return metadata
+}
+
+func newFakeS3Object(data []byte, metadata map[string]string) *fakeS3Object {
+	sum := md5.Sum(data)
+	return &fakeS3Object{data: data, metadata: metadata, etag: hex.EncodeToString(sum[:]), modTime: time.Now().UTC()}
+}
+
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+		f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	obj := newFakeS3Object(data, fakeS3Metadata(r.Header))
+	f.objects[key] = obj
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+}
+
+// copySource returns the object designated by the (URL encoded) X-Amz-Copy-Source header
+func (f *fakeS3) copySource(r *http.Request) (*fakeS3Object, bool) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return nil, false
+	}
+	obj, ok := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+	if !ok {
+		obj, ok = f.objects[strings.TrimPrefix(source, f.bucket+"/")]
+	}
+	return obj, ok
+}
+
+func (f *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, key string) {
+	src, ok := f.copySource(r)
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	if int64(len(src.data)) > s3MaxCopyObjectSize {
+		f.error(w, http.StatusBadRequest, "InvalidRequest")
+		return
+	}
+	metadata := src.metadata
+	if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+		metadata = fakeS3Metadata(r.Header)
+	}
+	obj := newFakeS3Object(src.data, metadata)
+	f.objects[key] = obj
+	f.xml(w, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: `"` + obj.etag + `"`, LastModified: obj.modTime.Format(time.RFC3339)})
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := f.objects[key]
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	for k, v := range obj.metadata {
+		w.Header().Set("X-Amz-Meta-"+k, v)
+	}
+	w.Header().Set("ETag", `"`+obj.etag+`"`)
+	w.Header().Set("Last-Modified", obj.modTime.Format(http.TimeFormat))
+
+	data := obj.data
+	status := http.StatusOK
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		start, end, ok := parseFakeRange(byteRange, int64(len(data)))
+		if !ok {
+			f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data = data[start : end+1]
+		status = http.StatusPartialContent
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+// parseFakeRange parses the "bytes=start-[end]" ranges sent by S3BlobStore
+func parseFakeRange(byteRange string, size int64) (start int64, end int64, ok bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(byteRange, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end = size - 1
+	if bounds[1] != "" {
+		if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix := query.Get("prefix")
+	maxKeys, _ := strconv.Atoi(query.Get("max-keys"))
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > query.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type content struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+	}{Name: f.bucket, Prefix: prefix}
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[maxKeys-1]
+	}
+	for _, key := range keys {
+		obj := f.objects[key]
+		result.Contents = append(result.Contents, content{
+			Key:          key,
+			LastModified: obj.modTime.Format(time.RFC3339),
+			ETag:         `"` + obj.etag + `"`,
+			Size:         len(obj.data),
+		})
+	}
+	result.KeyCount = len(result.Contents)
+	f.xml(w, result)
+}
+
+func (f *fakeS3) createUpload(w http.ResponseWriter, r *http.Request, key string) {
+	f.uploadID++
+	id := strconv.Itoa(f.uploadID)
+	f.uploads[id] = &fakeS3Upload{key: key, metadata: fakeS3Metadata(r.Header), parts: map[int]*fakeS3Object{}}
+	f.xml(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Bucket: f.bucket, Key: key, UploadId: id})
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, uploadID string, partNumber string) {
+	upload, ok := f.uploads[uploadID]
+	number, err := strconv.Atoi(partNumber)
+	if !ok || err != nil {
+		f.error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.error(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	part := newFakeS3Object(data, nil)
+	upload.parts[number] = part
+	w.Header().Set("ETag", `"`+part.etag+`"`)
+}
+
+func (f *fakeS3) uploadPartCopy(w http.ResponseWriter, r *http.Request, uploadID string, partNumber string) {
+	upload, ok := f.uploads[uploadID]
+	number, err := strconv.Atoi(partNumber)
+	if !ok || err != nil {
+		f.error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	src, ok := f.copySource(r)
+	if !ok {
+		f.error(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+	data := src.data
+	if byteRange := r.Header.Get("X-Amz-Copy-Source-Range"); byteRange != "" {
+		start, end, ok := parseFakeRange(byteRange, int64(len(data)))
+		if !ok {
+			f.error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		data = data[start : end+1]
+	}
+	part := newFakeS3Object(data, nil)
+	upload.parts[number] = part
+	f.xml(w, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		ETag         string
+		LastModified string
+	}{ETag: `"` + part.etag + `"`, LastModified: part.modTime.Format(time.RFC3339)})
+}
+
+func (f *fakeS3) completeUpload(w http.ResponseWriter, r *http.Request, key string, uploadID string) {
+	upload, ok := f.uploads[uploadID]
+	if !ok || upload.key != key {
+		f.error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	var body struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&body); err != nil || len(body.Parts) == 0 {
+		f.error(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	if _, ok := f.objects[key]; ok && r.Header.Get("If-None-Match") == "*" {
+		f.error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+		return
+	}
+
+	var data bytes.Buffer
+	digests := md5.New()
+	for i, completed := range body.Parts {
+		part, ok := upload.parts[completed.PartNumber]
+		if !ok || strings.Trim(completed.ETag, `"`) != part.etag || (i > 0 && completed.PartNumber <= body.Parts[i-1].PartNumber) {
+			f.error(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(body.Parts)-1 && len(part.data) < s3MinPartSize {
+			f.error(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		data.Write(part.data)
+		sum, _ := hex.DecodeString(part.etag)
+		digests.Write(sum)
+	}
+	obj := newFakeS3Object(data.Bytes(), upload.metadata)
+	obj.etag = fmt.Sprintf("%x-%d", digests.Sum(nil), len(body.Parts))
+	f.objects[key] = obj
+	delete(f.uploads, uploadID)
+	f.xml(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Bucket  string
+		Key     string
+		ETag    string
+	}{Bucket: f.bucket, Key: key, ETag: `"` + obj.etag + `"`})
+}
+
+func (f *fakeS3) listUploads(w http.ResponseWriter) {
+	type upload struct {
+		Key       string
+		UploadId  string
+		Initiated string
+	}
+	result := struct {
+		XMLName     xml.Name `xml:"ListMultipartUploadsResult"`
+		Bucket      string
+		IsTruncated bool
+		Uploads     []upload `xml:"Upload"`
+	}{Bucket: f.bucket}
+	for id, u := range f.uploads {
+		result.Uploads = append(result.Uploads, upload{Key: u.key, UploadId: id, Initiated: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)})
+	}
+	f.xml(w, result)
+}
+
+func TestS3BlobStoreCustomEndpoint(t *testing.T) {
+	ctx := context.Background()
+	f, store := newFakeS3(t)
+
+	require.NoError(t, store.PutWithMetadata(ctx, "algo/model.tar", strings.NewReader("model"), 5, map[string]string{"Owner": "morpheo"}))
+	assert.Equal(t, 1, f.count("PutObject"))
+
+	rc, err := store.Get("algo/model.tar")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "model", string(data))
+
+	info, err := store.Stat("algo/model.tar")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size)
+	assert.Equal(t, "morpheo", info.Metadata["owner"])
+	sum := md5.Sum([]byte("model"))
+	assert.Equal(t, "md5:"+hex.EncodeToString(sum[:]), info.ContentHash)
+	assert.False(t, info.ModTime.IsZero())
+
+	rc, err = store.GetRange("algo/model.tar", 1, 3)
+	require.NoError(t, err)
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.Equal(t, "ode", string(data))
+
+	err = store.PutIfAbsent("algo/model.tar", strings.NewReader("other"), 5)
+	assert.True(t, errors.Is(err, ErrAlreadyExists), "PutIfAbsent on an existing key: %v", err)
+
+	require.NoError(t, store.Copy("algo/model.tar", "algo/copy.tar"))
+	require.NoError(t, store.Rename("algo/copy.tar", "algo/renamed.tar"))
+	exists, err := store.Exists("algo/copy.tar")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	info, err = store.Stat("algo/renamed.tar")
+	require.NoError(t, err)
+	assert.Equal(t, "morpheo", info.Metadata["owner"], "copies keep their metadata")
+
+	require.NoError(t, store.Put("data/a", strings.NewReader("a"), 1))
+	var keys []string
+	pageToken := ""
+	for {
+		page, err := store.List("algo/", pageToken, 1)
+		require.NoError(t, err)
+		for _, blob := range page.Blobs {
+			keys = append(keys, blob.Key)
+		}
+		if pageToken = page.NextPageToken; pageToken == "" {
+			break
+		}
+	}
+	assert.Equal(t, []string{"algo/model.tar", "algo/renamed.tar"}, keys)
+
+	require.NoError(t, store.Delete("algo/model.tar"))
+	_, err = store.Get("algo/model.tar")
+	assert.True(t, errors.Is(err, ErrNotFound), "Get on a deleted key: %v", err)
+	_, err = store.Stat("algo/model.tar")
+	assert.True(t, errors.Is(err, ErrNotFound), "Stat on a deleted key: %v", err)
+}
+
+func TestS3BlobStoreDeleteIfUnchanged(t *testing.T) {
+	ctx := context.Background()
+	_, store := newFakeS3(t)
+
+	require.NoError(t, store.Put("key", strings.NewReader("v1"), 2))
+	info, err := store.Stat("key")
+	require.NoError(t, err)
+	require.NoError(t, store.Put("key", strings.NewReader("v2"), 2))
+	err = store.DeleteIfUnchanged(ctx, "key", info.Version)
+	assert.True(t, errors.Is(err, ErrModified), "DeleteIfUnchanged on a modified object: %v", err)
+
+	page, err := store.List("", "", 0)
+	require.NoError(t, err)
+	require.Len(t, page.Blobs, 1)
+	require.NoError(t, store.DeleteIfUnchanged(ctx, "key", page.Blobs[0].Version))
+	exists, err := store.Exists("key")
+	require.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestS3BlobStoreSignedURLValidation(t *testing.T) {
+	_, store := newFakeS3(t)
+
+	signedURL, err := store.SignedURL("algo/model.tar", "put", time.Hour)
+	require.NoError(t, err)
+	assert.True(t, strings.Contains(signedURL, "/morpheo/algo/model.tar?"), signedURL)
+
+	for _, ttl := range []time.Duration{0, -time.Minute} {
+		_, err = store.SignedURL("algo/model.tar", "GET", ttl)
+		assert.Error(t, err, "ttl %s", ttl)
+	}
+	for _, key := range []string{"", "../model.tar", "/algo/model.tar"} {
+		_, err = store.SignedURL(key, "GET", time.Hour)
+		assert.True(t, errors.Is(err, ErrInvalidKey), "key %q: %v", key, err)
+	}
+}
+
+func TestS3BlobStoreRejectedCredentials(t *testing.T) {
+	f, store := newFakeS3(t)
+	f.accessKey = "another-access-key"
+
+	err := store.Put("key", strings.NewReader("data"), 4)
+	assert.True(t, errors.Is(err, ErrPermission), "Put with wrong credentials: %v", err)
+	_, err = store.Stat("key")
+	assert.True(t, errors.Is(err, ErrPermission), "Stat with wrong credentials: %v", err)
+}
+
+func TestS3BlobStoreMultipartUpload(t *testing.T) {
+	ctx := context.Background()
+	f, store := newFakeS3(t)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*s3MinPartSize+1024)/16)
+	require.NoError(t, store.PutWithMetadata(ctx, "data/large", bytes.NewReader(data), -1, map[string]string{"kind": "dataset"}))
+	assert.Equal(t, 1, f.count("CreateMultipartUpload"))
+	assert.Equal(t, 3, f.count("UploadPart"))
+	assert.Equal(t, 1, f.count("CompleteMultipartUpload"))
+
+	rc, err := store.Get("data/large")
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "multipart upload content mismatch")
+
+	info, err := store.Stat("data/large")
+	require.NoError(t, err)
+	assert.Equal(t, "dataset", info.Metadata["kind"])
+	assert.True(t, strings.HasPrefix(info.ContentHash, "etag:"), "multipart uploads have no MD5 digest: %s", info.ContentHash)
+
+	// Empty blobs of unknown size are sent as a single empty part
+	require.NoError(t, store.PutWithContext(ctx, "data/empty", bytes.NewReader(nil), -1))
+	info, err = store.Stat("data/empty")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size)
+}
+
+func TestS3BlobStoreAbortsFailedMultipartUploads(t *testing.T) {
+	f, store := newFakeS3(t)
+
+	err := store.PutWithContext(context.Background(), "data/broken", &failingReader{after: s3MinPartSize + 10}, -1)
+	require.Error(t, err)
+	assert.Equal(t, 1, f.count("AbortMultipartUpload"))
+	f.mutex.Lock()
+	assert.Empty(t, f.uploads)
+	assert.NotContains(t, f.objects, "data/broken")
+	f.mutex.Unlock()
+}
+
+func TestS3BlobStoreCopyEscapesKeys(t *testing.T) {
+	ctx := context.Background()
+	_, store := newFakeS3(t)
+
+	require.NoError(t, store.PutWithMetadata(ctx, "data/50% off.csv", strings.NewReader("data"), 4, map[string]string{"kind": "dataset"}))
+	require.NoError(t, store.Copy("data/50% off.csv", "data/copy #1.csv"))
+	data, err := readBlob(t, store, "data/copy #1.csv")
+	require.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+
+	require.NoError(t, store.SetMetadata(ctx, "data/50% off.csv", map[string]string{"kind": "archive"}))
+	info, err := store.Stat("data/50% off.csv")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kind": "archive"}, info.Metadata)
+}
+
+func TestS3BlobStoreMultipartCopy(t *testing.T) {
+	defer func(size int64) { s3MaxCopyObjectSize = size }(s3MaxCopyObjectSize)
+	s3MaxCopyObjectSize = s3MinPartSize
+
+	ctx := context.Background()
+	f, store := newFakeS3(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), (2*s3MinPartSize+1024)/16)
+	require.NoError(t, store.PutWithMetadata(ctx, "data/large", bytes.NewReader(data), int64(len(data)), map[string]string{"kind": "dataset"}))
+
+	require.NoError(t, store.Rename("data/large", "data/renamed"))
+	assert.Equal(t, 0, f.count("CopyObject"))
+	assert.Equal(t, 3, f.count("UploadPartCopy"))
+	got, err := readBlob(t, store, "data/renamed")
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, got), "multipart copy content mismatch")
+	info, err := store.Stat("data/renamed")
+	require.NoError(t, err)
+	assert.Equal(t, "dataset", info.Metadata["kind"], "multipart copies keep their metadata")
+	exists, err := store.Exists("data/large")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	require.NoError(t, store.SetMetadata(ctx, "data/renamed", map[string]string{"kind": "archive"}))
+	assert.Equal(t, 6, f.count("UploadPartCopy"))
+	info, err = store.Stat("data/renamed")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"kind": "archive"}, info.Metadata)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	// Small objects are still copied with a single request
+	require.NoError(t, store.Put("data/small", strings.NewReader("small"), 5))
+	require.NoError(t, store.Copy("data/small", "data/small copy"))
+	assert.Equal(t, 1, f.count("CopyObject"))
+	f.mutex.Lock()
+	assert.Empty(t, f.uploads)
+	f.mutex.Unlock()
+}
+
+// failingReader yields zeros, and an error once after bytes have been read
+type failingReader struct {
+	after int
+	n     int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n >= r.after {
+		return 0, errors.New("read failure")
+	}
+	if len(p) > r.after-r.n {
+		p = p[:r.after-r.n]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	r.n += len(p)
+	return len(p), nil
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// HMACURLSigner issues and checks signed URLs for the blob stores that have no native way of doing
+// so (such as LocalBlobStore). A signed URL is made of BaseURL, the key of the blob, its expiry date
+// and an HMAC-SHA256 of the method, key and expiry date. The blobs are then served by a
+// SignedURLHandler, which must be reachable under BaseURL and share the signer's secret.
+type HMACURLSigner struct {
+	BaseURL string
+	Secret  []byte
+}
+
+// NewHMACURLSigner creates an HMACURLSigner, baseURL being the URL under which its SignedURLHandler
+// is served
+func NewHMACURLSigner(baseURL string, secret []byte) (*HMACURLSigner, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("[blobstore] Invalid signed URL base %q", baseURL)
+	}
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("[blobstore] URL signing secret is too short (%d bytes)", len(secret))
+	}
+	return &HMACURLSigner{BaseURL: strings.TrimSuffix(baseURL, "/"), Secret: secret}, nil
+}
+
+// Sign returns a URL granting method (GET, HEAD or PUT) on a blob for ttl
+func (s *HMACURLSigner) Sign(key string, method string, ttl time.Duration) (string, error) {
+	method, err := checkSignedURLRequest(key, method, ttl)
+	if err != nil {
+		return "", err
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", s.signature(method, key, expires))
+	return s.BaseURL + "/" + strings.Join(segments, "/") + "?" + query.Encode(), nil
+}
+
+// Verify checks the signature of a request made on a signed URL and returns the key of the blob it
+// grants access to. The errors it returns match ErrPermission (or ErrInvalidKey). A URL signed for
+// GET also grants HEAD.
+func (s *HMACURLSigner) Verify(r *http.Request) (string, error) {
+	base, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return "", fmt.Errorf("[blobstore] Invalid signed URL base %q", s.BaseURL)
+	}
+	prefix := strings.TrimSuffix(base.Path, "/") + "/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		return "", newBlobError(ErrPermission, r.URL.Path, fmt.Errorf("[blobstore] Path %s is outside of %s", r.URL.Path, prefix))
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	if err := validateBlobKey(key); err != nil {
+		return "", err
+	}
+
+	query := r.URL.Query()
+	expires := query.Get("expires")
+	expiry, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return "", newBlobError(ErrPermission, key, fmt.Errorf("[blobstore] Invalid signed URL expiry date for blob %s", key))
+	}
+	signature := []byte(query.Get("signature"))
+	valid := hmac.Equal(signature, []byte(s.signature(r.Method, key, expires)))
+	if !valid && r.Method == http.MethodHead {
+		valid = hmac.Equal(signature, []byte(s.signature(http.MethodGet, key, expires)))
+	}
+	if !valid {
+		return "", newBlobError(ErrPermission, key, fmt.Errorf("[blobstore] Invalid %s signature for blob %s", r.Method, key))
+	}
+	if time.Now().Unix() > expiry {
+		return "", newBlobError(ErrPermission, key, fmt.Errorf("[blobstore] Signed URL for blob %s expired at %s", key, time.Unix(expiry, 0).UTC()))
+	}
+	return key, nil
+}
+
+func (s *HMACURLSigner) signature(method string, key string, expires string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	io.WriteString(mac, method+"\n"+key+"\n"+expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignedURLHandler serves the blobs of a store to the requests made on URLs issued by its signer:
+// GET and HEAD requests download blobs (with support for HTTP ranges) and PUT requests upload them.
+type SignedURLHandler struct {
+	Store  BlobStore
+	Signer *HMACURLSigner
+}
+
+// NewSignedURLHandler creates a SignedURLHandler
+func NewSignedURLHandler(store BlobStore, signer *HMACURLSigner) *SignedURLHandler {
+	return &SignedURLHandler{Store: store, Signer: signer}
+}
+
+func (h *SignedURLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := h.Signer.Verify(r)
+	if err != nil {
+		http.Error(w, err.Error(), blobErrorStatus(err))
+		return
+	}
+	store := AsContextBlobStore(h.Store)
+	ctx := r.Context()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		info, err := store.StatWithContext(ctx, key)
+		if err != nil {
+			http.Error(w, err.Error(), blobErrorStatus(err))
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if info.ContentHash != "" {
+			w.Header().Set("ETag", strconv.Quote(info.ContentHash))
+		}
+		content := &blobReadSeeker{ctx: ctx, store: h.Store, key: key, size: info.Size}
+		defer content.Close()
+		http.ServeContent(w, r, path.Base(key), info.ModTime, content)
+	case http.MethodPut:
+		if err := store.PutWithContext(ctx, key, r.Body, r.ContentLength); err != nil {
+			http.Error(w, err.Error(), blobErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// blobErrorStatus returns the HTTP status code corresponding to a blob store error
+func blobErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAlreadyExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, ErrInvalidKey):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// blobReadSeeker is an io.ReadSeeker on a blob. Reads are streamed from a single ranged read,
+// started from the current offset on the first read following a seek.
+type blobReadSeeker struct {
+	ctx    context.Context
+	store  BlobStore
+	key    string
+	size   int64
+	offset int64
+	rc     io.ReadCloser
+}
+
+func (r *blobReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		rc, err := GetBlobRange(r.ctx, r.store, r.key, r.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+	n, err := r.rc.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("[blobstore] Negative offset in blob %s", r.key)
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *blobReadSeeker) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
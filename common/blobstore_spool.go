@@ -0,0 +1,103 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/net/context"
+)
+
+// spoolMemoryLimit is the size up to which spoolBlob keeps blobs in memory, larger ones being
+// written to a temporary file
+const spoolMemoryLimit = 8 << 20
+
+// spooledBlob is a copy of a stream, kept in memory or in a temporary file, that can be uploaded
+// once its size and content are known (to record their digest in metadata for instance, without
+// having to update it once the blob is committed)
+type spooledBlob struct {
+	Size int64
+	data []byte
+	file *os.File
+}
+
+// spoolBlob reads r until EOF (or until ctx is done) into a spooledBlob, that must be closed
+func spoolBlob(ctx context.Context, r io.Reader) (*spooledBlob, error) {
+	r = newContextReader(ctx, r)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(r, spoolMemoryLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= spoolMemoryLimit {
+		return &spooledBlob{Size: n, data: buf.Bytes()}, nil
+	}
+
+	file, err := ioutil.TempFile("", "blobstore-spool-")
+	if err != nil {
+		return nil, fmt.Errorf("[blobstore] Error creating spool file: %s", err)
+	}
+	b := &spooledBlob{file: file}
+	if b.Size, err = io.Copy(file, io.MultiReader(&buf, r)); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// Reader returns a reader on the spooled data, from its beginning
+func (b *spooledBlob) Reader() (io.Reader, error) {
+	if b.file == nil {
+		return bytes.NewReader(b.data), nil
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("[blobstore] Error rewinding spool file: %s", err)
+	}
+	return b.file, nil
+}
+
+// Close removes the spool file, if any
+func (b *spooledBlob) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
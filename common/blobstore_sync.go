@@ -0,0 +1,545 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultSyncConcurrency is the number of blobs copied in parallel by SyncBlobStores when
+// SyncOptions.Concurrency isn't set
+const DefaultSyncConcurrency = 8
+
+// syncCheckpointInterval is the number of handled blobs between two checkpoint file updates
+const syncCheckpointInterval = 100
+
+// ErrSyncStopped is returned by SyncBlobStores when it's been stopped through SyncOptions.Stop
+var ErrSyncStopped = errors.New("[sync] Sync stopped before completion")
+
+// SyncOptions tunes SyncBlobStores
+type SyncOptions struct {
+	// Prefix restricts the sync to the keys starting with it
+	Prefix string
+
+	Concurrency int
+
+	// CheckpointFile, if set, records the progress of the sync so that an interrupted run can be
+	// resumed: the keys a previous run went through are then skipped without being checked. It is
+	// removed once a run completes without errors, so that the next one checks every blob again.
+	CheckpointFile string
+
+	// DryRun only reports what would be copied and deleted
+	DryRun bool
+
+	// DeleteExtraneous deletes the destination blobs that don't exist in the source. It is skipped
+	// if any copy failed.
+	DeleteExtraneous bool
+
+	// VerifyByReading reads copied blobs back from the destination to check their checksum when the
+	// destination store doesn't provide a comparable content hash
+	VerifyByReading bool
+
+	// Logger, if set, logs every blob copied or deleted
+	Logger *log.Logger
+
+	// Stop, once closed, stops the sync gracefully: no further blob is copied, but the copies in
+	// progress complete (and are recorded in the checkpoint file) before SyncBlobStores returns
+	// ErrSyncStopped. Cancelling the context instead aborts the copies in progress.
+	Stop <-chan struct{}
+}
+
+// SyncReport sums up what SyncBlobStores did (or would have done, in dry-run mode)
+type SyncReport struct {
+	DryRun  bool
+	Scanned int
+
+	// Copied lists the keys copied (or that would have been, in dry-run mode)
+	Copied      []string
+	CopiedBytes int64
+
+	// UpToDate counts the blobs that were already identical in both stores, and Resumed the ones
+	// skipped thanks to the checkpoint file
+	UpToDate int
+	Resumed  int
+
+	// Deleted lists the extraneous keys deleted from the destination (or that would have been)
+	Deleted []string
+
+	Errors []error
+}
+
+// SyncBlobStores copies to dst the blobs of src that are missing from it or differ, along with
+// their metadata when both stores support it.
+//
+// A destination blob is considered up to date when it has the same size as the source one and the
+// same content hash, if both stores provide hashes of the same kind (or else a modification date
+// at least as recent). Every copied blob is checksummed while it is streamed, and the checksum is
+// checked against the content hashes of both stores.
+//
+// Failures to copy a blob are reported in SyncReport.Errors without stopping the sync. The
+// returned error is only set when listing blobs fails, ctx is done or the sync is stopped.
+func SyncBlobStores(ctx context.Context, src BlobStore, dst BlobStore, opts SyncOptions) (*SyncReport, error) {
+	s := &blobSync{
+		src:    AsContextBlobStore(src),
+		dst:    AsContextBlobStore(dst),
+		opts:   opts,
+		report: &SyncReport{DryRun: opts.DryRun},
+	}
+	if opts.DeleteExtraneous {
+		s.srcKeys = map[string]bool{}
+	}
+	if s.opts.Concurrency <= 0 {
+		s.opts.Concurrency = DefaultSyncConcurrency
+	}
+
+	checkpoint, err := s.readCheckpoint()
+	if err != nil {
+		return s.report, err
+	}
+	s.progress = &syncProgress{checkpoint: checkpoint, done: map[int]string{}}
+
+	jobs := make(chan syncJob)
+	var wg sync.WaitGroup
+	for i := 0; i < s.opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				err := s.syncBlob(ctx, job.info)
+				s.complete(job, err)
+			}
+		}()
+	}
+
+	seq := 0
+	walkErr := WalkBlobs(ctx, src, opts.Prefix, func(info BlobInfo) error {
+		s.mutex.Lock()
+		s.report.Scanned++
+		if s.srcKeys != nil {
+			s.srcKeys[info.Key] = true
+		}
+		resumed := checkpoint.LastKey != "" && info.Key <= checkpoint.LastKey
+		if resumed {
+			s.report.Resumed++
+		}
+		s.mutex.Unlock()
+		if resumed {
+			return nil
+		}
+
+		select {
+		case <-opts.Stop:
+			return ErrSyncStopped
+		default:
+		}
+		select {
+		case jobs <- syncJob{seq: seq, info: info}:
+			seq++
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-opts.Stop:
+			return ErrSyncStopped
+		}
+	})
+	close(jobs)
+	wg.Wait()
+
+	if err := s.writeCheckpoint(); err != nil {
+		s.report.Errors = append(s.report.Errors, err)
+	}
+	if errors.Is(walkErr, ErrSyncStopped) {
+		return s.report, ErrSyncStopped
+	}
+	if walkErr != nil {
+		return s.report, fmt.Errorf("[sync] Error listing source blobs: %w", walkErr)
+	}
+
+	if opts.DeleteExtraneous {
+		if len(s.report.Errors) > 0 {
+			s.report.Errors = append(s.report.Errors, errors.New("[sync] Extraneous blobs weren't deleted because of previous errors"))
+		} else if err := s.deleteExtraneous(ctx); err != nil {
+			return s.report, err
+		}
+	}
+	if len(s.report.Errors) == 0 {
+		if err := s.removeCheckpoint(); err != nil {
+			s.report.Errors = append(s.report.Errors, err)
+		}
+	}
+	return s.report, nil
+}
+
+// blobSync holds the state of a SyncBlobStores run
+type blobSync struct {
+	src  ContextBlobStore
+	dst  ContextBlobStore
+	opts SyncOptions
+
+	mutex    sync.Mutex
+	report   *SyncReport
+	srcKeys  map[string]bool
+	progress *syncProgress
+}
+
+type syncJob struct {
+	seq  int
+	info BlobInfo
+}
+
+// syncBlob copies a blob if the destination doesn't hold an up to date copy of it
+func (s *blobSync) syncBlob(ctx context.Context, info BlobInfo) error {
+	current, err := s.dst.StatWithContext(ctx, info.Key)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+	if err == nil && syncUpToDate(info, *current) {
+		s.mutex.Lock()
+		s.report.UpToDate++
+		s.mutex.Unlock()
+		return nil
+	}
+
+	if s.opts.DryRun {
+		s.copied(info.Key, info.Size)
+		return nil
+	}
+	n, err := s.copyBlob(ctx, info)
+	if err != nil {
+		return err
+	}
+	s.copied(info.Key, n)
+	return nil
+}
+
+func (s *blobSync) copied(key string, size int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.report.Copied = append(s.report.Copied, key)
+	s.report.CopiedBytes += size
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf("[sync] Copied %s (%d bytes)", key, size)
+	}
+}
+
+// copyBlob streams a blob from src to dst, checksumming it on the way, and checks the copy against
+// the information listed about it. A copy that fails the check is deleted.
+func (s *blobSync) copyBlob(ctx context.Context, info BlobInfo) (int64, error) {
+	key := info.Key
+	mdst, withMetadata := s.dst.(MetadataBlobStore)
+	if _, ok := s.src.(MetadataBlobStore); ok && withMetadata && info.Metadata == nil {
+		// Listings don't include metadata
+		srcInfo, err := s.src.StatWithContext(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		info.Metadata = srcInfo.Metadata
+	}
+	rc, err := s.src.GetWithContext(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	sums := newBlobChecksums()
+	data := io.TeeReader(rc, sums)
+	if withMetadata && len(info.Metadata) > 0 {
+		err = mdst.PutWithMetadata(ctx, key, data, info.Size, info.Metadata)
+	} else {
+		err = s.dst.PutWithContext(ctx, key, data, info.Size)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.verify(ctx, key, &info, sums); err != nil {
+		if delErr := s.dst.DeleteWithContext(ctx, key); delErr != nil {
+			return 0, fmt.Errorf("%s (and the copy couldn't be deleted: %s)", err, delErr)
+		}
+		return 0, err
+	}
+	return sums.size, nil
+}
+
+// verify checks the copy of a blob against the checksums of the data streamed from the source
+func (s *blobSync) verify(ctx context.Context, key string, srcInfo *BlobInfo, sums *blobChecksums) error {
+	if sums.size != srcInfo.Size {
+		return fmt.Errorf("[sync] Source blob %s changed while being copied: expected %d bytes, read %d", key, srcInfo.Size, sums.size)
+	}
+	if ok, comparable := sums.match(srcInfo.ContentHash); comparable && !ok {
+		return fmt.Errorf("[sync] Checksum mismatch for blob %s: source content hash is %s", key, srcInfo.ContentHash)
+	}
+
+	dstInfo, err := s.dst.StatWithContext(ctx, key)
+	if err != nil {
+		return fmt.Errorf("[sync] Error checking copy of blob %s: %w", key, err)
+	}
+	if dstInfo.Size != sums.size {
+		return fmt.Errorf("[sync] Size mismatch for the copy of blob %s: expected %d bytes, got %d", key, sums.size, dstInfo.Size)
+	}
+	ok, comparable := sums.match(dstInfo.ContentHash)
+	if !comparable && s.opts.VerifyByReading {
+		ok, err = s.verifyByReading(ctx, key, sums)
+		if err != nil {
+			return err
+		}
+	}
+	if !ok && (comparable || s.opts.VerifyByReading) {
+		return fmt.Errorf("[sync] Checksum mismatch for the copy of blob %s", key)
+	}
+	return nil
+}
+
+func (s *blobSync) verifyByReading(ctx context.Context, key string, sums *blobChecksums) (bool, error) {
+	rc, err := s.dst.GetWithContext(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("[sync] Error reading back copy of blob %s: %w", key, err)
+	}
+	defer rc.Close()
+	copySums := newBlobChecksums()
+	if _, err := io.Copy(copySums, rc); err != nil {
+		return false, fmt.Errorf("[sync] Error reading back copy of blob %s: %w", key, err)
+	}
+	return copySums.size == sums.size && bytes.Equal(copySums.sha256.Sum(nil), sums.sha256.Sum(nil)), nil
+}
+
+// complete records the outcome of a job and updates the checkpoint
+func (s *blobSync) complete(job syncJob, err error) {
+	if err != nil {
+		s.mutex.Lock()
+		s.report.Errors = append(s.report.Errors, fmt.Errorf("[sync] Error syncing blob %s: %s", job.info.Key, err))
+		s.mutex.Unlock()
+	}
+	if s.progress.complete(job, err == nil) && !s.opts.DryRun {
+		if err := s.writeCheckpoint(); err != nil && s.opts.Logger != nil {
+			s.opts.Logger.Printf("%s", err)
+		}
+	}
+}
+
+// deleteExtraneous deletes the destination blobs that aren't in the source
+func (s *blobSync) deleteExtraneous(ctx context.Context) error {
+	var extraneous []string
+	err := WalkBlobs(ctx, s.dst, s.opts.Prefix, func(info BlobInfo) error {
+		if !s.srcKeys[info.Key] {
+			extraneous = append(extraneous, info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("[sync] Error listing destination blobs: %w", err)
+	}
+
+	for _, key := range extraneous {
+		if !s.opts.DryRun {
+			if err := s.dst.DeleteWithContext(ctx, key); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				s.report.Errors = append(s.report.Errors, fmt.Errorf("[sync] Error deleting extraneous blob %s: %s", key, err))
+				continue
+			}
+		}
+		s.report.Deleted = append(s.report.Deleted, key)
+		if s.opts.Logger != nil {
+			s.opts.Logger.Printf("[sync] Deleted %s", key)
+		}
+	}
+	return nil
+}
+
+// syncCheckpoint is the content of a checkpoint file: every key up to LastKey (included) has been
+// synced
+type syncCheckpoint struct {
+	Prefix  string `json:"prefix"`
+	LastKey string `json:"last_key"`
+}
+
+func (s *blobSync) readCheckpoint() (syncCheckpoint, error) {
+	checkpoint := syncCheckpoint{Prefix: s.opts.Prefix}
+	if s.opts.CheckpointFile == "" {
+		return checkpoint, nil
+	}
+	content, err := ioutil.ReadFile(s.opts.CheckpointFile)
+	if os.IsNotExist(err) {
+		return checkpoint, nil
+	}
+	if err != nil {
+		return checkpoint, fmt.Errorf("[sync] Error reading checkpoint file: %s", err)
+	}
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		return checkpoint, fmt.Errorf("[sync] Invalid checkpoint file %s: %s", s.opts.CheckpointFile, err)
+	}
+	if checkpoint.Prefix != s.opts.Prefix {
+		return checkpoint, fmt.Errorf("[sync] Checkpoint file %s was written for prefix %q, not %q", s.opts.CheckpointFile, checkpoint.Prefix, s.opts.Prefix)
+	}
+	return checkpoint, nil
+}
+
+// writeCheckpoint atomically replaces the checkpoint file
+func (s *blobSync) writeCheckpoint() error {
+	if s.opts.CheckpointFile == "" || s.opts.DryRun {
+		return nil
+	}
+	content, err := json.Marshal(s.progress.snapshot())
+	if err != nil {
+		return err
+	}
+	tmpPath := s.opts.CheckpointFile + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return fmt.Errorf("[sync] Error writing checkpoint file: %s", err)
+	}
+	if err := os.Rename(tmpPath, s.opts.CheckpointFile); err != nil {
+		return fmt.Errorf("[sync] Error writing checkpoint file: %s", err)
+	}
+	return nil
+}
+
+// removeCheckpoint removes the checkpoint file of a completed sync
+func (s *blobSync) removeCheckpoint() error {
+	if s.opts.CheckpointFile == "" || s.opts.DryRun {
+		return nil
+	}
+	if err := os.Remove(s.opts.CheckpointFile); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("[sync] Error removing checkpoint file: %s", err)
+	}
+	return nil
+}
+
+// syncProgress tracks the last key before which every blob has been synced. Jobs complete out of
+// order, so the ones completed beyond the first pending (or failed) one are kept aside until it
+// completes.
+type syncProgress struct {
+	mutex      sync.Mutex
+	checkpoint syncCheckpoint
+	next       int
+	done       map[int]string
+	handled    int
+}
+
+// complete records a job's completion and tells whether the checkpoint should be written
+func (p *syncProgress) complete(job syncJob, ok bool) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if ok {
+		p.done[job.seq] = job.info.Key
+	}
+	for {
+		key, found := p.done[p.next]
+		if !found {
+			break
+		}
+		delete(p.done, p.next)
+		p.checkpoint.LastKey = key
+		p.next++
+	}
+	p.handled++
+	return p.handled%syncCheckpointInterval == 0
+}
+
+func (p *syncProgress) snapshot() syncCheckpoint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.checkpoint
+}
+
+// syncUpToDate tells whether dst holds the same content as src
+func syncUpToDate(src BlobInfo, dst BlobInfo) bool {
+	if src.Size != dst.Size {
+		return false
+	}
+	srcAlgo, srcSum := splitContentHash(src.ContentHash)
+	dstAlgo, dstSum := splitContentHash(dst.ContentHash)
+	if srcAlgo != "" && srcAlgo == dstAlgo {
+		return srcSum == dstSum
+	}
+	return !dst.ModTime.Before(src.ModTime)
+}
+
+// splitContentHash splits a BlobInfo content hash into the name of its hash function and its value
+func splitContentHash(contentHash string) (string, string) {
+	i := strings.Index(contentHash, ":")
+	if i < 0 {
+		return "", ""
+	}
+	return contentHash[:i], strings.ToLower(contentHash[i+1:])
+}
+
+// blobChecksums computes the checksums of the data written to it, with the hash functions used in
+// BlobInfo content hashes
+type blobChecksums struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+	size   int64
+}
+
+func newBlobChecksums() *blobChecksums {
+	return &blobChecksums{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (c *blobChecksums) Write(p []byte) (int, error) {
+	c.md5.Write(p)
+	c.sha256.Write(p)
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// match compares the checksums with a content hash, and tells whether they could be compared
+func (c *blobChecksums) match(contentHash string) (ok bool, comparable bool) {
+	algo, sum := splitContentHash(contentHash)
+	switch algo {
+	case "md5":
+		return hex.EncodeToString(c.md5.Sum(nil)) == sum, true
+	case "sha256":
+		return hex.EncodeToString(c.sha256.Sum(nil)) == sum, true
+	}
+	return false, false
+}
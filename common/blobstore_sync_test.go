@@ -0,0 +1,146 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// stoppingBlobStore closes stop as soon as a blob starts being written to it, and then takes its
+// time to write it
+type stoppingBlobStore struct {
+	*MemoryBlobStore
+	stop chan struct{}
+	once sync.Once
+}
+
+func (s *stoppingBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	return s.PutWithMetadata(ctx, key, data, size, nil)
+}
+
+func (s *stoppingBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	s.once.Do(func() { close(s.stop) })
+	time.Sleep(20 * time.Millisecond)
+	return s.MemoryBlobStore.PutWithMetadata(ctx, key, data, size, metadata)
+}
+
+func TestSyncBlobStoresStopsGracefully(t *testing.T) {
+	src := NewMemoryBlobStore()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, src.Put(fmt.Sprintf("blob-%d", i), strings.NewReader("content"), 7))
+	}
+	dst := &stoppingBlobStore{MemoryBlobStore: NewMemoryBlobStore(), stop: make(chan struct{})}
+
+	report, err := SyncBlobStores(context.Background(), src, dst, SyncOptions{Concurrency: 1, Stop: dst.stop})
+	assert.Equal(t, ErrSyncStopped, err)
+	assert.Empty(t, report.Errors)
+	require.Equal(t, []string{"blob-0"}, report.Copied, "the copy in progress completes, no other one starts")
+	data, err := readBlob(t, dst.MemoryBlobStore, "blob-0")
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+}
+
+func TestSyncBlobStoresCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobsync")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoint.json")
+
+	src := NewMemoryBlobStore()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, src.Put(fmt.Sprintf("blob-%d", i), strings.NewReader("content"), 7))
+	}
+	dst := &stoppingBlobStore{MemoryBlobStore: NewMemoryBlobStore(), stop: make(chan struct{})}
+	opts := SyncOptions{Concurrency: 1, CheckpointFile: checkpointFile}
+
+	stopped := opts
+	stopped.Stop = dst.stop
+	_, err = SyncBlobStores(context.Background(), src, dst, stopped)
+	require.Equal(t, ErrSyncStopped, err)
+	checkpoint, err := ioutil.ReadFile(checkpointFile)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"prefix": "", "last_key": "blob-0"}`, string(checkpoint))
+
+	report, err := SyncBlobStores(context.Background(), src, dst.MemoryBlobStore, opts)
+	require.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, 1, report.Resumed)
+	assert.Len(t, report.Copied, 9)
+	_, err = os.Stat(checkpointFile)
+	assert.True(t, os.IsNotExist(err), "the checkpoint of a completed sync should be removed")
+
+	// The next run checks every blob again
+	require.NoError(t, src.Put("blob-0", strings.NewReader("updated"), 7))
+	report, err = SyncBlobStores(context.Background(), src, dst.MemoryBlobStore, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 0, report.Resumed)
+	assert.Equal(t, []string{"blob-0"}, report.Copied)
+	assert.Equal(t, 9, report.UpToDate)
+}
+
+func TestSyncBlobStoresUsesListedInfo(t *testing.T) {
+	mem := NewMemoryBlobStore()
+	require.NoError(t, mem.PutWithMetadata(context.Background(), "blob", strings.NewReader("content"), 7, map[string]string{"owner": "morpheo"}))
+
+	// Without metadata to copy, the source blobs aren't stat'ed again
+	src := NewFaultyBlobStore(mem)
+	src.Inject(Fault{Op: "stat", Fail: true})
+	report, err := SyncBlobStores(context.Background(), src, NewFaultyBlobStore(NewMemoryBlobStore()), SyncOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, []string{"blob"}, report.Copied)
+	assert.Equal(t, 0, src.Calls("stat"))
+
+	dst := NewMemoryBlobStore()
+	report, err = SyncBlobStores(context.Background(), mem, dst, SyncOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	info, err := dst.Stat("blob")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "morpheo"}, info.Metadata)
+}
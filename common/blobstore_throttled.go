@@ -0,0 +1,369 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// throttleChunkSize is the maximum number of bytes transferred between two rate limit checks
+const throttleChunkSize = 32 * 1024
+
+// ThrottleConfig describes the limits enforced by a ThrottledBlobStore. Zero values stand for "no
+// limit".
+type ThrottleConfig struct {
+	// BytesPerSecond limits the bandwidth used by all transfers together
+	BytesPerSecond int64
+
+	// OperationBytesPerSecond limits the bandwidth used by each kind of transfer ("put", "get" and
+	// "get_range"), in addition to BytesPerSecond
+	OperationBytesPerSecond map[string]int64
+
+	// MaxConcurrentTransfers caps the number of blobs being uploaded or downloaded at once. Further
+	// transfers wait for a running one to complete.
+	MaxConcurrentTransfers int
+}
+
+// ThrottleStats holds the statistics of one kind of transfer made through a ThrottledBlobStore
+type ThrottleStats struct {
+	Transfers int64
+	Bytes     int64
+
+	// Throttled is the time spent waiting for the bandwidth limits, and Queued the time spent
+	// waiting for a transfer slot
+	Throttled time.Duration
+	Queued    time.Duration
+}
+
+// ThrottledBlobStore limits the bandwidth and the number of concurrent transfers of a BlobStore.
+// Uploads are throttled while the underlying store reads them and downloads while they are read.
+// The readers returned by Get and GetRange hold a transfer slot until they are closed.
+type ThrottledBlobStore struct {
+	ContextBlobStore
+
+	store    BlobStore
+	global   *byteRateLimiter
+	limiters map[string]*byteRateLimiter
+	slots    chan struct{}
+
+	mutex sync.Mutex
+	stats map[string]*ThrottleStats
+}
+
+// throttledOperations are the kinds of transfer OperationBytesPerSecond can limit
+var throttledOperations = map[string]bool{"put": true, "get": true, "get_range": true}
+
+// NewThrottledBlobStore creates a new ThrottledBlobStore around store. It fails if
+// OperationBytesPerSecond limits an unknown kind of transfer.
+func NewThrottledBlobStore(store BlobStore, conf ThrottleConfig) (*ThrottledBlobStore, error) {
+	for op := range conf.OperationBytesPerSecond {
+		if !throttledOperations[op] {
+			return nil, fmt.Errorf("[throttle] Can't limit the bandwidth of unknown operation %q (expected put, get or get_range)", op)
+		}
+	}
+	s := &ThrottledBlobStore{
+		ContextBlobStore: AsContextBlobStore(store),
+		store:            store,
+		global:           newByteRateLimiter(conf.BytesPerSecond),
+		limiters:         map[string]*byteRateLimiter{},
+		stats:            map[string]*ThrottleStats{},
+	}
+	for op, rate := range conf.OperationBytesPerSecond {
+		s.limiters[op] = newByteRateLimiter(rate)
+	}
+	if conf.MaxConcurrentTransfers > 0 {
+		s.slots = make(chan struct{}, conf.MaxConcurrentTransfers)
+	}
+	return s, nil
+}
+
+// Stats returns a snapshot of the statistics of every kind of transfer made so far, by operation
+// name
+func (s *ThrottledBlobStore) Stats() map[string]ThrottleStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make(map[string]ThrottleStats, len(s.stats))
+	for op, opStats := range s.stats {
+		stats[op] = *opStats
+	}
+	return stats
+}
+
+// Publish exposes the statistics as an expvar variable. It fails if the name is already taken.
+func (s *ThrottledBlobStore) Publish(name string) error {
+	if expvar.Get(name) != nil {
+		return fmt.Errorf("[throttle] Error publishing blob store throttling stats: expvar %s already exists", name)
+	}
+	expvar.Publish(name, expvar.Func(func() interface{} { return s.Stats() }))
+	return nil
+}
+
+func (s *ThrottledBlobStore) record(op string, update func(stats *ThrottleStats)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats, ok := s.stats[op]
+	if !ok {
+		stats = &ThrottleStats{}
+		s.stats[op] = stats
+	}
+	update(stats)
+}
+
+// acquire waits for a transfer slot, and returns the function releasing it
+func (s *ThrottledBlobStore) acquire(ctx context.Context, op string) (func(), error) {
+	start := time.Now()
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	s.record(op, func(stats *ThrottleStats) {
+		stats.Transfers++
+		stats.Queued += time.Since(start)
+	})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if s.slots != nil {
+				<-s.slots
+			}
+		})
+	}, nil
+}
+
+// throttle wraps r to enforce the bandwidth limits of op
+func (s *ThrottledBlobStore) throttle(ctx context.Context, op string, r io.Reader) io.Reader {
+	limiters := []*byteRateLimiter{}
+	for _, l := range []*byteRateLimiter{s.global, s.limiters[op]} {
+		if l != nil {
+			limiters = append(limiters, l)
+		}
+	}
+	return &throttledReader{ctx: ctx, r: r, limiters: limiters, onRead: func(n int, throttled time.Duration) {
+		s.record(op, func(stats *ThrottleStats) {
+			stats.Bytes += int64(n)
+			stats.Throttled += throttled
+		})
+	}}
+}
+
+// Put uploads a blob, throttling reads from data
+func (s *ThrottledBlobStore) Put(key string, data io.Reader, size int64) error {
+	return s.PutWithContext(context.Background(), key, data, size)
+}
+
+// PutWithContext uploads a blob, throttling reads from data
+func (s *ThrottledBlobStore) PutWithContext(ctx context.Context, key string, data io.Reader, size int64) error {
+	release, err := s.acquire(ctx, "put")
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.ContextBlobStore.PutWithContext(ctx, key, s.throttle(ctx, "put", data), size)
+}
+
+// PutWithMetadata uploads a blob along with its metadata, throttling reads from data. It fails if
+// the underlying store doesn't support metadata.
+func (s *ThrottledBlobStore) PutWithMetadata(ctx context.Context, key string, data io.Reader, size int64, metadata map[string]string) error {
+	mstore, err := s.metadataStore()
+	if err != nil {
+		return err
+	}
+	release, err := s.acquire(ctx, "put")
+	if err != nil {
+		return err
+	}
+	defer release()
+	return mstore.PutWithMetadata(ctx, key, s.throttle(ctx, "put", data), size, metadata)
+}
+
+// SetMetadata replaces the metadata of a blob of the underlying store
+func (s *ThrottledBlobStore) SetMetadata(ctx context.Context, key string, metadata map[string]string) error {
+	mstore, err := s.metadataStore()
+	if err != nil {
+		return err
+	}
+	return mstore.SetMetadata(ctx, key, metadata)
+}
+
+func (s *ThrottledBlobStore) metadataStore() (MetadataBlobStore, error) {
+	mstore, ok := s.store.(MetadataBlobStore)
+	if !ok {
+		return nil, fmt.Errorf("[throttle] Underlying blob store (%T) doesn't support metadata", s.store)
+	}
+	return mstore, nil
+}
+
+// Get downloads a blob, throttling reads from the returned reader
+func (s *ThrottledBlobStore) Get(key string) (io.ReadCloser, error) {
+	return s.GetWithContext(context.Background(), key)
+}
+
+// GetWithContext downloads a blob, throttling reads from the returned reader
+func (s *ThrottledBlobStore) GetWithContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.get(ctx, "get", func() (io.ReadCloser, error) {
+		return s.ContextBlobStore.GetWithContext(ctx, key)
+	})
+}
+
+// GetRange downloads a part of a blob, throttling reads from the returned reader
+func (s *ThrottledBlobStore) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.GetRangeWithContext(context.Background(), key, offset, length)
+}
+
+// GetRangeWithContext downloads a part of a blob, throttling reads from the returned reader
+func (s *ThrottledBlobStore) GetRangeWithContext(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.get(ctx, "get_range", func() (io.ReadCloser, error) {
+		return GetBlobRange(ctx, s.store, key, offset, length)
+	})
+}
+
+func (s *ThrottledBlobStore) get(ctx context.Context, op string, open func() (io.ReadCloser, error)) (io.ReadCloser, error) {
+	release, err := s.acquire(ctx, op)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := open()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &readCloser{
+		Reader: s.throttle(ctx, op, rc),
+		Closer: releasingCloser{Closer: rc, release: release},
+	}, nil
+}
+
+// releasingCloser calls release once the underlying io.Closer is closed
+type releasingCloser struct {
+	io.Closer
+	release func()
+}
+
+func (c releasingCloser) Close() error {
+	defer c.release()
+	return c.Closer.Close()
+}
+
+// throttledReader delays reads so that the data read through it doesn't exceed the bandwidth of any
+// of its limiters
+type throttledReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*byteRateLimiter
+	onRead   func(n int, throttled time.Duration)
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(r.limiters) == 0 {
+		n, err := r.r.Read(p)
+		r.onRead(n, 0)
+		return n, err
+	}
+
+	chunk := throttleChunkSize
+	for _, l := range r.limiters {
+		if l.rate < int64(chunk) {
+			chunk = int(l.rate)
+		}
+	}
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+
+	var delay time.Duration
+	for _, l := range r.limiters {
+		if d := l.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	r.onRead(n, delay)
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+	return n, err
+}
+
+// byteRateLimiter is a token bucket refilled with rate bytes per second and holding up to one
+// second worth of them
+type byteRateLimiter struct {
+	mutex  sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// newByteRateLimiter returns a limiter enforcing rate, or nil if rate isn't positive
+func newByteRateLimiter(rate int64) *byteRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteRateLimiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n bytes from the bucket and returns how long the caller must wait before using
+// them, the bucket going into debt when it runs out of bytes
+func (l *byteRateLimiter) reserve(n int) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
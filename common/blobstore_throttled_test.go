@@ -0,0 +1,145 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestByteRateLimiterReserve(t *testing.T) {
+	assert.Nil(t, newByteRateLimiter(0))
+
+	l := newByteRateLimiter(1000)
+	assert.Equal(t, time.Duration(0), l.reserve(600), "the bucket starts with a second worth of bytes")
+	assert.Equal(t, time.Duration(0), l.reserve(400))
+	delay := l.reserve(500)
+	assert.InDelta(t, float64(500*time.Millisecond), float64(delay), float64(20*time.Millisecond))
+	delay = l.reserve(500)
+	assert.InDelta(t, float64(time.Second), float64(delay), float64(20*time.Millisecond), "debts add up")
+
+	l = newByteRateLimiter(1000)
+	l.last = l.last.Add(-time.Hour)
+	l.tokens = 0
+	assert.Equal(t, time.Duration(0), l.reserve(1000))
+	assert.True(t, l.reserve(1) > 0, "the bucket shouldn't hold more than a second worth of bytes")
+}
+
+func TestThrottledBlobStoreBandwidth(t *testing.T) {
+	store, err := NewThrottledBlobStore(NewMemoryBlobStore(), ThrottleConfig{
+		OperationBytesPerSecond: map[string]int64{"put": 1000},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, store.Put("blob", strings.NewReader(strings.Repeat("a", 1500)), 1500))
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, "1500 bytes at 1000 bytes/s should take 500ms")
+
+	start = time.Now()
+	rc, err := store.Get("blob")
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Len(t, data, 1500)
+	assert.True(t, time.Since(start) < 100*time.Millisecond, "gets shouldn't be throttled")
+
+	stats := store.Stats()
+	assert.Equal(t, int64(1500), stats["put"].Bytes)
+	assert.True(t, stats["put"].Throttled >= 400*time.Millisecond)
+	assert.Equal(t, time.Duration(0), stats["get"].Throttled)
+}
+
+func TestThrottledBlobStoreMaxConcurrentTransfers(t *testing.T) {
+	store, err := NewThrottledBlobStore(NewMemoryBlobStore(), ThrottleConfig{MaxConcurrentTransfers: 1})
+	require.NoError(t, err)
+	require.NoError(t, store.Put("a", strings.NewReader("a"), 1))
+
+	rc, err := store.Get("a")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() {
+		done <- store.Put("b", strings.NewReader("b"), 1)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Put should wait for the reader to be closed, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rc.Close()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Put should proceed once the reader is closed")
+	}
+	assert.True(t, store.Stats()["put"].Queued >= 50*time.Millisecond)
+}
+
+func TestThrottledBlobStoreCancelledWhileQueued(t *testing.T) {
+	store, err := NewThrottledBlobStore(NewMemoryBlobStore(), ThrottleConfig{MaxConcurrentTransfers: 1})
+	require.NoError(t, err)
+	require.NoError(t, store.Put("a", strings.NewReader("a"), 1))
+	rc, err := store.Get("a")
+	require.NoError(t, err)
+	defer rc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = store.PutWithContext(ctx, "b", strings.NewReader("b"), 1)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = store.GetWithContext(ctx, "a")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	exists, err := store.Exists("b")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, int64(1), store.Stats()["put"].Transfers, "cancelled transfers shouldn't be counted")
+}
+
+func TestThrottledBlobStoreRejectsUnknownOperations(t *testing.T) {
+	_, err := NewThrottledBlobStore(NewMemoryBlobStore(), ThrottleConfig{
+		OperationBytesPerSecond: map[string]int64{"put": 1000, "gets": 1000},
+	})
+	assert.Error(t, err)
+}
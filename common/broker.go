@@ -36,8 +36,12 @@
 package common
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 // Topics (task queue names) for our broker
@@ -61,23 +65,33 @@ type Consumer interface {
 
 	// Add a handler function to the consumer for a given topic name. Up to concurrency tasks will be
 	// executed in parrallel. After the given timeout is reached, the task will be considered failed
-	// and will be re-enqueued.
-	AddHandler(topic string, handler Handler, concurrency int, timeout time.Duration)
+	// and will be re-enqueued. Messages whose handling fails are retried with an exponential backoff
+	// (see RetryPolicy), unless the handler returns a fatal error (see IsFatalHandlerError).
+	AddHandler(topic string, handler Handler, concurrency int, timeout time.Duration) error
+
+	// Stop drains the consumer: no new message is accepted, and the messages being handled are kept
+	// alive until their handlers return or ctx is done. ConsumeUntilKilled returns once the consumer
+	// is stopped. Stop returns ctx's error if handlers were still running at the deadline; their
+	// messages are then redelivered by the broker.
+	Stop(ctx context.Context) error
 }
 
+// ErrConsumerStopped is returned when adding handlers to, or delivering messages to, a stopped
+// consumer
+var ErrConsumerStopped = errors.New("consumer stopped")
+
 // Handler is an abstract Interface to a message handler Abstracts the way messages are handled so
 // that different handlers can easily be passed for different topics
 type Handler func(message []byte) error
 
 // HandlerFatalError is a simple wrapper type around fatal handler errors. If a fatal error occurred
 // during the handling of a message, the latter won't be requeued.
-// TODO: try and unit test the behaviour of this interface
 type HandlerFatalError struct {
 	message string
 }
 
 func (err HandlerFatalError) Error() string {
-	return fmt.Sprintf("Fatal error in handler: ")
+	return fmt.Sprintf("Fatal error in handler: %s", err.message)
 }
 
 // NewHandlerFatalError builds an HandlerFatalError given an error message
@@ -86,3 +100,51 @@ func NewHandlerFatalError(err error) HandlerFatalError {
 		message: err.Error(),
 	}
 }
+
+// IsFatalHandlerError tells whether a handler error means that the message it failed to handle
+// shouldn't be retried: HandlerFatalError and FatalTaskError are fatal, any other error (such as a
+// TaskError) is considered transient.
+func IsFatalHandlerError(err error) bool {
+	var handlerErr HandlerFatalError
+	var handlerErrPtr *HandlerFatalError
+	var taskErr *FatalTaskError
+	return errors.As(err, &handlerErr) || errors.As(err, &handlerErrPtr) || errors.As(err, &taskErr)
+}
+
+// RetryPolicy tells how many times consumers attempt to handle a message before giving up on it,
+// and how long they wait between attempts. The delay doubles after each failed attempt, from
+// InitialBackoff up to MaxBackoff.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times a message is handled (0 means no limit)
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy is the retry policy of the consumers that aren't given one
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 10 * time.Second,
+	MaxBackoff:     10 * time.Minute,
+}
+
+// Backoff returns the delay to wait for before retrying a message whose attempt-th handling
+// failed (attempts being numbered from 1)
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < attempt && delay <= math.MaxInt64/2; i++ {
+		delay *= 2
+		if p.MaxBackoff > 0 && delay >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	return delay
+}
+
+// GiveUp tells whether a message shouldn't be retried after its attempt-th handling failed with err
+func (p RetryPolicy) GiveUp(attempt int, err error) bool {
+	return IsFatalHandlerError(err) || (p.MaxAttempts > 0 && attempt >= p.MaxAttempts)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// DeadLetterTopicSuffix is appended to a topic name to get the name of the topic its dead letters
+// are published to
+const DeadLetterTopicSuffix = ".dead"
+
+// ErrDeadLetterNotPublished is returned by the handlers built by NewDeadLetterHandler when they give
+// up on a message but fail to publish its dead letter. The message should then be retried rather
+// than dropped, whatever its number of attempts.
+var ErrDeadLetterNotPublished = errors.New("dead letter not published")
+
+// DeadLetterTopic returns the name of the topic the dead letters of topic are published to
+func DeadLetterTopic(topic string) string {
+	return topic + DeadLetterTopicSuffix
+}
+
+// DeadLetter is published to a dead letter topic when a consumer gives up on a message, either
+// because its handler failed fatally or because it failed too many times. It holds the original
+// message along with what is known of its failure.
+type DeadLetter struct {
+	Topic string `json:"topic"`
+
+	// MessageID is the ID of the message's Envelope (if it has one) and Body the original message
+	MessageID string `json:"message_id,omitempty"`
+	Body      []byte `json:"body"`
+
+	Error    string `json:"error"`
+	Fatal    bool   `json:"fatal"`
+	Attempts int    `json:"attempts"`
+
+	// Hostname is the name of the host of the consumer that gave up on the message
+	Hostname string `json:"hostname"`
+
+	// PublishedAt is the time the original message was published at, if its envelope tells it
+	PublishedAt time.Time `json:"published_at,omitempty"`
+	FailedAt    time.Time `json:"failed_at"`
+}
+
+// NewDeadLetter creates the dead letter of a message that failed with err after the given number
+// of attempts. err may be nil if the consumer doesn't know why the message failed (when its
+// handling timed out for instance).
+func NewDeadLetter(topic string, body []byte, err error, attempts int, publishedAt time.Time) *DeadLetter {
+	hostname, _ := os.Hostname()
+	letter := &DeadLetter{
+		Topic:       topic,
+		Body:        body,
+		Error:       "unknown error (handling timed out?)",
+		Attempts:    attempts,
+		Hostname:    hostname,
+		PublishedAt: publishedAt,
+		FailedAt:    time.Now().UTC(),
+	}
+	if err != nil {
+		letter.Error = err.Error()
+		letter.Fatal = IsFatalHandlerError(err)
+	}
+	return letter
+}
+
+// PublishDeadLetter pushes a dead letter to the dead letter topic of its original topic
+func PublishDeadLetter(producer Producer, letter *DeadLetter) error {
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("[broker] Error marshaling dead letter: %s", err)
+	}
+	if err := producer.Push(DeadLetterTopic(letter.Topic), body); err != nil {
+		return fmt.Errorf("[broker] Error publishing dead letter to %s: %s", DeadLetterTopic(letter.Topic), err)
+	}
+	return nil
+}
+
+// NewDeadLetterHandler wraps an EnvelopeHandler so that the messages it fails to handle fatally, or
+// for the maxAttempts-th time (no limit if it isn't positive), are published to the dead letter topic
+// of topic. The wrapper then returns nil, so that the consumer acknowledges these messages rather
+// than retrying them, unless publishing their dead letter failed (see ErrDeadLetterNotPublished).
+// Other handler errors are returned as is. It relies on the consumer setting Envelope.Attempt.
+func NewDeadLetterHandler(topic string, handler EnvelopeHandler, producer Producer, maxAttempts int) EnvelopeHandler {
+	retry := RetryPolicy{MaxAttempts: maxAttempts}
+	return func(envelope *Envelope) error {
+		err := handler(envelope)
+		if err == nil || !retry.GiveUp(envelope.Attempt, err) {
+			return err
+		}
+
+		letter, letterErr := envelopeDeadLetter(topic, envelope, err)
+		if letterErr == nil {
+			letterErr = PublishDeadLetter(producer, letter)
+		}
+		if letterErr != nil {
+			return fmt.Errorf("%s (handler error: %s): %w", letterErr, err, ErrDeadLetterNotPublished)
+		}
+		log.Printf("[broker] Giving up on message %s after %d attempt(s), published to %s: %s", envelope.ID, envelope.Attempt, DeadLetterTopic(topic), err)
+		return nil
+	}
+}
+
+// envelopeDeadLetter creates the dead letter of an envelope, which holds the original message: the
+// body of legacy messages, and the envelope itself otherwise
+func envelopeDeadLetter(topic string, envelope *Envelope, err error) (*DeadLetter, error) {
+	body := envelope.Body
+	if !envelope.Legacy {
+		original := *envelope
+		original.Attempt = 0
+		message, marshalErr := original.Marshal()
+		if marshalErr != nil {
+			return nil, marshalErr
+		}
+		body = message
+	}
+	letter := NewDeadLetter(topic, body, err, envelope.Attempt, envelope.CreatedAt)
+	letter.MessageID = envelope.ID
+	return letter, nil
+}
+
+// ReplayDeadLetter republishes the original message of a dead letter (as consumed from a dead
+// letter topic) to its original topic
+func ReplayDeadLetter(producer Producer, message []byte) error {
+	var letter DeadLetter
+	if err := json.Unmarshal(message, &letter); err != nil {
+		return NewHandlerFatalError(fmt.Errorf("[broker] Invalid dead letter: %s", err))
+	}
+	if letter.Topic == "" {
+		return NewHandlerFatalError(fmt.Errorf("[broker] Dead letter has no topic"))
+	}
+	if err := producer.Push(letter.Topic, letter.Body); err != nil {
+		return fmt.Errorf("[broker] Error replaying dead letter to %s: %s", letter.Topic, err)
+	}
+	return nil
+}
+
+// NewDeadLetterReplayHandler returns a Handler replaying the dead letters it consumes, to be
+// added to a consumer for a dead letter topic:
+//
+//	consumer.AddHandler(DeadLetterTopic(TrainTopic), NewDeadLetterReplayHandler(producer), 1, time.Minute)
+func NewDeadLetterReplayHandler(producer Producer) Handler {
+	return func(message []byte) error {
+		return ReplayDeadLetter(producer, message)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterHandler(t *testing.T) {
+	deadLetters := &recordingProducer{}
+	handlerErr := errors.New("storage unavailable")
+	consumer := &ConsumerMOCK{}
+	require.NoError(t, consumer.AddEnvelopeHandler("train", NewDeadLetterHandler("train", func(envelope *Envelope) error {
+		return handlerErr
+	}, deadLetters, 3), 1, 0))
+
+	// Failures are returned for the broker to retry the message, until the last attempt
+	for attempt := 1; attempt < 3; attempt++ {
+		assert.Equal(t, handlerErr, consumer.DeliverAttempt("train", []byte(`{"key":"value"}`), attempt))
+	}
+	assert.Empty(t, deadLetters.deadLetters(t, "train"))
+	assert.NoError(t, consumer.DeliverAttempt("train", []byte(`{"key":"value"}`), 3))
+
+	letters := deadLetters.deadLetters(t, "train")
+	require.Len(t, letters, 1)
+	assert.Equal(t, "train", letters[0].Topic)
+	assert.Equal(t, []byte(`{"key":"value"}`), letters[0].Body)
+	assert.Equal(t, "storage unavailable", letters[0].Error)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.False(t, letters[0].Fatal)
+}
+
+func TestDeadLetterHandlerFatalErrors(t *testing.T) {
+	deadLetters := &recordingProducer{}
+	consumer := &ConsumerMOCK{}
+	require.NoError(t, consumer.AddEnvelopeHandler("train", NewDeadLetterHandler("train", func(envelope *Envelope) error {
+		return NewHandlerFatalError(errors.New("invalid learnuplet"))
+	}, deadLetters, 0), 1, 0))
+
+	envelope := NewEnvelope([]byte(`{"key":"value"}`))
+	message, err := envelope.Marshal()
+	require.NoError(t, err)
+	assert.NoError(t, consumer.Deliver("train", message))
+
+	letters := deadLetters.deadLetters(t, "train")
+	require.Len(t, letters, 1)
+	assert.True(t, letters[0].Fatal)
+	assert.Equal(t, 1, letters[0].Attempts)
+	assert.Equal(t, envelope.ID, letters[0].MessageID)
+	assert.Equal(t, envelope.CreatedAt, letters[0].PublishedAt)
+
+	// The dead letter holds the original envelope, which can be replayed as is
+	replayed := &recordingProducer{}
+	require.NoError(t, ReplayDeadLetter(replayed, deadLetters.messages[DeadLetterTopic("train")][0]))
+	replayedEnvelope, err := UnwrapMessage(replayed.messages["train"][0])
+	require.NoError(t, err)
+	assert.Equal(t, envelope.ID, replayedEnvelope.ID)
+	assert.Equal(t, 0, replayedEnvelope.Attempt)
+	assert.Equal(t, envelope.Body, replayedEnvelope.Body)
+}
+
+func TestDeadLetterHandlerUnpublishedDeadLetters(t *testing.T) {
+	deadLetters := &recordingProducer{err: errors.New("broker unavailable")}
+	handler := NewDeadLetterHandler("train", func(envelope *Envelope) error {
+		return errors.New("storage unavailable")
+	}, deadLetters, 1)
+
+	err := handler(&Envelope{Body: []byte(`{}`), Legacy: true, Attempt: 1})
+	assert.True(t, errors.Is(err, ErrDeadLetterNotPublished), "%v", err)
+	assert.False(t, IsFatalHandlerError(err), "the message should be retried")
+
+	deadLetters.err = nil
+	assert.NoError(t, handler(&Envelope{Body: []byte(`{}`), Legacy: true, Attempt: 2}))
+	assert.Len(t, deadLetters.deadLetters(t, "train"), 1)
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// EnvelopeVersion is the version of the Envelope format written by this package
+const EnvelopeVersion = 1
+
+// Content types of envelope bodies: JSON bodies are embedded as is in their envelope, others are
+// base64 encoded
+const (
+	ContentTypeJSON   = "application/json"
+	ContentTypeBinary = "application/octet-stream"
+)
+
+// Well-known envelope headers
+const (
+	HeaderTraceID = "trace_id"
+	HeaderTenant  = "tenant"
+)
+
+// Envelope wraps the messages exchanged through the broker with metadata, so that a task can be
+// followed from its producer to the worker handling it. Producers wrap message bodies in an
+// envelope and consumers unwrap them before calling their handlers. Messages that aren't wrapped in
+// an envelope (as published by older producers) are still accepted by consumers.
+type Envelope struct {
+	EnvelopeVersion int       `json:"envelope_version"`
+	ID              string    `json:"id"`
+	ContentType     string    `json:"content_type"`
+	SchemaVersion   string    `json:"schema_version,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+
+	// Attempt is the number of times the message has been delivered, including the current one. It
+	// is set by consumers, if their broker tells it.
+	Attempt int `json:"attempt,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Body is embedded as a JSON value in the marshaled envelope if its content type is JSON, and as
+	// a base64 string otherwise
+	Body []byte `json:"body"`
+
+	// Legacy is set on the envelopes built by UnwrapMessage around raw (legacy) messages
+	Legacy bool `json:"-"`
+}
+
+// NewEnvelope wraps a message body in a new envelope, with a random ID. Its content type is JSON,
+// unless the body isn't valid JSON.
+func NewEnvelope(body []byte) *Envelope {
+	return &Envelope{
+		EnvelopeVersion: EnvelopeVersion,
+		ID:              uuid.NewV4().String(),
+		ContentType:     bodyContentType(body),
+		CreatedAt:       time.Now().UTC(),
+		Headers:         map[string]string{},
+		Body:            body,
+	}
+}
+
+// Header returns the value of a header, or an empty string if it isn't set
+func (e *Envelope) Header(name string) string {
+	return e.Headers[name]
+}
+
+// SetHeader sets the value of a header
+func (e *Envelope) SetHeader(name string, value string) {
+	if e.Headers == nil {
+		e.Headers = map[string]string{}
+	}
+	e.Headers[name] = value
+}
+
+// Marshal returns the message to publish for an envelope
+func (e *Envelope) Marshal() ([]byte, error) {
+	message, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("[broker] Error marshaling envelope %s: %s", e.ID, err)
+	}
+	return message, nil
+}
+
+// envelopeFields has the fields of Envelope, without its methods
+type envelopeFields Envelope
+
+// envelopeJSON is the JSON representation of an Envelope, its body being either a JSON value or a
+// base64 string depending on its content type
+type envelopeJSON struct {
+	*envelopeFields
+	Body json.RawMessage `json:"body"`
+}
+
+// MarshalJSON embeds JSON bodies as is, and base64 encodes the others
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	body := json.RawMessage(e.Body)
+	if !isJSONContentType(e.ContentType) {
+		encoded, err := json.Marshal(e.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = encoded
+	} else if len(body) == 0 {
+		body = json.RawMessage("null")
+	} else if !json.Valid(body) {
+		return nil, fmt.Errorf("[broker] Body of envelope %s isn't valid %s", e.ID, e.ContentType)
+	}
+	return json.Marshal(envelopeJSON{envelopeFields: (*envelopeFields)(e), Body: body})
+}
+
+// UnmarshalJSON decodes the body according to the content type of the envelope
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	aux := envelopeJSON{envelopeFields: (*envelopeFields)(e)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if len(aux.Body) == 0 {
+		e.Body = nil
+		return nil
+	}
+	if !isJSONContentType(e.ContentType) {
+		e.Body = nil
+		return json.Unmarshal(aux.Body, &e.Body)
+	}
+	e.Body = []byte(aux.Body)
+	return nil
+}
+
+// isJSONContentType tells whether a content type is JSON (application/json or any +json type). An
+// empty content type is considered JSON, the default.
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// bodyContentType returns the content type of a message body: JSON if it is valid JSON, binary
+// otherwise
+func bodyContentType(body []byte) string {
+	if json.Valid(body) {
+		return ContentTypeJSON
+	}
+	return ContentTypeBinary
+}
+
+// WrapMessage wraps a message body in a new envelope. Messages that already are envelopes are
+// returned as is.
+func WrapMessage(body []byte) ([]byte, error) {
+	if version, ok := envelopeVersion(body); ok && version > 0 {
+		return body, nil
+	}
+	return NewEnvelope(body).Marshal()
+}
+
+// UnwrapMessage returns the envelope of a message. Messages that aren't envelopes are considered
+// legacy raw messages: they are returned in an envelope with no metadata, and Legacy set.
+func UnwrapMessage(message []byte) (*Envelope, error) {
+	version, ok := envelopeVersion(message)
+	if !ok || version <= 0 {
+		return &Envelope{ContentType: bodyContentType(message), Body: message, Legacy: true}, nil
+	}
+	if version > EnvelopeVersion {
+		return nil, NewHandlerFatalError(fmt.Errorf("[broker] Unsupported envelope version %d", version))
+	}
+
+	envelope := &Envelope{}
+	if err := json.Unmarshal(message, envelope); err != nil {
+		return nil, NewHandlerFatalError(fmt.Errorf("[broker] Invalid envelope: %s", err))
+	}
+	return envelope, nil
+}
+
+// envelopeVersion returns the envelope version of a message, if it is a JSON object
+func envelopeVersion(message []byte) (int, bool) {
+	var probe struct {
+		EnvelopeVersion int `json:"envelope_version"`
+	}
+	if err := json.Unmarshal(message, &probe); err != nil {
+		return 0, false
+	}
+	return probe.EnvelopeVersion, true
+}
+
+// legacyProducer is implemented by the producers that can be configured not to wrap messages in
+// envelopes
+type legacyProducer interface {
+	legacyPayloads() bool
+}
+
+// PushEnvelope publishes an envelope (with its headers set by the caller) to a topic. Producers
+// configured for legacy payloads are given the envelope's body only.
+func PushEnvelope(producer Producer, topic string, envelope *Envelope) error {
+	if legacy, ok := producer.(legacyProducer); ok && legacy.legacyPayloads() {
+		return producer.Push(topic, envelope.Body)
+	}
+	message, err := envelope.Marshal()
+	if err != nil {
+		return err
+	}
+	return producer.Push(topic, message)
+}
+
+// EnvelopeHandler is a message handler that is given the envelope of the messages it handles,
+// rather than their body
+type EnvelopeHandler func(envelope *Envelope) error
+
+// EnvelopeConsumer is implemented by the consumers that can call EnvelopeHandlers
+type EnvelopeConsumer interface {
+	// AddEnvelopeHandler is the same as Consumer.AddHandler, for an EnvelopeHandler
+	AddEnvelopeHandler(topic string, handler EnvelopeHandler, concurrency int, timeout time.Duration) error
+}
+
+// bodyHandler adapts a Handler to an EnvelopeHandler
+func bodyHandler(handler Handler) EnvelopeHandler {
+	return func(envelope *Envelope) error {
+		return handler(envelope.Body)
+	}
+}
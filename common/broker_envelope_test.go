@@ -0,0 +1,123 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrapMessageEmbedsJSONBodies(t *testing.T) {
+	message, err := WrapMessage([]byte(`{"key":"value"}`))
+	require.NoError(t, err)
+
+	var raw map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(message, &raw))
+	assert.JSONEq(t, `{"key":"value"}`, string(raw["body"]), "JSON bodies shouldn't be base64 encoded")
+	assert.Equal(t, `"application/json"`, string(raw["content_type"]))
+
+	envelope, err := UnwrapMessage(message)
+	require.NoError(t, err)
+	assert.False(t, envelope.Legacy)
+	assert.Equal(t, EnvelopeVersion, envelope.EnvelopeVersion)
+	assert.NotEmpty(t, envelope.ID)
+	assert.JSONEq(t, `{"key":"value"}`, string(envelope.Body))
+
+	rewrapped, err := WrapMessage(message)
+	require.NoError(t, err)
+	assert.Equal(t, message, rewrapped, "envelopes shouldn't be wrapped twice")
+}
+
+func TestWrapMessageEncodesBinaryBodies(t *testing.T) {
+	body := []byte{0, 1, 2, 0xff}
+	message, err := WrapMessage(body)
+	require.NoError(t, err)
+
+	var raw map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(message, &raw))
+	assert.Equal(t, `"AAEC/w=="`, string(raw["body"]))
+	assert.Equal(t, `"application/octet-stream"`, string(raw["content_type"]))
+
+	envelope, err := UnwrapMessage(message)
+	require.NoError(t, err)
+	assert.Equal(t, ContentTypeBinary, envelope.ContentType)
+	assert.Equal(t, body, envelope.Body)
+}
+
+func TestEnvelopeRejectsInvalidJSONBodies(t *testing.T) {
+	envelope := NewEnvelope([]byte(`{"key":"value"}`))
+	envelope.Body = []byte(`{"key":`)
+	_, err := envelope.Marshal()
+	assert.Error(t, err)
+
+	envelope.ContentType = "application/vnd.morpheo.task+json; charset=utf-8"
+	envelope.Body = []byte(`["task"]`)
+	message, err := envelope.Marshal()
+	require.NoError(t, err)
+	unwrapped, err := UnwrapMessage(message)
+	require.NoError(t, err)
+	assert.Equal(t, `["task"]`, string(unwrapped.Body))
+}
+
+func TestUnwrapMessageLegacyPayloads(t *testing.T) {
+	for _, message := range []string{
+		`{"key":"value"}`,
+		`{"envelope_version":0,"body":"payload"}`,
+		`["a","list"]`,
+		`"a string"`,
+		`42`,
+		`not JSON`,
+	} {
+		envelope, err := UnwrapMessage([]byte(message))
+		require.NoError(t, err, message)
+		assert.True(t, envelope.Legacy, message)
+		assert.Equal(t, message, string(envelope.Body), "legacy payloads should be handed over as is")
+		assert.Empty(t, envelope.ID, message)
+	}
+}
+
+func TestUnwrapMessageFutureVersions(t *testing.T) {
+	_, err := UnwrapMessage([]byte(`{"envelope_version":2,"id":"a","body":{}}`))
+	require.Error(t, err)
+	assert.True(t, IsFatalHandlerError(err), "messages of unsupported versions should be given up on")
+
+	_, err = UnwrapMessage([]byte(`{"envelope_version":1,"id":42}`))
+	require.Error(t, err)
+	assert.True(t, IsFatalHandlerError(err))
+}
@@ -36,7 +36,11 @@
 package common
 
 import (
+	"fmt"
+	"sync"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 const (
@@ -59,16 +63,103 @@ func (p *ProducerMOCK) Stop() {
 	return
 }
 
-// ConsumerMOCK implements an MOCK version of our Consumer interface
+// ConsumerMOCK implements an MOCK version of our Consumer interface. It doesn't receive messages
+// from any broker, but they can be delivered to its handlers with Deliver.
 type ConsumerMOCK struct {
+	mutex    sync.Mutex
+	handlers map[string]EnvelopeHandler
+	stopping bool
+	stopped  chan struct{}
+	wg       sync.WaitGroup
 }
 
-// ConsumeUntilKilled listens for messages on a given MOCK (topic, channel) pair until it's killed
+// ConsumeUntilKilled blocks until the MOCK consumer is stopped
 func (c *ConsumerMOCK) ConsumeUntilKilled() {
-	return
+	<-c.stoppedChan()
 }
 
-// AddHandler adds a handler function (with a tunable level of concurrency) to our MOCK consumer
+// Stop refuses new messages and waits for the ones being delivered to be handled, or for ctx to be
+// done
+func (c *ConsumerMOCK) Stop(ctx context.Context) error {
+	c.mutex.Lock()
+	if c.stopping {
+		c.mutex.Unlock()
+		return fmt.Errorf("[mock] Error stopping consumer: %w", ErrConsumerStopped)
+	}
+	c.stopping = true
+	c.mutex.Unlock()
+	defer close(c.stoppedChan())
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("[mock] Error draining consumer: %w", ctx.Err())
+	}
+}
+
+// AddHandler adds a handler function to our MOCK consumer
 func (c *ConsumerMOCK) AddHandler(topic string, handler Handler, concurrency int, timeout time.Duration) (err error) {
+	return c.AddEnvelopeHandler(topic, bodyHandler(handler), concurrency, timeout)
+}
+
+// AddEnvelopeHandler adds an envelope handler function to our MOCK consumer
+func (c *ConsumerMOCK) AddEnvelopeHandler(topic string, handler EnvelopeHandler, concurrency int, timeout time.Duration) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopping {
+		return fmt.Errorf("[mock] Error adding handler for topic %s: %w", topic, ErrConsumerStopped)
+	}
+	if c.handlers == nil {
+		c.handlers = map[string]EnvelopeHandler{}
+	}
+	c.handlers[topic] = handler
 	return nil
 }
+
+// Deliver synchronously hands a message to the handler of its topic, as a first attempt, and returns
+// the handler's error. Messages are refused once the consumer is stopping.
+func (c *ConsumerMOCK) Deliver(topic string, body []byte) error {
+	return c.DeliverAttempt(topic, body, 1)
+}
+
+// DeliverAttempt is the same as Deliver, the message being delivered for the attempt-th time, as if
+// its previous handlings had failed
+func (c *ConsumerMOCK) DeliverAttempt(topic string, body []byte, attempt int) error {
+	c.mutex.Lock()
+	if c.stopping {
+		c.mutex.Unlock()
+		return fmt.Errorf("[mock] Error delivering message to topic %s: %w", topic, ErrConsumerStopped)
+	}
+	handler, ok := c.handlers[topic]
+	if !ok {
+		c.mutex.Unlock()
+		return fmt.Errorf("[mock] Error delivering message: no handler for topic %s", topic)
+	}
+	c.wg.Add(1)
+	c.mutex.Unlock()
+	defer c.wg.Done()
+
+	envelope, err := UnwrapMessage(body)
+	if err != nil {
+		return err
+	}
+	envelope.Attempt = attempt
+	return handler(envelope)
+}
+
+// stoppedChan returns the channel closed once the consumer is stopped, creating it if needed so that
+// the zero value of ConsumerMOCK can be used
+func (c *ConsumerMOCK) stoppedChan() chan struct{} {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopped == nil {
+		c.stopped = make(chan struct{})
+	}
+	return c.stopped
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+func TestConsumerMOCKStop(t *testing.T) {
+	consumer := &ConsumerMOCK{}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	require.NoError(t, consumer.AddEnvelopeHandler("train", blockingHandler(started, release), 1, time.Minute))
+
+	delivered := make(chan error, 1)
+	go func() {
+		delivered <- consumer.Deliver("train", []byte(`{}`))
+	}()
+	<-started
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- consumer.Stop(context.Background())
+	}()
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case err := <-stopped:
+		t.Fatalf("Stop returned before the delivered message was handled: %v", err)
+	default:
+	}
+
+	// Deliveries are refused once the consumer is stopping
+	err := consumer.Deliver("train", []byte(`{}`))
+	assert.True(t, errors.Is(err, ErrConsumerStopped), "%v", err)
+	assert.Empty(t, started)
+	err = consumer.AddHandler("test", func([]byte) error { return nil }, 1, time.Minute)
+	assert.True(t, errors.Is(err, ErrConsumerStopped), "%v", err)
+
+	close(release)
+	assert.NoError(t, <-delivered)
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Stop didn't return once the message was handled")
+	}
+	consumer.ConsumeUntilKilled()
+
+	err = consumer.Stop(context.Background())
+	assert.True(t, errors.Is(err, ErrConsumerStopped), "%v", err)
+}
+
+func TestConsumerMOCKStopDeadline(t *testing.T) {
+	consumer := &ConsumerMOCK{}
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	require.NoError(t, consumer.AddEnvelopeHandler("train", blockingHandler(started, release), 1, time.Minute))
+	go consumer.Deliver("train", []byte(`{}`))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := consumer.Stop(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+}
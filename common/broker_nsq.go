@@ -36,13 +36,16 @@
 package common
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/nsqio/go-nsq"
+	"golang.org/x/net/context"
 )
 
 const (
@@ -56,12 +59,19 @@ type ProducerNSQ struct {
 	Producer
 
 	NsqProducer *nsq.Producer
+
+	// LegacyPayloads disables the wrapping of messages in an Envelope, for consumers that don't
+	// support envelopes yet. It is set by NewNSQProducer for now: consumers accept both envelopes
+	// and legacy payloads, so all of them must be upgraded before producers are switched to
+	// envelopes by setting it to false.
+	LegacyPayloads bool
 }
 
 // NewNSQProducer creates an instance of NSQProducer. Produced messages are sent to an Nsqd instance
-// accessible under the given (host, port) TCP/IP destination
+// accessible under the given (host, port) TCP/IP destination, as legacy payloads (see
+// LegacyPayloads).
 func NewNSQProducer(hostname string, port int) (p *ProducerNSQ, err error) {
-	p = &ProducerNSQ{}
+	p = &ProducerNSQ{LegacyPayloads: true}
 
 	config := nsq.NewConfig()
 	p.NsqProducer, err = nsq.NewProducer(fmt.Sprintf("%s:%d", hostname, port), config)
@@ -72,8 +82,14 @@ func NewNSQProducer(hostname string, port int) (p *ProducerNSQ, err error) {
 	return p, nil
 }
 
-// Push sends a message to the nsqd instance bound to p under a given topic
+// Push sends a message to the nsqd instance bound to p under a given topic, wrapped in an Envelope
+// (unless it already is one, or p is set to send legacy payloads)
 func (p *ProducerNSQ) Push(topic string, body []byte) (err error) {
+	if !p.LegacyPayloads {
+		if body, err = WrapMessage(body); err != nil {
+			return err
+		}
+	}
 	err = p.NsqProducer.Publish(topic, body)
 	if err != nil {
 		return fmt.Errorf("Error publishing to NSQ: %s", err)
@@ -81,6 +97,10 @@ func (p *ProducerNSQ) Push(topic string, body []byte) (err error) {
 	return nil
 }
 
+func (p *ProducerNSQ) legacyPayloads() bool {
+	return p.LegacyPayloads
+}
+
 // Stop stops the NSQProducer instances (no more messages will be forwarded to nsqd)
 func (p *ProducerNSQ) Stop() {
 	p.NsqProducer.Stop()
@@ -96,6 +116,18 @@ type ConsumerNSQ struct {
 	QueuePollingInterval time.Duration
 	Channel              string
 	Logger               *log.Logger
+
+	// Retry is the retry policy applied to the messages of the handlers added afterwards
+	Retry RetryPolicy
+
+	// DeadLetters, if set, is used to publish the messages given up on to their topic's dead letter
+	// topic (see NewDeadLetterHandler). They are dropped otherwise.
+	DeadLetters Producer
+
+	mutex    sync.Mutex
+	handlers []*handlerWrapper
+	stopping bool
+	stopped  chan struct{}
 }
 
 // NewNSQConsumer instantiates ConsumerNSQ for the provided channel, using provided nsqlookupd URLs
@@ -107,6 +139,7 @@ func NewNSQConsumer(lookupUrls []string, nsqdURL string, channel string, queuePo
 		QueuePollingInterval: queuePollingInterval,
 		NsqConsumer:          map[string]*nsq.Consumer{},
 		Logger:               logger,
+		Retry:                DefaultRetryPolicy,
 	}
 }
 
@@ -132,16 +165,86 @@ func (c *ConsumerNSQ) ConsumeUntilKilled() {
 		// Using a channel for this purpose is a bit weird... but why not Bitly guys :)
 		<-consumer.StopChan
 	}
+
+	// go-nsq gives up on waiting for in-flight messages after 30s, so let's wait for Stop to drain
+	// them if it's the one that stopped the consumers
+	c.mutex.Lock()
+	stopped := c.stopped
+	c.mutex.Unlock()
+	if stopped != nil {
+		<-stopped
+	}
+}
+
+// Stop drains the consumer: nsqd stops sending messages, the ones already received but not handled
+// yet are requeued, and the ones being handled are touched until their handlers return or ctx is
+// done
+func (c *ConsumerNSQ) Stop(ctx context.Context) (err error) {
+	c.mutex.Lock()
+	if c.stopping {
+		c.mutex.Unlock()
+		return fmt.Errorf("[nsq] Error stopping consumer: %w", ErrConsumerStopped)
+	}
+	c.stopping = true
+	c.stopped = make(chan struct{})
+	handlers := c.handlers
+	c.mutex.Unlock()
+	defer close(c.stopped)
+
+	log.Printf("[nsq] Stopping consumer, waiting for in-flight messages to be handled...")
+	for _, consumer := range c.NsqConsumer {
+		consumer.Stop()
+	}
+
+	errs := make(chan error, len(handlers))
+	for _, hw := range handlers {
+		go func(hw *handlerWrapper) {
+			errs <- hw.drain(ctx)
+		}(hw)
+	}
+	for range handlers {
+		if drainErr := <-errs; drainErr != nil && err == nil {
+			err = drainErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("[nsq] Error draining consumer, messages still in flight will be redelivered: %w", err)
+	}
+
+	for _, consumer := range c.NsqConsumer {
+		select {
+		case <-consumer.StopChan:
+		case <-ctx.Done():
+			return fmt.Errorf("[nsq] Error waiting for NSQ connections to close: %w", ctx.Err())
+		}
+	}
+	log.Printf("[nsq] Consumer stopped")
+	return nil
 }
 
-// AddHandler adds a handler function (with a tunable level of concurrency) to our NSQ consumer
+// AddHandler adds a handler function (with a tunable level of concurrency) to our NSQ consumer. The
+// handler is given the body of messages, unwrapped from their Envelope.
 func (c *ConsumerNSQ) AddHandler(topic string, handler Handler, concurrency int, timeout time.Duration) (err error) {
+	return c.AddEnvelopeHandler(topic, bodyHandler(handler), concurrency, timeout)
+}
+
+// AddEnvelopeHandler adds a handler function (with a tunable level of concurrency) to our NSQ
+// consumer. The handler is given the Envelope of messages, with its Attempt set.
+func (c *ConsumerNSQ) AddEnvelopeHandler(topic string, handler EnvelopeHandler, concurrency int, timeout time.Duration) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopping {
+		return fmt.Errorf("[nsq] Error adding handler for topic %s: %w", topic, ErrConsumerStopped)
+	}
 	log.Printf("Adding %d handler(s) for topic %s.", concurrency, topic)
 
 	// Let's add our handler to that (topic, channel) tuple
 	config := nsq.NewConfig()
 	config.LookupdPollInterval = c.QueuePollingInterval
-	config.MaxAttempts = 1
+	// The attempt limit is enforced by handlerWrapper (including for the messages nsqd requeued
+	// because their handling timed out): go-nsq would finish messages past it without dead
+	// lettering them, even when publishing their dead letter failed the previous time
+	config.MaxAttempts = 0
 	config.HeartbeatInterval = c.QueuePollingInterval
 	config.MsgTimeout = timeout
 
@@ -150,8 +253,10 @@ func (c *ConsumerNSQ) AddHandler(topic string, handler Handler, concurrency int,
 		return fmt.Errorf("Error creating NSQ Consumer for topic %s: %s", topic, err)
 	}
 	consumer.SetLogger(c.Logger, nsq.LogLevelWarning)
-	consumer.AddConcurrentHandlers(newHandlerWrapper(handler), concurrency)
+	hw := newHandlerWrapper(topic, handler, c.Retry, c.DeadLetters, timeout)
+	consumer.AddConcurrentHandlers(hw, concurrency)
 	c.NsqConsumer[topic] = consumer
+	c.handlers = append(c.handlers, hw)
 
 	// Pre-create Topics in order to avoid "404 not found Error" in logs
 	if err := c.CreateTopic(topic); err != nil {
@@ -161,28 +266,134 @@ func (c *ConsumerNSQ) AddHandler(topic string, handler Handler, concurrency int,
 	return nil
 }
 
+// handlerWrapper calls a Handler on NSQ messages, finishing them once they've been handled or
+// given up on (after being dead lettered), and requeuing them with an exponential backoff otherwise.
+// It keeps track of the messages being handled so that they can be drained.
 type handlerWrapper struct {
 	nsq.Handler
 
-	handler Handler
+	topic       string
+	handler     EnvelopeHandler
+	retry       RetryPolicy
+	deadLetters Producer
+	timeout     time.Duration
+
+	mutex    sync.Mutex
+	inFlight map[*nsq.Message]struct{}
+	draining bool
+	wg       sync.WaitGroup
 }
 
-func newHandlerWrapper(handler Handler) *handlerWrapper {
+func newHandlerWrapper(topic string, handler EnvelopeHandler, retry RetryPolicy, deadLetters Producer, timeout time.Duration) *handlerWrapper {
 	return &handlerWrapper{
-		handler: handler,
+		topic:       topic,
+		handler:     handler,
+		retry:       retry,
+		deadLetters: deadLetters,
+		timeout:     timeout,
+		inFlight:    map[*nsq.Message]struct{}{},
 	}
 }
 
 func (hw *handlerWrapper) HandleMessage(message *nsq.Message) (err error) {
 	log.Printf("[DEBUG][nsq] nsq-consumer received task")
-	err = hw.handler(message.Body)
-	// TODO: smart backoff strategy
-	// if _, fatal := err.(HandlerFatalError); fatal {
-	message.Finish()
-	// }
+	message.DisableAutoResponse()
+	if !hw.begin(message) {
+		// The consumer is stopping: leave the message to another one
+		message.RequeueWithoutBackoff(0)
+		return nil
+	}
+	defer hw.end(message)
+
+	attempt := int(message.Attempts)
+	handler := hw.handler
+	envelope, err := UnwrapMessage(message.Body)
+	if err != nil {
+		// Messages that can't be unwrapped are given up on (and dead lettered) as is
+		unwrapErr := err
+		envelope = &Envelope{ContentType: bodyContentType(message.Body), Body: message.Body, Legacy: true}
+		handler = func(*Envelope) error { return unwrapErr }
+	}
+	envelope.Attempt = attempt
+	if hw.deadLetters != nil {
+		handler = NewDeadLetterHandler(hw.topic, handler, hw.deadLetters, hw.retry.MaxAttempts)
+	}
+	err = handler(envelope)
+	if err == nil {
+		message.Finish()
+		return nil
+	}
+
+	switch {
+	case errors.Is(err, ErrDeadLetterNotPublished):
+		// Better handle the message once more than lose it
+		log.Printf("[nsq] %s, requeuing message %s", err, message.ID[:])
+		message.RequeueWithoutBackoff(hw.retry.Backoff(attempt))
+	case hw.retry.GiveUp(attempt, err):
+		log.Printf("[nsq] Giving up on message %s after %d attempt(s), dropping it: %s", message.ID[:], attempt, err)
+		message.Finish()
+	default:
+		delay := hw.retry.Backoff(attempt)
+		log.Printf("[nsq] Error handling message %s (attempt %d), retrying in %s: %s", message.ID[:], attempt, delay, err)
+		message.RequeueWithoutBackoff(delay)
+	}
 	return err
 }
 
+// begin registers a message as being handled, unless the wrapper is draining
+func (hw *handlerWrapper) begin(message *nsq.Message) bool {
+	hw.mutex.Lock()
+	defer hw.mutex.Unlock()
+	if hw.draining {
+		return false
+	}
+	hw.inFlight[message] = struct{}{}
+	hw.wg.Add(1)
+	return true
+}
+
+func (hw *handlerWrapper) end(message *nsq.Message) {
+	hw.mutex.Lock()
+	delete(hw.inFlight, message)
+	hw.mutex.Unlock()
+	hw.wg.Done()
+}
+
+// drain refuses new messages and waits for the ones being handled, touching them every half
+// timeout so that nsqd doesn't redeliver them meanwhile
+func (hw *handlerWrapper) drain(ctx context.Context) error {
+	hw.mutex.Lock()
+	hw.draining = true
+	hw.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		hw.wg.Wait()
+		close(done)
+	}()
+
+	interval := hw.timeout / 2
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			hw.mutex.Lock()
+			for message := range hw.inFlight {
+				message.Touch()
+			}
+			hw.mutex.Unlock()
+		}
+	}
+}
+
 // CreateTopic creates a topic in Nsqd, avoiding initial "404 error not found"
 func (c *ConsumerNSQ) CreateTopic(topic string) error {
 	url := fmt.Sprintf("http://%s/topic/create?topic=%s", c.NsqdURL, topic)
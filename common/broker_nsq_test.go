@@ -0,0 +1,408 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nsqio/go-nsq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/context"
+)
+
+// fakeNSQDelegate records what handlerWrapper does with the messages it's given, in place of an
+// nsqd connection
+type fakeNSQDelegate struct {
+	mutex    sync.Mutex
+	finished bool
+	requeued bool
+	delay    time.Duration
+	backoff  bool
+	touches  int
+}
+
+func (d *fakeNSQDelegate) OnFinish(m *nsq.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.finished = true
+}
+
+func (d *fakeNSQDelegate) OnRequeue(m *nsq.Message, delay time.Duration, backoff bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.requeued = true
+	d.delay = delay
+	d.backoff = backoff
+}
+
+func (d *fakeNSQDelegate) OnTouch(m *nsq.Message) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.touches++
+}
+
+// snapshot returns a copy of what the delegate recorded so far
+func (d *fakeNSQDelegate) snapshot() fakeNSQDelegate {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return fakeNSQDelegate{finished: d.finished, requeued: d.requeued, delay: d.delay, backoff: d.backoff, touches: d.touches}
+}
+
+// recordingProducer keeps the messages pushed to it, or fails to push them if err is set
+type recordingProducer struct {
+	mutex    sync.Mutex
+	err      error
+	messages map[string][][]byte
+}
+
+func (p *recordingProducer) Push(topic string, body []byte) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	if p.messages == nil {
+		p.messages = map[string][][]byte{}
+	}
+	p.messages[topic] = append(p.messages[topic], body)
+	return nil
+}
+
+func (p *recordingProducer) Stop() {}
+
+func (p *recordingProducer) deadLetters(t *testing.T, topic string) []DeadLetter {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var letters []DeadLetter
+	for _, body := range p.messages[DeadLetterTopic(topic)] {
+		var letter DeadLetter
+		require.NoError(t, json.Unmarshal(body, &letter))
+		letters = append(letters, letter)
+	}
+	return letters
+}
+
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 10 * time.Millisecond,
+	MaxBackoff:     time.Second,
+}
+
+// newNSQMessage creates a message delivered for the attempt-th time, reporting to a fake delegate
+func newNSQMessage(body []byte, attempt int) (*nsq.Message, *fakeNSQDelegate) {
+	delegate := &fakeNSQDelegate{}
+	var id nsq.MessageID
+	copy(id[:], "0123456789abcdef")
+	message := nsq.NewMessage(id, body)
+	message.Attempts = uint16(attempt)
+	message.Timestamp = time.Now().UnixNano()
+	message.Delegate = delegate
+	return message, delegate
+}
+
+// handleNSQMessage hands a message, delivered for the attempt-th time, to a handlerWrapper and
+// returns what the wrapper did with it
+func handleNSQMessage(hw *handlerWrapper, body []byte, attempt int) *fakeNSQDelegate {
+	message, delegate := newNSQMessage(body, attempt)
+	hw.HandleMessage(message)
+	return delegate
+}
+
+func TestNSQHandlerRequeuesWithBackoff(t *testing.T) {
+	handlerErr := errors.New("storage unavailable")
+	hw := newHandlerWrapper("train", bodyHandler(func([]byte) error { return handlerErr }), testRetryPolicy, nil, time.Minute)
+
+	for attempt, delay := range map[int]time.Duration{1: 10 * time.Millisecond, 2: 20 * time.Millisecond} {
+		delegate := handleNSQMessage(hw, []byte(`{}`), attempt)
+		assert.False(t, delegate.finished, "attempt %d", attempt)
+		assert.True(t, delegate.requeued, "attempt %d", attempt)
+		assert.Equal(t, delay, delegate.delay, "attempt %d", attempt)
+		assert.False(t, delegate.backoff, "attempt %d: the consumer itself shouldn't back off", attempt)
+	}
+}
+
+func TestNSQHandlerFinishesHandledMessages(t *testing.T) {
+	var attempts []int
+	hw := newHandlerWrapper("train", func(envelope *Envelope) error {
+		attempts = append(attempts, envelope.Attempt)
+		return nil
+	}, testRetryPolicy, nil, time.Minute)
+
+	delegate := handleNSQMessage(hw, []byte(`{}`), 2)
+	assert.True(t, delegate.finished)
+	assert.False(t, delegate.requeued)
+	assert.Equal(t, []int{2}, attempts)
+}
+
+func TestNSQHandlerFinishesFatalErrors(t *testing.T) {
+	for _, handlerErr := range []error{
+		NewHandlerFatalError(errors.New("invalid learnuplet")),
+		fmt.Errorf("wrapped: %w", &FatalTaskError{}),
+	} {
+		deadLetters := &recordingProducer{}
+		hw := newHandlerWrapper("train", bodyHandler(func([]byte) error { return handlerErr }), testRetryPolicy, deadLetters, time.Minute)
+
+		delegate := handleNSQMessage(hw, []byte(`{}`), 1)
+		assert.True(t, delegate.finished, "%s", handlerErr)
+		assert.False(t, delegate.requeued, "%s", handlerErr)
+		letters := deadLetters.deadLetters(t, "train")
+		require.Len(t, letters, 1)
+		assert.True(t, letters[0].Fatal)
+		assert.Equal(t, 1, letters[0].Attempts)
+	}
+}
+
+func TestNSQHandlerDeadLettersAfterMaxAttempts(t *testing.T) {
+	deadLetters := &recordingProducer{}
+	hw := newHandlerWrapper("train", bodyHandler(func([]byte) error { return errors.New("storage unavailable") }), testRetryPolicy, deadLetters, time.Minute)
+
+	delegate := handleNSQMessage(hw, []byte(`{"key":"value"}`), testRetryPolicy.MaxAttempts)
+	assert.True(t, delegate.finished)
+	assert.False(t, delegate.requeued)
+	letters := deadLetters.deadLetters(t, "train")
+	require.Len(t, letters, 1)
+	assert.False(t, letters[0].Fatal)
+	assert.Equal(t, testRetryPolicy.MaxAttempts, letters[0].Attempts)
+	assert.Equal(t, "storage unavailable", letters[0].Error)
+	assert.Equal(t, []byte(`{"key":"value"}`), letters[0].Body)
+
+	// Messages redelivered by nsqd past the limit (after their handling timed out) are given up on
+	// as well
+	delegate = handleNSQMessage(hw, []byte(`{}`), testRetryPolicy.MaxAttempts+1)
+	assert.True(t, delegate.finished)
+	assert.Len(t, deadLetters.deadLetters(t, "train"), 2)
+}
+
+func TestNSQHandlerDeadLettersInvalidEnvelopes(t *testing.T) {
+	deadLetters := &recordingProducer{}
+	hw := newHandlerWrapper("train", func(*Envelope) error {
+		t.Error("the handler shouldn't be given messages that can't be unwrapped")
+		return nil
+	}, testRetryPolicy, deadLetters, time.Minute)
+
+	message := []byte(`{"envelope_version":99,"body":{}}`)
+	delegate := handleNSQMessage(hw, message, 1)
+	assert.True(t, delegate.finished)
+	letters := deadLetters.deadLetters(t, "train")
+	require.Len(t, letters, 1)
+	assert.True(t, letters[0].Fatal)
+	assert.Equal(t, message, letters[0].Body)
+}
+
+func TestNSQHandlerRequeuesUndeliverableDeadLetters(t *testing.T) {
+	deadLetters := &recordingProducer{err: errors.New("nsqd unavailable")}
+	hw := newHandlerWrapper("train", bodyHandler(func([]byte) error { return errors.New("storage unavailable") }), testRetryPolicy, deadLetters, time.Minute)
+
+	delegate := handleNSQMessage(hw, []byte(`{}`), testRetryPolicy.MaxAttempts)
+	assert.False(t, delegate.finished)
+	assert.True(t, delegate.requeued)
+
+	// It's handled (and dead lettered) again once redelivered
+	deadLetters.err = nil
+	delegate = handleNSQMessage(hw, []byte(`{}`), testRetryPolicy.MaxAttempts+1)
+	assert.True(t, delegate.finished)
+	assert.Len(t, deadLetters.deadLetters(t, "train"), 1)
+}
+
+// blockingHandler returns a handler that signals on started when it's called, and then waits for
+// release to be closed
+func blockingHandler(started chan<- struct{}, release <-chan struct{}) EnvelopeHandler {
+	return func(*Envelope) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}
+}
+
+func TestNSQHandlerDrain(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	hw := newHandlerWrapper("train", blockingHandler(started, release), testRetryPolicy, nil, 20*time.Millisecond)
+
+	message, inFlight := newNSQMessage([]byte(`{}`), 1)
+	go hw.HandleMessage(message)
+	<-started
+	drained := make(chan error, 1)
+	go func() {
+		drained <- hw.drain(context.Background())
+	}()
+
+	// The message being handled is kept alive while the wrapper drains
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, inFlight.snapshot().touches >= 2, "in-flight messages should be touched every half timeout")
+	select {
+	case err := <-drained:
+		t.Fatalf("drain returned before the message was handled: %v", err)
+	default:
+	}
+
+	// New messages are left to other consumers
+	delegate := handleNSQMessage(hw, []byte(`{}`), 1).snapshot()
+	assert.True(t, delegate.requeued)
+	assert.Equal(t, time.Duration(0), delegate.delay)
+	assert.False(t, delegate.finished)
+	assert.Empty(t, started, "the handler shouldn't be given messages while draining")
+
+	close(release)
+	select {
+	case err := <-drained:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("drain didn't return once the message was handled")
+	}
+	assert.True(t, inFlight.snapshot().finished)
+}
+
+func TestNSQConsumerStopDeadline(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	hw := newHandlerWrapper("train", blockingHandler(started, release), testRetryPolicy, nil, time.Minute)
+	consumer := &ConsumerNSQ{NsqConsumer: map[string]*nsq.Consumer{}, handlers: []*handlerWrapper{hw}}
+
+	message, delegate := newNSQMessage([]byte(`{}`), 1)
+	go hw.HandleMessage(message)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := consumer.Stop(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.False(t, delegate.snapshot().finished)
+
+	err = consumer.Stop(context.Background())
+	assert.True(t, errors.Is(err, ErrConsumerStopped), "%v", err)
+	assert.True(t, errors.Is(consumer.AddHandler("test", func([]byte) error { return nil }, 1, time.Minute), ErrConsumerStopped))
+
+	stopped := make(chan struct{})
+	go func() {
+		consumer.ConsumeUntilKilled()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeUntilKilled should return once the consumer is stopped")
+	}
+}
+
+// testNSQD returns the TCP and HTTP addresses of the nsqd instance to run the integration tests
+// against (set with NSQD_ADDRESS, its HTTP port being the next one), skipping the test if it isn't
+// reachable
+func testNSQD(t *testing.T) (string, string) {
+	address := os.Getenv("NSQD_ADDRESS")
+	if address == "" {
+		address = "127.0.0.1:4150"
+	}
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Skipf("No nsqd listening on %s (set NSQD_ADDRESS to run this test): %s", address, err)
+	}
+	conn.Close()
+
+	host, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+	tcpPort, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return address, net.JoinHostPort(host, strconv.Itoa(tcpPort+1))
+}
+
+func TestNSQConsumerRetries(t *testing.T) {
+	address, httpAddress := testNSQD(t)
+	host, port, _ := net.SplitHostPort(address)
+	tcpPort, _ := strconv.Atoi(port)
+	topic := fmt.Sprintf("test-retries-%d", time.Now().UnixNano())
+
+	producer, err := NewNSQProducer(host, tcpPort)
+	require.NoError(t, err)
+	defer producer.Stop()
+
+	deadLetters := &recordingProducer{}
+	consumer := NewNSQConsumer(nil, httpAddress, "test", 100*time.Millisecond, nil)
+	consumer.Retry = testRetryPolicy
+	consumer.DeadLetters = deadLetters
+
+	var mutex sync.Mutex
+	attempts := map[string][]int{}
+	done := make(chan struct{}, 2)
+	require.NoError(t, consumer.AddEnvelopeHandler(topic, func(envelope *Envelope) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		body := string(envelope.Body)
+		attempts[body] = append(attempts[body], envelope.Attempt)
+		switch {
+		case body == `"transient"` && envelope.Attempt < 2:
+			return errors.New("storage unavailable")
+		case body == `"transient"`:
+			done <- struct{}{}
+			return nil
+		case envelope.Attempt >= testRetryPolicy.MaxAttempts:
+			done <- struct{}{}
+		}
+		return errors.New("storage still unavailable")
+	}, 1, time.Minute))
+	require.NoError(t, consumer.NsqConsumer[topic].ConnectToNSQD(address))
+	defer consumer.NsqConsumer[topic].Stop()
+
+	require.NoError(t, producer.Push(topic, []byte(`"transient"`)))
+	require.NoError(t, producer.Push(topic, []byte(`"persistent"`)))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for the messages to be retried")
+		}
+	}
+
+	// Let the wrapper finish the last message
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []int{1, 2}, attempts[`"transient"`])
+	assert.Equal(t, []int{1, 2, 3}, attempts[`"persistent"`])
+	letters := deadLetters.deadLetters(t, topic)
+	require.Len(t, letters, 1)
+	assert.Equal(t, testRetryPolicy.MaxAttempts, letters[0].Attempts)
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Schema versions recorded in the envelopes of task messages
+const (
+	LearnupletSchemaVersion = "learnuplet/v1"
+	PredupletSchemaVersion  = "preduplet/v1"
+)
+
+// PublishLearnuplet validates a learnuplet and publishes it to the train topic
+func PublishLearnuplet(producer Producer, learnuplet Learnuplet) error {
+	return PublishTask(producer, TrainTopic, LearnupletSchemaVersion, &learnuplet, nil)
+}
+
+// PublishPreduplet validates a preduplet and publishes it to the prediction topic
+func PublishPreduplet(producer Producer, preduplet Preduplet) error {
+	return PublishTask(producer, PredictTopic, PredupletSchemaVersion, &preduplet, nil)
+}
+
+// PublishTask validates a task and publishes it to a topic as JSON, in an Envelope carrying the
+// given schema version and headers (or as raw JSON to the producers configured for legacy payloads)
+func PublishTask(producer Producer, topic string, schemaVersion string, task Checkable, headers map[string]string) error {
+	if err := task.Check(); err != nil {
+		return fmt.Errorf("[broker] Invalid %s task: %s", topic, err)
+	}
+	body, err := json.Marshal(task)
+	if err != nil {
+		return fmt.Errorf("[broker] Error marshaling %s task: %s", topic, err)
+	}
+
+	envelope := NewEnvelope(body)
+	envelope.SchemaVersion = schemaVersion
+	for name, value := range headers {
+		envelope.SetHeader(name, value)
+	}
+	return PushEnvelope(producer, topic, envelope)
+}
+
+// AddLearnupletHandler adds a learnuplet handler to a consumer of the train topic (see
+// NewLearnupletHandler)
+func AddLearnupletHandler(consumer Consumer, handler func(learnuplet Learnuplet) error, concurrency int, timeout time.Duration) error {
+	return addTaskHandler(consumer, TrainTopic, newLearnupletEnvelopeHandler(handler), concurrency, timeout)
+}
+
+// AddPredupletHandler adds a preduplet handler to a consumer of the prediction topic (see
+// NewPredupletHandler)
+func AddPredupletHandler(consumer Consumer, handler func(preduplet Preduplet) error, concurrency int, timeout time.Duration) error {
+	return addTaskHandler(consumer, PredictTopic, newPredupletEnvelopeHandler(handler), concurrency, timeout)
+}
+
+// NewLearnupletHandler returns a Handler decoding and checking learnuplets before passing them to
+// handler. Malformed learnuplets result in a HandlerFatalError, so that they aren't retried.
+func NewLearnupletHandler(handler func(learnuplet Learnuplet) error) Handler {
+	return unwrappingHandler(newLearnupletEnvelopeHandler(handler))
+}
+
+// NewPredupletHandler returns a Handler decoding and checking preduplets before passing them to
+// handler. Malformed preduplets result in a HandlerFatalError, so that they aren't retried.
+func NewPredupletHandler(handler func(preduplet Preduplet) error) Handler {
+	return unwrappingHandler(newPredupletEnvelopeHandler(handler))
+}
+
+func newLearnupletEnvelopeHandler(handler func(learnuplet Learnuplet) error) EnvelopeHandler {
+	return func(envelope *Envelope) error {
+		var learnuplet Learnuplet
+		if err := decodeTask(envelope, LearnupletSchemaVersion, &learnuplet); err != nil {
+			return err
+		}
+		return handler(learnuplet)
+	}
+}
+
+func newPredupletEnvelopeHandler(handler func(preduplet Preduplet) error) EnvelopeHandler {
+	return func(envelope *Envelope) error {
+		var preduplet Preduplet
+		if err := decodeTask(envelope, PredupletSchemaVersion, &preduplet); err != nil {
+			return err
+		}
+		return handler(preduplet)
+	}
+}
+
+// addTaskHandler adds a task handler to a consumer. Consumers that don't pass envelopes to their
+// handlers give them the message bodies only, so that the schema version can't be checked.
+func addTaskHandler(consumer Consumer, topic string, handler EnvelopeHandler, concurrency int, timeout time.Duration) error {
+	if envelopeConsumer, ok := consumer.(EnvelopeConsumer); ok {
+		return envelopeConsumer.AddEnvelopeHandler(topic, handler, concurrency, timeout)
+	}
+	return consumer.AddHandler(topic, unwrappingHandler(handler), concurrency, timeout)
+}
+
+// unwrappingHandler adapts an EnvelopeHandler to the consumers that don't unwrap messages (or
+// whose messages are legacy raw payloads)
+func unwrappingHandler(handler EnvelopeHandler) Handler {
+	return func(message []byte) error {
+		envelope, err := UnwrapMessage(message)
+		if err != nil {
+			return err
+		}
+		return handler(envelope)
+	}
+}
+
+// decodeTask unmarshals and checks the task carried by an envelope, whose schema version (if any)
+// must be the expected one
+func decodeTask(envelope *Envelope, schemaVersion string, task Checkable) error {
+	if envelope.SchemaVersion != "" && envelope.SchemaVersion != schemaVersion {
+		return NewHandlerFatalError(fmt.Errorf("[broker] Unsupported task schema version %s (expected %s)", envelope.SchemaVersion, schemaVersion))
+	}
+	if err := json.Unmarshal(envelope.Body, task); err != nil {
+		return NewHandlerFatalError(fmt.Errorf("[broker] Malformed task: %s", err))
+	}
+	if err := task.Check(); err != nil {
+		return NewHandlerFatalError(fmt.Errorf("[broker] Invalid task: %s", err))
+	}
+	return nil
+}
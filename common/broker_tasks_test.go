@@ -0,0 +1,144 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bodyConsumer hides the envelope support of the consumer it wraps
+type bodyConsumer struct {
+	Consumer
+}
+
+// legacyRecordingProducer records messages like a producer configured for legacy payloads
+type legacyRecordingProducer struct {
+	recordingProducer
+}
+
+func (p *legacyRecordingProducer) legacyPayloads() bool {
+	return true
+}
+
+func testLearnuplet() Learnuplet {
+	return Learnuplet{
+		Key:       "learnuplet",
+		Problem:   uuid.NewV4(),
+		Algo:      uuid.NewV4(),
+		TrainData: []uuid.UUID{uuid.NewV4()},
+		TestData:  []uuid.UUID{uuid.NewV4()},
+		Status:    TaskStatusTodo,
+	}
+}
+
+func TestPublishLearnuplet(t *testing.T) {
+	learnuplet := testLearnuplet()
+	producer := &recordingProducer{}
+	require.NoError(t, PublishLearnuplet(producer, learnuplet))
+	require.Len(t, producer.messages[TrainTopic], 1)
+
+	envelope, err := UnwrapMessage(producer.messages[TrainTopic][0])
+	require.NoError(t, err)
+	assert.False(t, envelope.Legacy)
+	assert.Equal(t, LearnupletSchemaVersion, envelope.SchemaVersion)
+
+	consumer := &ConsumerMOCK{}
+	var handled []Learnuplet
+	require.NoError(t, AddLearnupletHandler(consumer, func(learnuplet Learnuplet) error {
+		handled = append(handled, learnuplet)
+		return nil
+	}, 1, 0))
+	require.NoError(t, consumer.Deliver(TrainTopic, producer.messages[TrainTopic][0]))
+	assert.Equal(t, []Learnuplet{learnuplet}, handled)
+
+	assert.Error(t, PublishLearnuplet(producer, Learnuplet{}), "invalid learnuplets aren't published")
+	assert.Len(t, producer.messages[TrainTopic], 1)
+}
+
+func TestPublishLearnupletLegacyPayloads(t *testing.T) {
+	learnuplet := testLearnuplet()
+	producer := &legacyRecordingProducer{}
+	require.NoError(t, PublishLearnuplet(producer, learnuplet))
+	require.Len(t, producer.messages[TrainTopic], 1)
+
+	var published Learnuplet
+	require.NoError(t, json.Unmarshal(producer.messages[TrainTopic][0], &published))
+	assert.Equal(t, learnuplet, published)
+}
+
+func TestLearnupletHandlerChecksSchemaVersion(t *testing.T) {
+	body, err := json.Marshal(testLearnuplet())
+	require.NoError(t, err)
+	envelope := NewEnvelope(body)
+	envelope.SchemaVersion = PredupletSchemaVersion
+	message, err := envelope.Marshal()
+	require.NoError(t, err)
+
+	handled := 0
+	handler := func(Learnuplet) error {
+		handled++
+		return nil
+	}
+	consumer := &ConsumerMOCK{}
+	require.NoError(t, AddLearnupletHandler(consumer, handler, 1, 0))
+	err = consumer.Deliver(TrainTopic, message)
+	assert.True(t, IsFatalHandlerError(err), "%v", err)
+	assert.Equal(t, 0, handled)
+
+	// Handlers given the message bodies only can't tell the schema version
+	bodyOnly := &ConsumerMOCK{}
+	require.NoError(t, AddLearnupletHandler(bodyConsumer{bodyOnly}, handler, 1, 0))
+	assert.NoError(t, bodyOnly.Deliver(TrainTopic, message))
+	assert.Equal(t, 1, handled)
+}
+
+func TestLearnupletHandlerRejectsMalformedTasks(t *testing.T) {
+	consumer := &ConsumerMOCK{}
+	require.NoError(t, AddLearnupletHandler(consumer, func(Learnuplet) error {
+		t.Error("Malformed learnuplet handled")
+		return nil
+	}, 1, 0))
+
+	for _, message := range []string{`not json`, `{"key": "learnuplet"}`} {
+		err := consumer.Deliver(TrainTopic, []byte(message))
+		assert.True(t, IsFatalHandlerError(err), "%s: %v", message, err)
+	}
+}
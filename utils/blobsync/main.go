@@ -0,0 +1,129 @@
+/*
+ * Copyright Morpheo Org. 2017
+ *
+ * contact@morpheo.co
+ *
+ * This software is part of the Morpheo project, an open-source machine
+ * learning platform.
+ *
+ * This software is governed by the CeCILL license, compatible with the
+ * GNU GPL, under French law and abiding by the rules of distribution of
+ * free software. You can  use, modify and/ or redistribute the software
+ * under the terms of the CeCILL license as circulated by CEA, CNRS and
+ * INRIA at the following URL "http://www.cecill.info".
+ *
+ * As a counterpart to the access to the source code and  rights to copy,
+ * modify and redistribute granted by the license, users are provided only
+ * with a limited warranty  and the software's author,  the holder of the
+ * economic rights,  and the successive licensors  have only  limited
+ * liability.
+ *
+ * In this respect, the user's attention is drawn to the risks associated
+ * with loading,  using,  modifying and/or developing or reproducing the
+ * software by the user in light of its specific status of free software,
+ * that may mean  that it is complicated to manipulate,  and  that  also
+ * therefore means  that it is reserved for developers  and  experienced
+ * professionals having in-depth computer knowledge. Users are therefore
+ * encouraged to load and test the software's suitability as regards their
+ * requirements in conditions enabling the security of their systems and/or
+ * data to be ensured and,  more generally, to use and operate it in the
+ * same conditions as regards security.
+ *
+ * The fact that you are presently reading this means that you have had
+ * knowledge of the CeCILL license and that you accept its terms.
+ */
+
+// Command blobsync copies the blobs of a blob store to another one, both given as URLs (see
+// common.OpenBlobStore). It prints a summary of the sync and exits with a non-zero status if any
+// blob couldn't be synced.
+//
+//	blobsync -src file:///data -dst 's3://bucket?region=eu-west-1' -checkpoint /var/tmp/sync.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/MorpheoOrg/morpheo-go-packages/common"
+	"golang.org/x/net/context"
+)
+
+func main() {
+	var (
+		srcURL           = flag.String("src", "", "URL of the source blob store")
+		dstURL           = flag.String("dst", "", "URL of the destination blob store")
+		prefix           = flag.String("prefix", "", "Only sync the keys starting with this prefix")
+		concurrency      = flag.Int("concurrency", common.DefaultSyncConcurrency, "Number of blobs copied in parallel")
+		checkpoint       = flag.String("checkpoint", "", "File recording the progress of the sync, to resume it if interrupted (removed once the sync completes)")
+		dryRun           = flag.Bool("dry-run", false, "Only report what would be copied and deleted")
+		deleteExtraneous = flag.Bool("delete", false, "Delete the destination blobs that don't exist in the source")
+		verifyByReading  = flag.Bool("verify-by-reading", false, "Read copies back when the destination provides no comparable checksum")
+		quiet            = flag.Bool("quiet", false, "Don't log every blob copied or deleted")
+	)
+	flag.Parse()
+	if *srcURL == "" || *dstURL == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	src, err := common.OpenBlobStore(*srcURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst, err := common.OpenBlobStore(*dstURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Stop cleanly on SIGINT/SIGTERM, letting the current copies complete so that the checkpoint
+	// file is up to date. A second signal aborts them.
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Print("Interrupted, waiting for the current copies to complete (interrupt again to abort them)...")
+		close(stop)
+		<-signals
+		log.Print("Interrupted again, aborting the current copies...")
+		cancel()
+	}()
+
+	opts := common.SyncOptions{
+		Prefix:           *prefix,
+		Concurrency:      *concurrency,
+		CheckpointFile:   *checkpoint,
+		DryRun:           *dryRun,
+		DeleteExtraneous: *deleteExtraneous,
+		VerifyByReading:  *verifyByReading,
+		Stop:             stop,
+	}
+	if !*quiet {
+		opts.Logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	report, err := common.SyncBlobStores(ctx, src, dst, opts)
+
+	mode := ""
+	if report.DryRun {
+		mode = " (dry run)"
+	}
+	fmt.Printf("Scanned:    %d blobs%s\n", report.Scanned, mode)
+	fmt.Printf("Copied:     %d blobs (%d bytes)\n", len(report.Copied), report.CopiedBytes)
+	fmt.Printf("Up to date: %d blobs\n", report.UpToDate)
+	fmt.Printf("Resumed:    %d blobs\n", report.Resumed)
+	fmt.Printf("Deleted:    %d blobs\n", len(report.Deleted))
+	for _, syncErr := range report.Errors {
+		log.Print(syncErr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}